@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"sort"
+	"sync"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// Exoscale organization managed with its own credentials
+type AccountConfig struct {
+	Name            string           `yaml:"name"`
+	CredentialsFile string           `yaml:"credentials_file"` // File to read API credentials from, same format as --credentials-file
+	APIKeyEnv       string           `yaml:"api_key_env"`      // Environment variable to read the API key from
+	APISecretEnv    string           `yaml:"api_secret_env"`   // Environment variable to read the API secret from
+	Profile         string           `yaml:"profile"`          // Account of the Exoscale CLI configuration file
+	Instances       []InstanceConfig `yaml:"instances"`
+	Discover        DiscoveryConfig  `yaml:"discover"`
+}
+
+// API clients by account name, the top-level instances use the account with an empty name
+type accountClients map[string]*v3.Client
+
+// Get the client of an account
+func (c accountClients) get(account string) (*v3.Client, error) {
+	client, ok := c[account]
+	if !ok {
+		return nil, fmt.Errorf("unknown account %q", account)
+	}
+	return client, nil
+}
+
+// Get the names of the accounts, sorted
+func (c accountClients) names() []string {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Check whether the top-level instances of the configuration are used, they can be omitted when accounts are
+// configured
+func (c config) usesDefaultAccount() bool {
+	return len(c.Accounts) == 0 || len(c.Instances) > 0 || c.Discover.Enabled
+}
+
+// Get the credentials of an account
+func (a AccountConfig) credentials() (*credentials.Credentials, error) {
+	switch {
+	case a.CredentialsFile != "":
+		return apiCredentialsFromFile(a.CredentialsFile)
+
+	case a.APIKeyEnv != "" || a.APISecretEnv != "":
+		key, secret := os.Getenv(a.APIKeyEnv), os.Getenv(a.APISecretEnv)
+		if key == "" || secret == "" {
+			return nil, fmt.Errorf("environment variables %s and %s must both be set", a.APIKeyEnv, a.APISecretEnv)
+		}
+		return credentials.NewStaticCredentials(key, secret), nil
+
+	case a.Profile != "":
+		return credentials.NewFileCredentials(credentials.FileOptWithAccount(a.Profile)), nil
+
+	default:
+		return nil, errors.New("one of credentials_file, api_key_env/api_secret_env or profile must be set")
+	}
+}
+
+// Create the API clients of the accounts
+func newAccountClients(cfg config, defaultCreds func() (*credentials.Credentials, error)) (accountClients, error) {
+	clients := accountClients{}
+
+	if cfg.usesDefaultAccount() {
+		creds, err := defaultCreds()
+		if err != nil {
+			return nil, err
+		}
+		client, err := v3.NewClient(creds, cfg.clientOptions("")...)
+		if err != nil {
+			return nil, err
+		}
+		clients[""] = client
+	}
+
+	for i, account := range cfg.Accounts {
+		if account.Name == "" {
+			return nil, fmt.Errorf("account %d: missing name", i+1)
+		}
+		if _, ok := clients[account.Name]; ok {
+			return nil, fmt.Errorf("account %q: defined more than once", account.Name)
+		}
+
+		creds, err := account.credentials()
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %w", account.Name, err)
+		}
+		client, err := v3.NewClient(creds, cfg.clientOptions(account.Name)...)
+		if err != nil {
+			return nil, fmt.Errorf("account %q: %w", account.Name, err)
+		}
+		clients[account.Name] = client
+	}
+
+	return clients, nil
+}
+
+// Get the instances to process over all accounts. An account whose instances can't be resolved doesn't prevent the
+// others from being processed, the failure is returned as the result of the account instead.
+func resolveAccountInstances(ctx context.Context, clients accountClients, cfg config) ([]InstanceConfig, []instanceResult) {
+	instances := []InstanceConfig{}
+	failures := []instanceResult{}
+
+	resolve := func(name string, accountCfg config) {
+		client, err := clients.get(name)
+		if err == nil {
+			accountCfg.Instances, err = resolveInstances(ctx, client, accountCfg)
+		}
+		if err != nil {
+			failures = append(failures, instanceResult{Account: name, Err: explainAPIError(fmt.Errorf("unable to resolve instances: %w", err), "")})
+			return
+		}
+
+		for _, instance := range accountCfg.Instances {
+			instance.Account = name
+			instances = append(instances, instance)
+		}
+	}
+
+	if cfg.usesDefaultAccount() {
+		resolve("", cfg)
+	}
+	for _, account := range cfg.Accounts {
+		accountCfg := cfg
+		accountCfg.Instances = account.Instances
+		accountCfg.Discover = account.Discover
+		resolve(account.Name, accountCfg)
+	}
+
+	for _, failure := range failures {
+		slog.ErrorContext(ctx, "Error resolving instances", "account", failure.Account, "err", failure.Err)
+	}
+
+	return instances, failures
+}
+
+// Snapshot indexes of the accounts and zones, each created on first use
+type snapshotIndexes struct {
+	mu      sync.Mutex
+	clients accountClients
+	indexes map[snapshotIndexKey]*snapshotIndex
+}
+
+type snapshotIndexKey struct {
+	account  string
+	endpoint v3.Endpoint
+}
+
+func newSnapshotIndexes(clients accountClients) *snapshotIndexes {
+	return &snapshotIndexes{clients: clients, indexes: make(map[snapshotIndexKey]*snapshotIndex)}
+}
+
+// Get the snapshot index of an account in the zone served by an API endpoint
+func (s *snapshotIndexes) get(account string, endpoint v3.Endpoint) (*snapshotIndex, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := snapshotIndexKey{account, endpoint}
+	index, ok := s.indexes[key]
+	if !ok {
+		client, err := s.clients.get(account)
+		if err != nil {
+			return nil, err
+		}
+		index = newSnapshotIndex(client.WithEndpoint(endpoint))
+		s.indexes[key] = index
+	}
+	return index, nil
+}
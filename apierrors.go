@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// API error along with a hint of how to address it
+type hintedError struct {
+	err  error
+	hint string
+}
+
+func (e *hintedError) Error() string {
+	return fmt.Sprintf("%s (%s)", e.err, e.hint)
+}
+
+func (e *hintedError) Unwrap() error {
+	return e.err
+}
+
+// Add a hint of how to address the common API errors, notFound being the one of 404 errors, e.g. "instance x not
+// found". Other errors are returned as is.
+func explainAPIError(err error, notFound string) error {
+	var hinted *hintedError
+	if err == nil || errors.As(err, &hinted) {
+		return err
+	}
+
+	var hint string
+	switch {
+	case errors.Is(err, v3.ErrUnauthorized):
+		hint = "the API credentials are invalid or revoked, check the API key and secret"
+	case errors.Is(err, v3.ErrForbidden):
+		hint = "the IAM role of the API key doesn't allow the operation, it needs the compute operations on instances and snapshots, e.g. list-instances, create-snapshot and delete-snapshot"
+	case errors.Is(err, v3.ErrNotFound) && notFound != "":
+		hint = notFound
+	case errors.Is(err, v3.ErrNotFound):
+		hint = "not found, check the IDs and zones of the configuration"
+	case errors.Is(err, v3.ErrTooManyRequests):
+		hint = "throttled by the API, lower the concurrency or set rate_limit"
+	default:
+		return err
+	}
+	return &hintedError{err: err, hint: hint}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Reason of the protection of yearly archive snapshots, and bucket of the ones archived by the current run
+const yearlyArchive = "yearly_archive"
+
+// Permanently protect the first snapshot of each year which has no archived snapshot yet, among the retention
+// candidates, and return the archived candidates. Years are evaluated in the given time zone. In dry run mode, the
+// snapshots are archived as far as the returned ones go but not protected.
+func archiveYearlySnapshots(ctx context.Context, state *stateStore, instanceSnapshots, candidates []v3.Snapshot, retention SnapshotRetention, dryRun bool) ([]v3.Snapshot, error) {
+	loc := retention.Timezone.location()
+
+	archivedYears := make(map[int]bool)
+	for _, snapshot := range instanceSnapshots {
+		if state.protectionReason(snapshot.ID) == yearlyArchive {
+			archivedYears[snapshot.CreatedAT.In(loc).Year()] = true
+		}
+	}
+
+	candidates = append([]v3.Snapshot(nil), candidates...)
+	sort.Slice(candidates, func(i, j int) bool { return newerSnapshot(candidates[j], candidates[i]) })
+
+	archived := []v3.Snapshot{}
+	for _, snapshot := range candidates {
+		year := snapshot.CreatedAT.In(loc).Year()
+		if archivedYears[year] {
+			continue
+		}
+		archivedYears[year] = true
+		archived = append(archived, snapshot)
+
+		ctx := withLogAttrs(ctx, "year", year)
+		if dryRun {
+			ctx := withLogAttrs(ctx, "snapshot_id", snapshot.ID)
+			slog.InfoContext(ctx, "Dry run: snapshot would be archived")
+			audit.record(ctx, "archive", snapshot.Instance.ID, snapshot.ID, "first snapshot of the year", true, nil)
+			continue
+		}
+		if err := archiveSnapshot(ctx, state, snapshot.Instance.ID, snapshot.ID); err != nil {
+			return archived, err
+		}
+	}
+
+	return archived, nil
+}
+
+// Permanently protect a snapshot as the yearly archive
+func archiveSnapshot(ctx context.Context, state *stateStore, instanceID, id v3.UUID) error {
+	ctx = withLogAttrs(ctx, "snapshot_id", id)
+	err := state.protectFor(id, yearlyArchive)
+	audit.record(ctx, "archive", instanceID, id, "first snapshot of the year", false, err)
+	if err != nil {
+		return err
+	}
+	slog.InfoContext(ctx, "Archived snapshot")
+	return nil
+}
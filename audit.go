@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Snapshot creation or deletion as recorded in the audit log, one JSON document per line
+type auditEvent struct {
+	Time       time.Time `json:"time"`
+	RunID      string    `json:"run_id,omitempty"`
+	Account    string    `json:"account,omitempty"`
+	InstanceID v3.UUID   `json:"instance_id"`
+	SnapshotID v3.UUID   `json:"snapshot_id,omitempty"`
+	Action     string    `json:"action"` // create, delete or archive
+	Reason     string    `json:"reason"` // Policy decision which caused the action
+	DryRun     bool      `json:"dry_run"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Append-only audit log of the snapshot creations and deletions, independent of the log stream
+type auditLog struct {
+	mu   sync.Mutex
+	path string // Disabled if empty
+}
+
+var audit = &auditLog{}
+
+// Record an action, attempted or done, the run and account are taken from the logging attributes of the context
+func (a *auditLog) record(ctx context.Context, action string, instanceID, snapshotID v3.UUID, reason string, dryRun bool, err error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.path == "" {
+		return
+	}
+
+	event := auditEvent{
+		Time:       time.Now(),
+		RunID:      runID(ctx),
+		Account:    logAttr(ctx, "account"),
+		InstanceID: instanceID,
+		SnapshotID: snapshotID,
+		Action:     action,
+		Reason:     reason,
+		DryRun:     dryRun,
+	}
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	if err := a.write(event); err != nil {
+		slog.ErrorContext(ctx, "Error writing audit log", "err", err)
+	}
+}
+
+// Append an event to the audit log, the caller must hold the lock
+func (a *auditLog) write(event auditEvent) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(a.path), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(a.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
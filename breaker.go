@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// Consecutive API failures after which the remaining operations of a run are aborted, unless configured otherwise
+const defaultCircuitBreakerFailures = 10
+
+// Circuit breaker of the API requests of an account: once open, after consecutive failures, e.g. revoked credentials
+// or an API outage, requests fail right away until the next run rather than hammering the API
+type circuitBreaker struct {
+	mu        sync.Mutex
+	account   string
+	threshold int // Consecutive failures opening the circuit, never if zero
+	failures  int
+	last      string // Last failure
+	open      bool
+}
+
+// Circuit breakers of the API clients by account name, so that an account failing doesn't abort the others
+type circuitBreakers struct {
+	mu       sync.Mutex
+	accounts map[string]*circuitBreaker
+}
+
+// Circuit breakers of all the API clients, reset at the start of each run
+var breakers = &circuitBreakers{accounts: make(map[string]*circuitBreaker)}
+
+// Get the circuit breaker of an account, created with the given threshold if it has none yet
+func (b *circuitBreakers) get(account string, threshold int) *circuitBreaker {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	breaker, ok := b.accounts[account]
+	if !ok {
+		breaker = &circuitBreaker{account: account, threshold: threshold}
+		b.accounts[account] = breaker
+	}
+	return breaker
+}
+
+// Close the circuits of all the accounts, e.g. for a new run
+func (b *circuitBreakers) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, breaker := range b.accounts {
+		breaker.reset()
+	}
+}
+
+// Get the error of the requests of an account while its circuit is open, nil if it's closed
+func (b *circuitBreakers) err(account string) error {
+	b.mu.Lock()
+	breaker, ok := b.accounts[account]
+	b.mu.Unlock()
+	if !ok {
+		return nil
+	}
+	return breaker.err()
+}
+
+// Get the accounts whose circuit is open, labelled like the results of the accounts and sorted
+func (b *circuitBreakers) opened() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	accounts := []string{}
+	for account, breaker := range b.accounts {
+		if breaker.err() != nil {
+			accounts = append(accounts, instanceResult{Account: account}.label())
+		}
+	}
+	sort.Strings(accounts)
+	return accounts
+}
+
+// Get the number of consecutive API failures opening the circuits
+func (cfg config) breakerThreshold() int {
+	if cfg.BreakerFailures != nil {
+		return *cfg.BreakerFailures
+	}
+	return defaultCircuitBreakerFailures
+}
+
+// Close the circuit, e.g. for a new run
+func (b *circuitBreaker) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures, b.last, b.open = 0, "", false
+}
+
+// Get the error of the requests while the circuit is open, nil if it's closed
+func (b *circuitBreaker) err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !b.open {
+		return nil
+	}
+	return fmt.Errorf("circuit breaker open after %d consecutive API failures, last one: %s", b.failures, b.last)
+}
+
+// Record the outcome of a request, the failure if any
+func (b *circuitBreaker) record(failure string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if failure == "" {
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	b.last = failure
+	if b.threshold > 0 && b.failures >= b.threshold && !b.open {
+		b.open = true
+		slog.Error("Aborting the remaining API operations of the account for the run, the API keeps failing", "account", b.account, "failures", b.failures, "last_failure", failure)
+	}
+}
+
+// Transport failing fast while the circuit breaker of its account is open
+type circuitBreakerTransport struct {
+	breaker *circuitBreaker
+	next    http.RoundTripper
+}
+
+func (t circuitBreakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.breaker.err(); err != nil {
+		return nil, err
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case req.Context().Err() != nil:
+		// Canceled by a timeout or the shutdown, the API isn't at fault
+	case err != nil:
+		t.breaker.record(err.Error())
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusUnauthorized, resp.StatusCode == http.StatusForbidden, resp.StatusCode == http.StatusTooManyRequests:
+		t.breaker.record(fmt.Sprintf("%s %s: %s", req.Method, req.URL.Path, resp.Status))
+	default:
+		t.breaker.record("")
+	}
+	return resp, err
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Title of the chat and push notifications
+func (r runReport) title() string {
+	title := "snap-o-matic run succeeded"
+	if r.hasFailures() {
+		title = "snap-o-matic run FAILED"
+	}
+	if r.DryRun {
+		title += " (dry run)"
+	}
+	return title
+}
+
+// Name and value of the figures of the run shown on chat cards
+func (r runReport) facts() [][2]string {
+	totals := r.totals()
+	return [][2]string{
+		{"Run", r.RunID},
+		{"Duration", r.FinishedAt.Sub(r.StartedAt).Round(time.Second).String()},
+		{"Instances", fmt.Sprintf("%d processed, %d failed", totals.Instances, totals.Failed)},
+		{"Snapshots created", strconv.Itoa(totals.Created)},
+		{"Snapshots deleted", strconv.Itoa(totals.Deleted)},
+		{"Deletion errors", strconv.Itoa(totals.DeleteErrors)},
+	}
+}
+
+// Microsoft Teams incoming webhook or workflow, receiving an Adaptive Card
+type TeamsConfig struct {
+	NotifierOptions `yaml:",inline"`
+	WebhookURL      string `yaml:"webhook_url"`
+}
+
+func (c TeamsConfig) notify(ctx context.Context, report runReport) error {
+	color := "Good"
+	if report.hasFailures() {
+		color = "Attention"
+	}
+	facts := []map[string]string{}
+	for _, fact := range report.facts() {
+		facts = append(facts, map[string]string{"title": fact[0], "value": fact[1]})
+	}
+	body := []map[string]any{
+		{"type": "TextBlock", "text": report.title(), "weight": "Bolder", "size": "Medium", "color": color, "wrap": true},
+		{"type": "FactSet", "facts": facts},
+	}
+	if problems := report.problems(); len(problems) > 0 {
+		body = append(body, map[string]any{"type": "TextBlock", "text": "- " + strings.Join(problems, "\n- "), "wrap": true})
+	}
+
+	card := map[string]any{
+		"type": "message",
+		"attachments": []map[string]any{{
+			"contentType": "application/vnd.microsoft.card.adaptive",
+			"content": map[string]any{
+				"$schema": "http://adaptivecards.io/schemas/adaptive-card.json",
+				"type":    "AdaptiveCard",
+				"version": "1.4",
+				"body":    body,
+			},
+		}},
+	}
+	if err := postJSON(ctx, c.WebhookURL, card); err != nil {
+		return fmt.Errorf("teams: %w", err)
+	}
+	return nil
+}
+
+// Google Chat space incoming webhook, receiving a card
+type GoogleChatConfig struct {
+	NotifierOptions `yaml:",inline"`
+	WebhookURL      string `yaml:"webhook_url"`
+}
+
+func (c GoogleChatConfig) notify(ctx context.Context, report runReport) error {
+	widgets := []map[string]any{}
+	for _, fact := range report.facts() {
+		widgets = append(widgets, map[string]any{"decoratedText": map[string]string{"topLabel": fact[0], "text": fact[1]}})
+	}
+	sections := []map[string]any{{"widgets": widgets}}
+	if problems := report.problems(); len(problems) > 0 {
+		sections = append(sections, map[string]any{
+			"header":  "Problems",
+			"widgets": []map[string]any{{"textParagraph": map[string]string{"text": strings.Join(problems, "\n")}}},
+		})
+	}
+
+	message := map[string]any{
+		"text": report.title(), // Shown in push notifications, which don't render cards
+		"cardsV2": []map[string]any{{
+			"cardId": report.RunID,
+			"card": map[string]any{
+				"header":   map[string]string{"title": report.title(), "subtitle": "Run " + report.RunID},
+				"sections": sections,
+			},
+		}},
+	}
+	if err := postJSON(ctx, c.WebhookURL, message); err != nil {
+		return fmt.Errorf("google chat: %w", err)
+	}
+	return nil
+}
+
+// Telegram bot posting to a chat
+type TelegramConfig struct {
+	NotifierOptions `yaml:",inline"`
+	BotToken        string `yaml:"bot_token"`
+	ChatID          string `yaml:"chat_id"` // Numeric ID of the chat, or @username of a channel
+}
+
+func (c TelegramConfig) notify(ctx context.Context, report runReport) error {
+	u := "https://api.telegram.org/bot" + c.BotToken + "/sendMessage"
+	if err := postJSON(ctx, u, map[string]string{"chat_id": c.ChatID, "text": report.title() + "\n\n" + report.summary()}); err != nil {
+		// The URL embeds the token, which mustn't end up in the logs
+		return fmt.Errorf("telegram: %w", redactURLError(err))
+	}
+	return nil
+}
+
+// ntfy topic, on ntfy.sh or a self-hosted server
+type NtfyConfig struct {
+	NotifierOptions `yaml:",inline"`
+	URL             string `yaml:"url"`      // Of the topic, e.g. https://ntfy.sh/my-backups
+	Token           string `yaml:"token"`    // Access token of protected topics
+	Priority        string `yaml:"priority"` // Of failed runs, defaults to high, the others have the default priority
+}
+
+func (c NtfyConfig) notify(ctx context.Context, report runReport) error {
+	header := http.Header{}
+	header.Set("Content-Type", "text/plain; charset=utf-8")
+	header.Set("Title", report.title())
+	if report.hasFailures() {
+		header.Set("Priority", cmp.Or(c.Priority, "high"))
+		header.Set("Tags", "warning")
+	} else {
+		header.Set("Tags", "white_check_mark")
+	}
+	if c.Token != "" {
+		header.Set("Authorization", "Bearer "+c.Token)
+	}
+	if err := post(ctx, c.URL, []byte(report.summary()), header); err != nil {
+		return fmt.Errorf("ntfy: %w", err)
+	}
+	return nil
+}
+
+// Strip the URL from the error of a request, if any
+func redactURLError(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+package main
+
+import "time"
+
+// Source of the current time of retention decisions, so that they can be computed as of another time
+type clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time { return time.Now() }
+
+// Clock stopped at a given time, set with --now
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time { return time.Time(c) }
+
+var retentionClock clock = systemClock{}
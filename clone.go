@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Prefix of the names of the templates registered to clone instances from snapshots
+const cloneTemplatePrefix = "snap-o-matic-clone-"
+
+// Settings of the instance created by the clone command, unset ones default to those of the original instance
+type cloneOptions struct {
+	Name         string
+	InstanceType string // e.g. standard.medium
+	Zone         string
+}
+
+// Create a new instance from a snapshot, by registering a template from the snapshot, leaving the original instance
+// untouched. The snapshot is looked up in all accounts, in the zones of the given API endpoints.
+func cloneSnapshot(ctx context.Context, clients accountClients, endpoints []v3.Endpoint, state *stateStore, cfg config) error {
+	if cfg.SnapshotID == "" {
+		return errors.New("usage: snap-o-matic clone --snapshot ID [--name NAME] [--instance-type TYPE] [--zone ZONE]")
+	}
+	snapshotID, err := v3.ParseUUID(cfg.SnapshotID)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot ID %q: %w", cfg.SnapshotID, err)
+	}
+
+	snapshot, account, endpoint, err := findSnapshot(ctx, clients, endpoints, snapshotID)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve snapshot %s: %w", snapshotID, err)
+	}
+	if snapshot.Instance == nil {
+		return fmt.Errorf("snapshot %s has no instance", snapshotID)
+	}
+
+	client := clients[account].WithEndpoint(endpoint)
+	zoneClient, cloneEndpoint := client, endpoint
+	if cfg.Clone.Zone != "" {
+		cloneEndpoint = zoneEndpoint(cfg.Clone.Zone)
+		zoneClient = client.WithEndpoint(cloneEndpoint)
+	}
+
+	// The original instance may be gone, its settings are only used as defaults
+	original, err := client.GetInstance(ctx, snapshot.Instance.ID)
+	if err != nil {
+		slog.WarnContext(ctx, "Unable to retrieve the original instance", "instance_id", snapshot.Instance.ID, "err", err)
+		original = &v3.Instance{ID: snapshot.Instance.ID, Name: string(snapshot.Instance.ID)}
+	}
+
+	name := cfg.Clone.Name
+	if name == "" {
+		name = original.Name + "-clone-" + snapshot.CreatedAT.UTC().Format("20060102T150405Z")
+	}
+	instanceType, err := cloneInstanceType(ctx, zoneClient, cfg.Clone.InstanceType, original)
+	if err != nil {
+		return err
+	}
+
+	ctx = withLogAttrs(ctx, "snapshot_id", snapshotID, "instance_name", name)
+	if cfg.DryRun {
+		slog.InfoContext(ctx, "Dry run: would clone snapshot", "instance_type", instanceType.ID, "zone", cfg.Clone.Zone)
+		return nil
+	}
+	slog.InfoContext(ctx, "Cloning snapshot")
+
+	templateName := cloneTemplatePrefix + string(snapshotID)
+	description := fmt.Sprintf("Clone of snapshot %s of instance %s", snapshotID, snapshot.Instance.ID)
+	templateID, err := registerSnapshotTemplate(ctx, client, zoneClient, *snapshot, templateName, description)
+	if err != nil {
+		return fmt.Errorf("unable to register template: %w", err)
+	}
+	record := templateRecord{
+		Kind:       templateKindClone,
+		Account:    account,
+		Endpoint:   cloneEndpoint,
+		InstanceID: snapshot.Instance.ID,
+		SnapshotID: snapshotID,
+		CreatedAt:  time.Now(),
+	}
+	if err := state.addTemplate(templateID, record); err != nil {
+		return err
+	}
+
+	// The template is only needed to create the instance, failing to delete it here leaves it to the next run
+	defer func() {
+		ctx := context.WithoutCancel(ctx)
+		if err := deleteTemplate(ctx, zoneClient, state, templateID); err != nil {
+			slog.WarnContext(ctx, "Unable to delete the template of the clone", "template_id", templateID, "err", err)
+		}
+	}()
+
+	op, err := zoneClient.CreateInstance(ctx, v3.CreateInstanceRequest{
+		Name:         name,
+		InstanceType: instanceType,
+		Template:     &v3.Template{ID: templateID},
+		DiskSize:     max(snapshot.Size, 10),
+		SSHKeys:      original.SSHKeys,
+		Labels:       v3.Labels{"snap-o-matic-clone-of": string(snapshot.Instance.ID)},
+	})
+	if err == nil {
+		op, err = operations.wait(ctx, zoneClient, op)
+	}
+	if err != nil {
+		return fmt.Errorf("unable to create instance: %w", err)
+	}
+
+	if op.Reference != nil {
+		ctx = withLogAttrs(ctx, "new_instance_id", op.Reference.ID)
+	}
+	slog.InfoContext(ctx, "Cloned snapshot")
+	return nil
+}
+
+// Get the instance type of a clone, given as family.size, defaulting to the type of the original instance
+func cloneInstanceType(ctx context.Context, client *v3.Client, name string, original *v3.Instance) (*v3.InstanceType, error) {
+	if name == "" {
+		if original.InstanceType == nil {
+			return nil, errors.New("unable to determine the instance type of the original instance, set --instance-type")
+		}
+		return &v3.InstanceType{ID: original.InstanceType.ID}, nil
+	}
+
+	family, size, ok := strings.Cut(name, ".")
+	if !ok {
+		return nil, fmt.Errorf("invalid instance type %q, expected FAMILY.SIZE", name)
+	}
+	types, err := client.ListInstanceTypes(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list instance types: %w", err)
+	}
+	for _, instanceType := range types.InstanceTypes {
+		if string(instanceType.Family) == family && string(instanceType.Size) == size {
+			return &v3.InstanceType{ID: instanceType.ID}, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown instance type %q", name)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Subcommand of the command line
+type cliCommand struct {
+	name     string // e.g. list, or config migrate
+	args     string // Positional arguments, e.g. ID...
+	minArgs  int
+	maxArgs  int      // -1 for any number
+	summary  string   // One-line description
+	flags    []string // Flags the command supports besides the global ones
+	readOnly bool     // Doesn't create or delete snapshots, so runs without taking the lock
+	hidden   bool     // Not listed by the usage, e.g. used by the completion scripts
+}
+
+// Flags supported by all commands
+var globalFlags = []string{"config", "config-dir", "config-format", "credentials-file", "log-level", "log-format", "log-output", "syslog-facility", "syslog-tag", "log-file", "log-max-size", "log-max-age", "log-max-files", "quiet", "no-color", "version"}
+
+// Flags of the commands processing the configured instances like a run
+var runFlags = []string{"instance", "exclude-instance", "dry-run", "unsafe-delete-all", "now", "gc", "concurrency", "timeout", "shutdown-timeout", "output", "metrics-textfile", "pushgateway-url", "report-file"}
+
+// Commands of the command line, as listed by the usage
+var cliCommands = []cliCommand{
+	{name: "run", summary: "Create snapshots and apply retention policies (default command)",
+		flags: append([]string{"prune-only", "snapshot-only", "daemon", "metrics-listen"}, runFlags...)},
+	{name: "prune", summary: "Apply retention policies without creating snapshots", flags: runFlags},
+	{name: "init", summary: "Write a starter configuration with the instances of the account", flags: []string{"out"}, readOnly: true},
+	{name: "validate", summary: "Check the configuration file", flags: []string{"resolve"}, readOnly: true},
+	{name: "schema", summary: "Print the JSON Schema of the configuration file", readOnly: true},
+	{name: "config migrate", summary: "Update the configuration file to the current version of the format", flags: []string{"out"}, readOnly: true},
+	{name: "list", summary: "List snapshots of the configured instances", flags: []string{"output", "now", "unsafe-delete-all"}, readOnly: true},
+	{name: "explain", summary: "Explain why a snapshot is retained or deleted", flags: []string{"snapshot", "output", "now", "unsafe-delete-all"}, readOnly: true},
+	{name: "protect", args: "ID...", minArgs: 1, maxArgs: -1, summary: "Protect snapshots from ever being deleted"},
+	{name: "unprotect", args: "ID...", minArgs: 1, maxArgs: -1, summary: "Remove the protection of snapshots"},
+	{name: "plan", summary: "Plan the changes of a run without applying them", flags: []string{"out", "unsafe-delete-all", "prune-only", "snapshot-only", "concurrency"}, readOnly: true},
+	{name: "apply", args: "PLAN_FILE", minArgs: 1, maxArgs: 1, summary: "Apply a plan created by the plan command", flags: []string{"timeout", "shutdown-timeout", "metrics-textfile", "pushgateway-url", "report-file"}},
+	{name: "restore", summary: "Revert an instance to a snapshot", flags: []string{"instance", "snapshot", "yes", "ignore-never-touch", "dry-run"}},
+	{name: "clone", summary: "Create a new instance from a snapshot", flags: []string{"snapshot", "name", "instance-type", "zone", "dry-run"}},
+	{name: "gc", summary: "Delete snapshots of deleted or unconfigured instances", flags: []string{"dry-run", "unsafe-delete-all", "output"}},
+	{name: "coverage", summary: "List all instances and flag gaps in backup coverage", flags: []string{"output", "now"}, readOnly: true},
+	{name: "cost", summary: "Show the storage used by the snapshots and estimate its monthly cost", flags: []string{"output"}, readOnly: true},
+	{name: "verify", summary: "Check that the configured instances have recent enough ready snapshots", flags: []string{"instance", "exclude-instance", "output", "now"}, readOnly: true},
+	{name: "history", summary: "Show the snapshots created and deleted by past runs", flags: []string{"instance", "snapshot", "output"}, readOnly: true},
+	{name: "simulate", summary: "Simulate a retention policy over time", flags: []string{"policy", "interval", "horizon", "now", "output"}, readOnly: true},
+	{name: "version", summary: "Print the version of snap-o-matic and how it was built", readOnly: true},
+	{name: "completion", args: "SHELL", minArgs: 1, maxArgs: 1, summary: "Print the completion script of a shell: bash, zsh or fish", readOnly: true},
+	{name: "help", args: "[COMMAND]", maxArgs: 2, summary: "Show the usage of a command", readOnly: true},
+	{name: "__complete", args: "-- WORD...", maxArgs: -1, summary: "Complete a command line", readOnly: true, hidden: true},
+}
+
+// Find the command designated by the positional arguments, the run command if there are none, and return its own
+// arguments
+func findCommand(args []string) (cliCommand, []string, error) {
+	if len(args) == 0 {
+		return cliCommands[0], nil, nil
+	}
+	for _, command := range cliCommands {
+		words := strings.Fields(command.name)
+		if len(args) >= len(words) && slices.Equal(args[:len(words)], words) {
+			return command, args[len(words):], nil
+		}
+	}
+	for _, command := range cliCommands {
+		if words := strings.Fields(command.name); len(words) > 1 && args[0] == words[0] {
+			return cliCommand{}, nil, fmt.Errorf("unknown command %q, did you mean %q?", strings.Join(args, " "), command.name)
+		}
+	}
+	return cliCommand{}, nil, fmt.Errorf("unknown command %q", args[0])
+}
+
+// Check the flags and arguments given to a command
+func (c cliCommand) check(flags *flag.FlagSet, args []string) error {
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		if err == nil && !slices.Contains(globalFlags, f.Name) && !slices.Contains(c.flags, f.Name) {
+			err = fmt.Errorf("flag --%s is not supported by the %s command", f.Name, c.name)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	if len(args) < c.minArgs || (c.maxArgs >= 0 && len(args) > c.maxArgs) {
+		return fmt.Errorf("usage: %s", c.usage())
+	}
+	return nil
+}
+
+// Get the usage line of a command
+func (c cliCommand) usage() string {
+	usage := "snap-o-matic " + c.name
+	if c.args != "" {
+		usage += " " + c.args
+	}
+	if len(c.flags) > 0 {
+		usage += " [flags]"
+	}
+	return usage
+}
+
+// Write the usage of all the commands
+func writeCommands(w io.Writer) {
+	width := 0
+	for _, command := range cliCommands {
+		width = max(width, len(command.usage()))
+	}
+	for _, command := range cliCommands {
+		if !command.hidden {
+			_, _ = fmt.Fprintf(w, "  %-*s  %s\n", width, command.usage(), command.summary)
+		}
+	}
+}
+
+// Get the usage of some of the flags of a flag set, in the given order
+func flagUsages(flags *flag.FlagSet, names []string) string {
+	set := flag.NewFlagSet("", flag.ContinueOnError)
+	set.SortFlags = false
+	for _, name := range names {
+		if f := flags.Lookup(name); f != nil {
+			set.AddFlag(f)
+		}
+	}
+	return set.FlagUsages()
+}
+
+// Write the usage of a command, with its own flags and the global ones
+func writeCommandUsage(w io.Writer, c cliCommand, flags *flag.FlagSet) {
+	_, _ = fmt.Fprintf(w, "Usage:\n  %s\n\n%s\n", c.usage(), c.summary)
+	if len(c.flags) > 0 {
+		_, _ = fmt.Fprintf(w, "\nFlags:\n%s", flagUsages(flags, c.flags))
+	}
+	_, _ = fmt.Fprintf(w, "\nGlobal flags:\n%s", flagUsages(flags, globalFlags))
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
+
+	flag "github.com/spf13/pflag"
+)
+
+// Candidate printed by the completion helper asking the shell to complete file names
+const completeFiles = ":files"
+
+// Values of the flags taking one of a few, completed as such
+var flagValues = map[string][]string{
+	"output":        {"table", "json", "yaml"},
+	"config-format": {"yaml", "json", "toml"},
+	"log-level":     {"error", "warn", "info", "debug"},
+	"log-format":    {"text", "json"},
+	"log-output":    {"stderr", "syslog"},
+}
+
+// Flags taking a file name
+var fileFlags = []string{"config", "config-dir", "credentials-file", "out", "metrics-textfile", "report-file", "log-file"}
+
+// Completion scripts, which delegate to the hidden __complete command to get the candidates
+var completionScripts = map[string]string{
+	"bash": `# bash completion for snap-o-matic, e.g. source <(snap-o-matic completion bash)
+_snap_o_matic() {
+    local IFS=$'\n' cur="${COMP_WORDS[COMP_CWORD]}"
+    local candidates=($(snap-o-matic __complete -- "${COMP_WORDS[@]:1:COMP_CWORD}" 2>/dev/null))
+    if [[ ${candidates[0]} == ` + completeFiles + ` ]]; then
+        COMPREPLY=($(compgen -f -- "$cur"))
+        return
+    fi
+    COMPREPLY=($(compgen -W "${candidates[*]%%$'\t'*}" -- "$cur"))
+}
+complete -o filenames -F _snap_o_matic snap-o-matic
+`,
+	"zsh": `#compdef snap-o-matic
+# zsh completion for snap-o-matic, e.g. source <(snap-o-matic completion zsh)
+_snap_o_matic() {
+    local -a lines candidates
+    local line
+    lines=("${(@f)$(snap-o-matic __complete -- "${(@)words[2,CURRENT]}" 2>/dev/null)}")
+    if [[ ${lines[1]} == ` + completeFiles + ` ]]; then
+        _files
+        return
+    fi
+    for line in $lines; do
+        [[ -n $line ]] || continue
+        candidates+=("${${line%%$'\t'*}//:/\\:}:${line#*$'\t'}")
+    done
+    _describe 'snap-o-matic' candidates
+}
+compdef _snap_o_matic snap-o-matic
+`,
+	"fish": `# fish completion for snap-o-matic, e.g. snap-o-matic completion fish | source
+function __snap_o_matic_complete
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    set -l current (commandline -ct)
+    set -l candidates (snap-o-matic __complete -- $tokens "$current" 2>/dev/null)
+    if test "$candidates[1]" = "` + completeFiles + `"
+        __fish_complete_path "$current"
+        return
+    end
+    printf '%s\n' $candidates
+end
+complete -c snap-o-matic -f -a '(__snap_o_matic_complete)'
+`,
+}
+
+// Write the completion script of a shell
+func writeCompletionScript(w io.Writer, shell string) error {
+	script, ok := completionScripts[shell]
+	if !ok {
+		return fmt.Errorf("unsupported shell %q (expected bash, zsh or fish)", shell)
+	}
+	_, err := io.WriteString(w, script)
+	return err
+}
+
+// Write the candidates completing the last of the words of a command line, one per line with their description after
+// a tab. Instances are completed from the configuration designated by the words.
+func writeCompletions(w io.Writer, flags *flag.FlagSet, words []string) {
+	if len(words) == 0 {
+		words = []string{""}
+	}
+	current, previous := words[len(words)-1], words[:len(words)-1]
+
+	// Find the command, skipping the flags and their values
+	positional := []string{}
+	var valueOf *flag.Flag
+	for _, word := range previous {
+		switch {
+		case valueOf != nil:
+			valueOf = nil
+		case strings.HasPrefix(word, "-") && !strings.Contains(word, "="):
+			valueOf = lookupFlag(flags, word)
+			if valueOf != nil && valueOf.NoOptDefVal != "" {
+				valueOf = nil // Boolean flags don't take a value
+			}
+		case !strings.HasPrefix(word, "-"):
+			positional = append(positional, word)
+		}
+	}
+
+	candidates := [][2]string{}
+	command, args, err := findCommand(positional)
+	switch {
+	case valueOf != nil && (valueOf.Name == "instance" || valueOf.Name == "exclude-instance"):
+		for _, instance := range completionInstances(words) {
+			candidates = append(candidates, [2]string{instance, ""})
+		}
+	case valueOf != nil && slices.Contains(fileFlags, valueOf.Name):
+		_, _ = fmt.Fprintln(w, completeFiles)
+		return
+	case valueOf != nil:
+		for _, value := range flagValues[valueOf.Name] {
+			candidates = append(candidates, [2]string{value, ""})
+		}
+
+	case strings.HasPrefix(current, "-"):
+		names := globalFlags
+		if err == nil {
+			names = append(append([]string{}, command.flags...), globalFlags...)
+		}
+		for _, name := range names {
+			if f := flags.Lookup(name); f != nil {
+				candidates = append(candidates, [2]string{"--" + name, f.Usage})
+			}
+		}
+
+	case err != nil || len(positional) == 0, command.name == "help":
+		// Command names, and the second word of the ones made of two
+		prefix := positional
+		if command.name == "help" {
+			prefix = args
+		}
+		for _, c := range cliCommands {
+			words := strings.Fields(c.name)
+			if c.hidden || len(words) <= len(prefix) || strings.Join(words[:len(prefix)], " ") != strings.Join(prefix, " ") {
+				continue
+			}
+			candidates = append(candidates, [2]string{words[len(prefix)], c.summary})
+		}
+
+	case command.name == "completion":
+		for _, shell := range []string{"bash", "fish", "zsh"} {
+			candidates = append(candidates, [2]string{shell, ""})
+		}
+	case command.name == "apply":
+		_, _ = fmt.Fprintln(w, completeFiles)
+		return
+	}
+
+	for _, candidate := range candidates {
+		if strings.HasPrefix(candidate[0], current) {
+			_, _ = fmt.Fprintf(w, "%s\t%s\n", candidate[0], candidate[1])
+		}
+	}
+}
+
+// Look up a flag by its long or short name, e.g. --config or -c
+func lookupFlag(flags *flag.FlagSet, word string) *flag.Flag {
+	if name, ok := strings.CutPrefix(word, "--"); ok {
+		return flags.Lookup(name)
+	}
+	if len(word) == 2 {
+		return flags.ShorthandLookup(word[1:])
+	}
+	return nil
+}
+
+// Get the IDs and names of the instances configured in the configuration the words of a command line designate,
+// nothing if it can't be loaded
+func completionInstances(words []string) []string {
+	flags := flag.NewFlagSet("", flag.ContinueOnError)
+	flags.ParseErrorsWhitelist.UnknownFlags = true
+	flags.SetOutput(io.Discard)
+	configFile := flags.StringP("config", "c", os.Getenv("SNAPOMATIC_CONFIG"), "")
+	configDir := flags.String("config-dir", os.Getenv("SNAPOMATIC_CONFIG_DIR"), "")
+	configFormat := flags.String("config-format", "", "")
+	_ = flags.Parse(words)
+
+	var cfg config
+	filename, err := findConfigFile(*configFile)
+	if err == nil {
+		err = loadConfig(filename, *configFormat, &cfg)
+	}
+	if err == nil && *configDir != "" {
+		err = loadConfigDir(*configDir, &cfg)
+	}
+	if err != nil {
+		return nil
+	}
+
+	instances := []string{}
+	add := func(configured []InstanceConfig) {
+		for _, instance := range configured {
+			switch {
+			case instance.ID != "":
+				instances = append(instances, instance.ID.String())
+			case instance.Name != "" && !isNamePattern(instance.Name):
+				instances = append(instances, instance.Name)
+			}
+		}
+	}
+	add(cfg.Instances)
+	for _, account := range cfg.Accounts {
+		add(account.Instances)
+	}
+	return instances
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Top-level keys a configuration fragment may set, the other settings belong to the main configuration file
+var configFragmentKeys = []string{"instances", "policies", "accounts"}
+
+// List the configuration fragments of a directory, in the order they are merged: by file name
+func configFragments(dir string) ([]string, error) {
+	entries, err := os.ReadDir(dir) // Sorted by file name
+	if err != nil {
+		return nil, err
+	}
+
+	fragments := []string{}
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || strings.HasPrefix(entry.Name(), ".") {
+			continue
+		}
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json", ".toml":
+			fragments = append(fragments, filepath.Join(dir, entry.Name()))
+		}
+	}
+	return fragments, nil
+}
+
+// Parse the configuration fragments of a directory as YAML documents, none without directory
+func readConfigFragments(dir string) ([]*yaml.Node, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	fragments, err := configFragments(dir)
+	if err != nil {
+		return nil, err
+	}
+	roots := []*yaml.Node{}
+	for _, fragment := range fragments {
+		data, err := readConfigFile(fragment, "", false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", fragment, err)
+		}
+		var root yaml.Node
+		if err := yaml.Unmarshal(data, &root); err != nil {
+			return nil, fmt.Errorf("%s: %w", fragment, err)
+		}
+		roots = append(roots, &root)
+	}
+	return roots, nil
+}
+
+// Check that a configuration fragment only sets the keys fragments may set
+func checkFragmentKeys(root *yaml.Node) error {
+	node := yamlNode(root)
+	for i := 0; node != nil && node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+		if key := node.Content[i]; !slices.Contains(configFragmentKeys, key.Value) {
+			return fmt.Errorf("line %d: %s can't be set in a configuration fragment, only %s", key.Line, key.Value, strings.Join(configFragmentKeys, ", "))
+		}
+	}
+	return nil
+}
+
+// Get the name nodes of the policies a configuration fragment defines
+func fragmentPolicies(root *yaml.Node) []*yaml.Node {
+	names := []*yaml.Node{}
+	node := yamlNode(root, "policies")
+	for i := 0; node != nil && node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+		names = append(names, node.Content[i])
+	}
+	return names
+}
+
+// Merge a configuration fragment into the configuration. Its instances and accounts are appended, its policies added,
+// and it uses the defaults of the main configuration file and the policies defined before it.
+func loadConfigFragment(filename string, cfg *config) error {
+	data, err := readConfigFile(filename, "", true)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+
+	fragment := config{Defaults: cfg.Defaults, Policies: maps.Clone(cfg.Policies)}
+	err = checkFragmentKeys(&root)
+	if err == nil {
+		err = decodeConfig(data, &fragment)
+	}
+	for _, name := range fragmentPolicies(&root) {
+		if _, ok := cfg.Policies[name.Value]; ok && err == nil {
+			err = fmt.Errorf("line %d: policy %q is already defined", name.Line, name.Value)
+		}
+	}
+	if err != nil {
+		return withoutConvertedLines(filename, "", err)
+	}
+
+	for _, name := range fragmentPolicies(&root) {
+		cfg.Policies[name.Value] = fragment.Policies[name.Value]
+	}
+	cfg.Instances = append(cfg.Instances, fragment.Instances...)
+	cfg.Accounts = append(cfg.Accounts, fragment.Accounts...)
+	return nil
+}
+
+// Merge the configuration fragments of a directory into the configuration, in the order of their file names
+func loadConfigDir(dir string, cfg *config) error {
+	fragments, err := configFragments(dir)
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		if err := loadConfigFragment(fragment, cfg); err != nil {
+			return fmt.Errorf("%s: %w", fragment, err)
+		}
+	}
+	return nil
+}
+
+// Check the configuration fragments of a directory on top of the main configuration and write their problems.
+// Returns whether any was found.
+func validateConfigDir(w io.Writer, dir string, cfg config) bool {
+	fragments, err := configFragments(dir)
+	if err != nil {
+		_, _ = fmt.Fprintln(w, err)
+		return true
+	}
+
+	invalid := false
+	for _, fragment := range fragments {
+		problems := validateConfigFile(fragment, "", &cfg)
+		if len(problems) == 0 {
+			// Merged for the next fragments, which may use its policies
+			if err := loadConfigFragment(fragment, &cfg); err != nil {
+				problems = configProblems(err)
+			}
+		}
+		writeConfigProblems(w, fragment, problems)
+		invalid = invalid || len(problems) > 0
+	}
+	return invalid
+}
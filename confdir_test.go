@@ -0,0 +1,74 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigDirPolicies(t *testing.T) {
+	const base = "policies:\n  prod:\n    daily: 14\n"
+	tests := []struct {
+		name      string
+		fragments map[string]string // By file name
+		wantErr   string            // Empty if the fragments are merged
+		policies  []string
+	}{
+		{
+			name:      "new policy",
+			fragments: map[string]string{"a.yaml": "policies:\n  dev:\n    daily: 3\ninstances:\n  - id: a\n    policy: dev\n"},
+			policies:  []string{"prod", "dev"},
+		},
+		{
+			name:      "policy of an earlier fragment",
+			fragments: map[string]string{"a.yaml": "policies:\n  dev:\n    daily: 3\n", "b.yaml": "instances:\n  - id: a\n    policy: dev\n"},
+			policies:  []string{"prod", "dev"},
+		},
+		{
+			name:      "policy of the configuration file",
+			fragments: map[string]string{"a.yaml": "policies:\n  prod:\n    daily: 3\n"},
+			wantErr:   `a.yaml: line 2: policy "prod" is already defined`,
+		},
+		{
+			name:      "policy of an earlier fragment redefined",
+			fragments: map[string]string{"a.yaml": "policies:\n  dev:\n    daily: 3\n", "b.yaml": "instances: []\npolicies:\n  dev:\n    daily: 7\n"},
+			wantErr:   `b.yaml: line 3: policy "dev" is already defined`,
+		},
+		{
+			name:      "policy of a later fragment",
+			fragments: map[string]string{"a.yaml": "instances:\n  - id: a\n    policy: dev\n", "b.yaml": "policies:\n  dev:\n    daily: 3\n"},
+			wantErr:   "a.yaml",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			for name, content := range tt.fragments {
+				if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			cfg := config{}
+			if err := decodeConfig([]byte(base), &cfg); err != nil {
+				t.Fatal(err)
+			}
+
+			err := loadConfigDir(dir, &cfg)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Fatalf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Fatalf("error %v, want one containing %q", err, tt.wantErr)
+			}
+			for _, name := range tt.policies {
+				if _, ok := cfg.Policies[name]; !ok {
+					t.Errorf("policy %q missing", name)
+				}
+			}
+			if tt.wantErr == "" && cfg.Policies["prod"].Daily.Keep != 14 {
+				t.Errorf("policy prod overridden: %+v", cfg.Policies["prod"])
+			}
+		})
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pelletier/go-toml/v2"
+	"gopkg.in/yaml.v3"
+)
+
+// Get the format of a configuration file, the given one or the one of its extension, defaulting to YAML
+func configFormat(filename, format string) (string, error) {
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(configPath(filename))) {
+		case ".toml":
+			return "toml", nil
+		case ".json":
+			return "json", nil
+		default:
+			return "yaml", nil
+		}
+	}
+
+	switch format {
+	case "yaml", "json", "toml":
+		return format, nil
+	default:
+		return "", fmt.Errorf("unsupported configuration format %q (expected yaml, json or toml)", format)
+	}
+}
+
+// Read a configuration file as YAML, expanding its environment variable references unless told otherwise. JSON is
+// valid YAML already, TOML gets converted so that all formats are decoded the same way.
+func readConfigFile(filename, format string, expand bool) ([]byte, error) {
+	format, err := configFormat(filename, format)
+	if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if isRemoteConfig(filename) {
+		data, err = readRemoteConfig(filename)
+	} else {
+		data, err = os.ReadFile(filename)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if expand {
+		if data, err = expandEnv(data); err != nil {
+			return nil, err
+		}
+	}
+	if format != "toml" {
+		return data, nil
+	}
+
+	var doc map[string]any
+	if err := toml.Unmarshal(data, &doc); err != nil {
+		var decodeErr *toml.DecodeError
+		if errors.As(err, &decodeErr) {
+			row, _ := decodeErr.Position()
+			return nil, fmt.Errorf("line %d: %w", row, err)
+		}
+		return nil, err
+	}
+	return yaml.Marshal(doc)
+}
+
+// Reference to an environment variable in a configuration file, or its escape
+var envReferenceRe = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Replace the ${VAR} references to environment variables of a configuration file by their values, $${ escaping a
+// literal ${. Lines that are comments are left as is, and variables which are not defined are errors.
+func expandEnv(data []byte) ([]byte, error) {
+	lines := strings.SplitAfter(string(data), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "#") {
+			continue
+		}
+
+		var undefined string
+		lines[i] = envReferenceRe.ReplaceAllStringFunc(line, func(reference string) string {
+			if reference == "$${" {
+				return "${"
+			}
+			name := reference[2 : len(reference)-1]
+			value, ok := os.LookupEnv(name)
+			if !ok && undefined == "" {
+				undefined = name
+			}
+			return value
+		})
+		if undefined != "" {
+			return nil, fmt.Errorf("line %d: environment variable %s is not defined", i+1, undefined)
+		}
+	}
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// Duration accepting Go duration strings (e.g. "6h") as well as days, weeks and years (e.g. "90d", "2w", "1y")
+type duration time.Duration
+
+func (d *duration) UnmarshalYAML(value *yaml.Node) error {
+	parsed, err := parseDuration(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", value.Line, err)
+	}
+	if parsed < 0 {
+		return fmt.Errorf("line %d: duration %q must not be negative", value.Line, value.Value)
+	}
+	*d = duration(parsed)
+	return nil
+}
+
+func (d duration) String() string {
+	return formatDuration(time.Duration(d))
+}
+
+// Parse a duration, supporting "d" (day), "w" (week) and "y" (365 days) units in addition to the Go ones
+func parseDuration(s string) (time.Duration, error) {
+	for unit, length := range map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour, "y": 365 * 24 * time.Hour} {
+		if n, ok := strings.CutSuffix(s, unit); ok {
+			value, err := strconv.ParseFloat(n, 64)
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", s)
+			}
+			return time.Duration(value * float64(length)), nil
+		}
+	}
+
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, errors.New(strings.TrimPrefix(err.Error(), "time: "))
+	}
+	return d, nil
+}
+
+// Format a duration, using days when it is a whole number of them
+func formatDuration(d time.Duration) string {
+	if d >= 24*time.Hour && d%(24*time.Hour) == 0 {
+		return fmt.Sprintf("%dd", d/(24*time.Hour))
+	}
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+// Settings of one of the fixed retention timeframes, written either as the number of snapshots to keep (e.g. 24) or
+// as a mapping (e.g. {keep: 24, margin: 5%})
+type timeframeRetention struct {
+	Keep   int
+	Margin retentionMargin // Overrides the margin of the retention policy
+}
+
+func (r *timeframeRetention) UnmarshalYAML(value *yaml.Node) error {
+	*r = timeframeRetention{}
+	keep := value
+	if value.Kind == yaml.MappingNode {
+		keep = nil
+		for i := 0; i+1 < len(value.Content); i += 2 {
+			switch key := value.Content[i]; key.Value {
+			case "keep":
+				keep = value.Content[i+1]
+			case "margin":
+				if err := value.Content[i+1].Decode(&r.Margin); err != nil {
+					return err
+				}
+			default:
+				return fmt.Errorf("line %d: unknown field %q, expected keep or margin", key.Line, key.Value)
+			}
+		}
+		if keep == nil {
+			return fmt.Errorf("line %d: missing keep", value.Line)
+		}
+	}
+
+	if err := keep.Decode(&r.Keep); err != nil {
+		return err
+	}
+	if r.Keep < 0 {
+		return fmt.Errorf("line %d: number of snapshots to keep must not be negative", keep.Line)
+	}
+	return nil
+}
+
+// Fraction of a timeframe by which retained snapshots may be closer than the timeframe, written as a fraction (e.g.
+// 0.1) or a percentage (e.g. 10%)
+type retentionMargin struct {
+	factor float64
+	set    bool // Whether the margin is configured, a zero margin is valid
+}
+
+func (m *retentionMargin) UnmarshalYAML(value *yaml.Node) error {
+	s, divisor := value.Value, 1.0
+	if n, ok := strings.CutSuffix(s, "%"); ok {
+		s, divisor = n, 100
+	}
+	factor, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid margin %q", value.Line, value.Value)
+	}
+	factor /= divisor
+	if factor < 0 || factor >= 1 {
+		return fmt.Errorf("line %d: margin %q must be at least 0 and less than 100%%", value.Line, value.Value)
+	}
+	*m = retentionMargin{factor: factor, set: true}
+	return nil
+}
+
+// Get the margin factor, or the fallback one if the margin isn't configured
+func (m retentionMargin) or(fallback float64) float64 {
+	if !m.set {
+		return fallback
+	}
+	return m.factor
+}
+
+func (t *RetentionTier) UnmarshalYAML(value *yaml.Node) error {
+	for i := 0; value.Kind == yaml.MappingNode && i+1 < len(value.Content); i += 2 {
+		if key := value.Content[i]; key.Value != "every" && key.Value != "keep" && key.Value != "margin" {
+			return fmt.Errorf("line %d: unknown field %q, expected every, keep or margin", key.Line, key.Value)
+		}
+	}
+
+	type plain RetentionTier // Without the UnmarshalYAML method
+	if err := value.Decode((*plain)(t)); err != nil {
+		return err
+	}
+	if t.Every <= 0 {
+		return fmt.Errorf("line %d: tier is missing every", value.Line)
+	}
+	if t.Keep <= 0 {
+		return fmt.Errorf("line %d: tier must keep at least one snapshot", value.Line)
+	}
+	return nil
+}
+
+// Settings applied to all instances unless they override them
+type DefaultsConfig struct {
+	Snapshots SnapshotRetention `yaml:"snapshots"`
+}
+
+// Raw retention blocks of the configuration, needed to tell which fields were actually set
+type rawRetentionConfig struct {
+	Policies  map[string]yaml.Node `yaml:"policies"`
+	Instances []struct {
+		Snapshots yaml.Node `yaml:"snapshots"`
+	} `yaml:"instances"`
+	Discover struct {
+		Snapshots yaml.Node `yaml:"snapshots"`
+	} `yaml:"discover"`
+	Accounts []struct {
+		Instances []struct {
+			Snapshots yaml.Node `yaml:"snapshots"`
+		} `yaml:"instances"`
+		Discover struct {
+			Snapshots yaml.Node `yaml:"snapshots"`
+		} `yaml:"discover"`
+	} `yaml:"accounts"`
+}
+
+// Resolve the retention policies of instances by layering, from lowest to highest precedence: the default retention
+// policy, the named policy referenced by the instance and the fields set by the instance itself
+func applyRetentionDefaults(data []byte, cfg *config) error {
+	var raw rawRetentionConfig
+	if err := yaml.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	// Named policies inherit the defaults as well
+	for name, node := range raw.Policies {
+		policy := cfg.Defaults.Snapshots
+		if err := node.Decode(&policy); err != nil {
+			return fmt.Errorf("policy %q: %w", name, err)
+		}
+		cfg.Policies[name] = policy
+	}
+
+	merge := func(policyName string, node *yaml.Node) (SnapshotRetention, error) {
+		retention := cfg.Defaults.Snapshots
+		if policyName != "" {
+			policy, ok := cfg.Policies[policyName]
+			if !ok {
+				return retention, fmt.Errorf("unknown policy %q", policyName)
+			}
+			retention = policy
+		}
+		if node.Kind != 0 {
+			if err := node.Decode(&retention); err != nil {
+				return retention, err
+			}
+		}
+		return retention, nil
+	}
+
+	for i := range cfg.Instances {
+		retention, err := merge(cfg.Instances[i].Policy, &raw.Instances[i].Snapshots)
+		if err != nil {
+			return fmt.Errorf("instance %d: %w", i+1, err)
+		}
+		cfg.Instances[i].Snapshots = retention
+		cfg.Instances[i].retentionSet = cfg.Instances[i].Policy != "" || raw.Instances[i].Snapshots.Kind != 0
+	}
+
+	retention, err := merge(cfg.Discover.Policy, &raw.Discover.Snapshots)
+	if err != nil {
+		return fmt.Errorf("discover: %w", err)
+	}
+	cfg.Discover.Snapshots = retention
+
+	for a := range cfg.Accounts {
+		account, rawAccount := &cfg.Accounts[a], &raw.Accounts[a]
+		for i := range account.Instances {
+			retention, err := merge(account.Instances[i].Policy, &rawAccount.Instances[i].Snapshots)
+			if err != nil {
+				return fmt.Errorf("account %d: instance %d: %w", a+1, i+1, err)
+			}
+			account.Instances[i].Snapshots = retention
+			account.Instances[i].retentionSet = account.Instances[i].Policy != "" || rawAccount.Instances[i].Snapshots.Kind != 0
+		}
+
+		retention, err := merge(account.Discover.Policy, &rawAccount.Discover.Snapshots)
+		if err != nil {
+			return fmt.Errorf("account %d: discover: %w", a+1, err)
+		}
+		account.Discover.Snapshots = retention
+	}
+
+	return nil
+}
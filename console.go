@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// ANSI escape sequences of the colors of the console
+const (
+	colorReset  = "\x1b[0m"
+	colorRed    = "\x1b[31m"
+	colorGreen  = "\x1b[32m"
+	colorYellow = "\x1b[33m"
+	colorCyan   = "\x1b[36m"
+	colorGray   = "\x1b[90m"
+)
+
+// Terminal the logs and the progress of the run are written to when snap-o-matic is run interactively
+type console struct {
+	mu    sync.Mutex
+	w     io.Writer
+	color bool
+	done  int // Instances processed so far
+}
+
+// nil unless logs go to a terminal, see setupLogging
+var interactive *console
+
+// Check whether w is a terminal rather than a file or a pipe
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// Check whether colors are wanted, see https://no-color.org
+func colorEnabled(noColor bool) bool {
+	return !noColor && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// Wrap s in the escape sequences of a color, if colors are enabled
+func (c *console) paint(color, s string) string {
+	if !c.color {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// Print a line with the outcome of an instance and how many of the total are done. Does nothing if not interactive.
+func (c *console) instanceDone(result instanceResult, total int) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.done++
+
+	status := c.paint(colorGreen, "ok")
+	detail := fmt.Sprintf("%d created, %d deleted", result.Created, result.Deleted)
+	switch {
+	case result.Err != nil:
+		status, detail = c.paint(colorRed, "failed"), result.Err.Error()
+	case result.DeleteErrors > 0:
+		status = c.paint(colorRed, "failed")
+		detail += fmt.Sprintf(", %d deletion error(s)", result.DeleteErrors)
+	case result.Skipped != "":
+		status = c.paint(colorYellow, "skipped")
+		detail = result.Skipped
+	}
+	_, _ = fmt.Fprintf(c.w, "[%d/%d] %s %s: %s\n", c.done, total, result.label(), status, detail)
+}
+
+// Handler writing records as short colored lines, for humans rather than log collectors
+type consoleHandler struct {
+	console *console
+	level   slog.Leveler
+	attrs   []slog.Attr
+	prefix  string // Of the keys of the attributes, from the groups
+}
+
+func (h consoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h consoleHandler) Handle(_ context.Context, r slog.Record) error {
+	c := h.console
+
+	var b strings.Builder
+	b.WriteString(c.paint(colorGray, r.Time.Format("15:04:05")))
+	b.WriteByte(' ')
+	level := fmt.Sprintf("%-5s", r.Level)
+	switch {
+	case r.Level >= slog.LevelError:
+		level = c.paint(colorRed, level)
+	case r.Level >= slog.LevelWarn:
+		level = c.paint(colorYellow, level)
+	case r.Level >= slog.LevelInfo:
+		level = c.paint(colorCyan, level)
+	default:
+		level = c.paint(colorGray, level)
+	}
+	b.WriteString(level)
+	if r.Message != "" {
+		b.WriteString(" " + r.Message)
+	}
+
+	writeAttr := func(prefix string, attr slog.Attr) {
+		if attr.Equal(slog.Attr{}) {
+			return
+		}
+		value := attr.Value.Resolve().String()
+		if strings.ContainsAny(value, " \t\"") {
+			value = fmt.Sprintf("%q", value)
+		}
+		b.WriteString(" " + c.paint(colorGray, prefix+attr.Key+"=") + value)
+	}
+	for _, attr := range h.attrs {
+		writeAttr("", attr)
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		writeAttr(h.prefix, attr)
+		return true
+	})
+	b.WriteByte('\n')
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := io.WriteString(c.w, b.String())
+	return err
+}
+
+func (h consoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	for _, attr := range attrs {
+		attr.Key = h.prefix + attr.Key
+		h.attrs = append(h.attrs[:len(h.attrs):len(h.attrs)], attr)
+	}
+	return h
+}
+
+func (h consoleHandler) WithGroup(name string) slog.Handler {
+	h.prefix += name + "."
+	return h
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Settings of the cost command
+type CostConfig struct {
+	PricePerGiB float64 `yaml:"price_per_gib_month"` // Price of a GiB of snapshot storage for a month, costs aren't estimated if zero
+	Currency    string  `yaml:"currency"`            // Shown along with the costs, e.g. CHF
+}
+
+// Storage used by the snapshots of an instance, as shown by the cost command
+type instanceCost struct {
+	Account     string      `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID  v3.UUID     `json:"instance_id" yaml:"instance_id"`
+	Endpoint    v3.Endpoint `json:"endpoint" yaml:"endpoint"`
+	Snapshots   int         `json:"snapshots" yaml:"snapshots"`
+	SizeGiB     int64       `json:"size_gib" yaml:"size_gib"`
+	MonthlyCost *float64    `json:"monthly_cost,omitempty" yaml:"monthly_cost,omitempty"` // Unknown without a price
+}
+
+// Storage used by all the configured instances, and the estimate of its monthly cost
+type costReport struct {
+	Instances   []instanceCost `json:"instances" yaml:"instances"`
+	Snapshots   int            `json:"snapshots" yaml:"snapshots"`
+	SizeGiB     int64          `json:"size_gib" yaml:"size_gib"`
+	MonthlyCost *float64       `json:"monthly_cost,omitempty" yaml:"monthly_cost,omitempty"`
+	Currency    string         `json:"currency,omitempty" yaml:"currency,omitempty"`
+}
+
+// Sum the sizes of the snapshots of the configured instances and estimate their monthly cost
+func storageCosts(ctx context.Context, clients accountClients, cfg config) (costReport, error) {
+	report := costReport{Instances: []instanceCost{}, Currency: cfg.Cost.Currency}
+	estimate := func(size int64) *float64 {
+		if cfg.Cost.PricePerGiB <= 0 {
+			return nil
+		}
+		cost := float64(size) * cfg.Cost.PricePerGiB
+		return &cost
+	}
+
+	indexes := newSnapshotIndexes(clients)
+	for _, instance := range cfg.Instances {
+		endpoint := instance.apiEndpoint(cfg.APIEndpoint)
+		index, err := indexes.get(instance.Account, endpoint)
+		if err != nil {
+			return report, err
+		}
+		snapshots, err := index.get(ctx, instance.ID)
+		if err != nil {
+			return report, fmt.Errorf("unable to list the snapshots of instance %s: %w", instance.ID, err)
+		}
+
+		c := instanceCost{Account: instance.Account, InstanceID: instance.ID, Endpoint: endpoint, Snapshots: len(snapshots)}
+		for _, snapshot := range snapshots {
+			c.SizeGiB += snapshot.Size
+		}
+		c.MonthlyCost = estimate(c.SizeGiB)
+
+		report.Instances = append(report.Instances, c)
+		report.Snapshots += c.Snapshots
+		report.SizeGiB += c.SizeGiB
+	}
+	report.MonthlyCost = estimate(report.SizeGiB)
+
+	return report, nil
+}
+
+// Write the storage costs in the requested output format
+func writeCosts(w io.Writer, report costReport, format string) error {
+	return writeFormatted(w, report, format, func(tw *tabwriter.Writer) {
+		cost := func(c *float64) string {
+			if c == nil {
+				return "-"
+			}
+			if report.Currency != "" {
+				return fmt.Sprintf("%.2f %s", *c, report.Currency)
+			}
+			return fmt.Sprintf("%.2f", *c)
+		}
+
+		_, _ = fmt.Fprintln(tw, "INSTANCE\tSNAPSHOTS\tSIZE (GiB)\tMONTHLY COST")
+		for _, c := range report.Instances {
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%s\n", c.InstanceID, c.Snapshots, c.SizeGiB, cost(c.MonthlyCost))
+		}
+		_, _ = fmt.Fprintf(tw, "TOTAL\t%d\t%d\t%s\n", report.Snapshots, report.SizeGiB, cost(report.MonthlyCost))
+	})
+}
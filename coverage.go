@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Age of the newest snapshot above which an instance counts as not covered, unless configured
+const defaultCoverageMaxAge = 48 * time.Hour
+
+// Check whether the newest ready snapshot of an instance is older than its max_snapshot_age after a run, and describe
+// the alert if so. Dry runs which would have created a snapshot don't raise one.
+func snapshotAgeAlert(ctx context.Context, index *snapshotIndex, instance InstanceConfig, wouldCreate bool) (string, error) {
+	if wouldCreate {
+		return "", nil
+	}
+	snapshots, err := index.get(ctx, instance.ID)
+	if err != nil {
+		return "", err
+	}
+	snapshots = slices.DeleteFunc(snapshots, func(s v3.Snapshot) bool { return !snapshotUsable(s) })
+
+	newest := newestSnapshot(snapshots)
+	if newest == nil {
+		slog.WarnContext(ctx, "Instance has no ready snapshot", "instance_id", instance.ID, "max_snapshot_age", instance.MaxAge)
+		return "no ready snapshot", nil
+	}
+	if age := retentionClock.Now().Sub(newest.CreatedAT); age > time.Duration(instance.MaxAge) {
+		slog.WarnContext(ctx, "Newest ready snapshot is older than the max_snapshot_age", "instance_id", instance.ID, "snapshot_id", newest.ID, "created_at", newest.CreatedAT, "max_snapshot_age", instance.MaxAge)
+		return fmt.Sprintf("newest ready snapshot is %s old, more than the max_snapshot_age of %s", formatDuration(age.Round(time.Minute)), instance.MaxAge), nil
+	}
+	return "", nil
+}
+
+// Settings of the coverage command
+type CoverageConfig struct {
+	MaxAge duration `yaml:"max_age"` // Instances without a snapshot younger than this are flagged, defaults to 2 days
+}
+
+// Instance as shown by the coverage command
+type instanceCoverage struct {
+	Account        string      `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID     v3.UUID     `json:"instance_id" yaml:"instance_id"`
+	Name           string      `json:"name" yaml:"name"`
+	Endpoint       v3.Endpoint `json:"endpoint" yaml:"endpoint"`
+	Configured     bool        `json:"configured" yaml:"configured"`
+	NewestSnapshot *time.Time  `json:"newest_snapshot,omitempty" yaml:"newest_snapshot,omitempty"`
+	Status         string      `json:"status" yaml:"status"` // ok, unconfigured, stale or unconfigured+stale
+}
+
+// List all instances of all accounts, in the zones of the given API endpoints, and flag the ones without snapshot
+// policy or without a recent enough ready snapshot
+func instancesCoverage(ctx context.Context, clients accountClients, endpoints []v3.Endpoint, cfg config) ([]instanceCoverage, error) {
+	maxAge := time.Duration(cfg.Coverage.MaxAge)
+	if maxAge == 0 {
+		maxAge = defaultCoverageMaxAge
+	}
+
+	type instanceKey struct {
+		account string
+		id      v3.UUID
+	}
+	configured := make(map[instanceKey]bool)
+	for _, instance := range cfg.Instances {
+		configured[instanceKey{instance.Account, instance.ID}] = true
+	}
+
+	coverage := []instanceCoverage{}
+	indexes := newSnapshotIndexes(clients)
+	for _, account := range clients.names() {
+		for _, endpoint := range endpoints {
+			instances, err := clients[account].WithEndpoint(endpoint).ListInstances(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to list instances: %w", err)
+			}
+			index, err := indexes.get(account, endpoint)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, instance := range instances.Instances {
+				snapshots, err := index.get(ctx, instance.ID)
+				if err != nil {
+					return nil, err
+				}
+
+				// Only snapshots which can actually be restored count
+				ready := []v3.Snapshot{}
+				for _, snapshot := range snapshots {
+					if snapshotUsable(snapshot) {
+						ready = append(ready, snapshot)
+					}
+				}
+
+				c := instanceCoverage{
+					Account:    account,
+					InstanceID: instance.ID,
+					Name:       instance.Name,
+					Endpoint:   endpoint,
+					Configured: configured[instanceKey{account, instance.ID}],
+				}
+				newest := newestSnapshot(ready)
+				if newest != nil {
+					c.NewestSnapshot = &newest.CreatedAT
+				}
+				stale := newest == nil || retentionClock.Now().Sub(newest.CreatedAT) > maxAge
+
+				switch {
+				case !c.Configured && stale:
+					c.Status = "unconfigured+stale"
+				case !c.Configured:
+					c.Status = "unconfigured"
+				case stale:
+					c.Status = "stale"
+				default:
+					c.Status = "ok"
+				}
+				coverage = append(coverage, c)
+			}
+		}
+	}
+
+	return coverage, nil
+}
+
+// Write the coverage of instances in the requested output format
+func writeCoverage(w io.Writer, coverage []instanceCoverage, format string) error {
+	return writeFormatted(w, coverage, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(tw, "INSTANCE\tNAME\tCONFIGURED\tNEWEST SNAPSHOT\tSTATUS")
+		for _, c := range coverage {
+			newest := "-"
+			if c.NewestSnapshot != nil {
+				newest = c.NewestSnapshot.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%t\t%s\t%s\n", c.InstanceID, c.Name, c.Configured, newest, c.Status)
+		}
+	})
+}
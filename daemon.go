@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Schedule used for instances which don't define their own in daemon mode
+const defaultSchedule = "@hourly"
+
+// Run continuously, processing every instance according to its cron schedule
+func runDaemon(ctx context.Context, clients accountClients, state *stateStore, cfg config) error {
+	if cfg.MetricsListen != "" {
+		if err := metrics.serve(cfg.MetricsListen); err != nil {
+			return err
+		}
+	}
+
+	// Each scheduled run gets its own ID, the one of the process is left to the lines logged outside of them
+	processRunIDUsed.Store(true)
+
+	scheduler := cron.New(cron.WithChain(cron.SkipIfStillRunning(cronLogger{})), cron.WithLogger(cronLogger{}))
+
+	for _, instance := range cfg.Instances {
+		schedule := instance.Schedule
+		if schedule == "" {
+			schedule = defaultSchedule
+		}
+
+		_, err := scheduler.AddFunc(schedule, func() {
+			runInstances(ctx, clients, state, cfg, []InstanceConfig{instance})
+		})
+		if err != nil {
+			return fmt.Errorf("invalid schedule %q for instance %s: %w", schedule, instance.ID, err)
+		}
+		slog.Info("Scheduled instance", "instance_id", instance.ID, "schedule", schedule)
+	}
+
+	// Running jobs are waited for on shutdown, they abort their operations once the context is canceled
+	scheduler.Start()
+	<-shutdown.stopping
+	<-scheduler.Stop().Done()
+
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	defaultEmailSubject = `[snap-o-matic] {{if .Failed}}FAILED{{else}}OK{{end}}: run {{.Report.RunID}}`
+	defaultEmailBody    = `{{.Summary}}
+`
+)
+
+// SMTP server receiving run summaries
+type EmailConfig struct {
+	NotifierOptions `yaml:",inline"`
+	Host            string   `yaml:"host"`
+	Port            int      `yaml:"port"` // Defaults to 465 with implicit TLS, 587 otherwise
+	TLS             string   `yaml:"tls"`  // starttls (default), tls (implicit TLS) or none
+	Username        string   `yaml:"username"`
+	Password        string   `yaml:"password"`
+	From            string   `yaml:"from"`
+	To              []string `yaml:"to"`
+	Subject         string   `yaml:"subject"` // text/template, see emailTemplateData
+	Body            string   `yaml:"body"`    // text/template, see emailTemplateData
+}
+
+// Data available to the email subject and body templates
+type emailTemplateData struct {
+	Report       runReport
+	Summary      string
+	Failed       bool
+	Created      int
+	Deleted      int
+	DeleteErrors int
+}
+
+func (c EmailConfig) notify(ctx context.Context, report runReport) error {
+	if err := c.send(ctx, report); err != nil {
+		return fmt.Errorf("email: %w", err)
+	}
+	return nil
+}
+
+func (c EmailConfig) send(ctx context.Context, report runReport) error {
+	if len(c.To) == 0 {
+		return errors.New("no recipients configured")
+	}
+
+	data := emailTemplateData{
+		Report:  report,
+		Summary: report.summary(),
+		Failed:  report.hasFailures(),
+	}
+	totals := report.totals()
+	data.Created, data.Deleted, data.DeleteErrors = totals.Created, totals.Deleted, totals.DeleteErrors
+
+	subject, err := renderTemplate("subject", c.Subject, defaultEmailSubject, data)
+	if err != nil {
+		return err
+	}
+	body, err := renderTemplate("body", c.Body, defaultEmailBody, data)
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", c.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(c.To, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", strings.ReplaceAll(subject, "\n", " "))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "X-Snapomatic-Run-Id: %s\r\n", report.RunID)
+	msg.WriteString("MIME-Version: 1.0\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(strings.ReplaceAll(strings.ReplaceAll(body, "\r\n", "\n"), "\n", "\r\n"))
+
+	client, err := c.dial(ctx)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+
+	if err := client.Mail(c.From); err != nil {
+		return err
+	}
+	for _, to := range c.To {
+		if err := client.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s rejected: %w", to, err)
+		}
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return client.Quit()
+}
+
+// Connect to the SMTP server, using the configured TLS mode
+func (c EmailConfig) dial(ctx context.Context) (*smtp.Client, error) {
+	port := c.Port
+	if port == 0 {
+		port = 587
+		if c.TLS == "tls" {
+			port = 465
+		}
+	}
+	addr := net.JoinHostPort(c.Host, strconv.Itoa(port))
+	tlsConfig := &tls.Config{ServerName: c.Host}
+
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	var conn net.Conn
+	var err error
+	switch c.TLS {
+	case "tls":
+		conn, err = (&tls.Dialer{Config: tlsConfig}).DialContext(ctx, "tcp", addr)
+	case "starttls", "", "none":
+		conn, err = (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	default:
+		return nil, fmt.Errorf("unsupported TLS mode %q (expected starttls, tls or none)", c.TLS)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if c.TLS == "starttls" || c.TLS == "" {
+		if err := client.StartTLS(tlsConfig); err != nil {
+			client.Close()
+			return nil, fmt.Errorf("STARTTLS failed: %w", err)
+		}
+	}
+
+	return client, nil
+}
+
+// Render a user-supplied template, falling back to a default one
+func renderTemplate(name, text, fallback string, data any) (string, error) {
+	if text == "" {
+		text = fallback
+	}
+
+	tmpl, err := template.New(name).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s template: %w", name, err)
+	}
+
+	var b strings.Builder
+	if err := tmpl.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("unable to render %s template: %w", name, err)
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/google/uuid"
+)
+
+// Prefix of the types of the emitted events
+const cloudEventTypePrefix = "com.exoscale.snap-o-matic."
+
+// Events waiting to be sent over HTTP at most, the ones emitted while the queue is full are dropped
+const cloudEventQueueSize = 1000
+
+// Emission of snapshot lifecycle events as CloudEvents, see https://cloudevents.io
+type EventsConfig struct {
+	URL     string            `yaml:"url"`     // Receiver of the events over HTTP, in the structured content mode
+	Headers map[string]string `yaml:"headers"` // Sent along with the events, e.g. for authentication
+	File    string            `yaml:"file"`    // File the events are appended to, one JSON document per line
+	Source  string            `yaml:"source"`  // Source attribute of the events, defaults to snap-o-matic/HOSTNAME
+	Retries *int              `yaml:"retries"` // Additional attempts after a failed delivery over HTTP, defaults to 3
+}
+
+// CloudEvent in the JSON format, version 1.0 of the specification
+type cloudEvent struct {
+	SpecVersion     string    `json:"specversion"`
+	ID              string    `json:"id"`
+	Source          string    `json:"source"`
+	Type            string    `json:"type"`
+	Subject         string    `json:"subject,omitempty"`
+	Time            time.Time `json:"time"`
+	DataContentType string    `json:"datacontenttype"`
+	Data            any       `json:"data"`
+}
+
+// Data of the snapshot and instance events
+type snapshotEventData struct {
+	RunID      string  `json:"run_id"`
+	Account    string  `json:"account,omitempty"`
+	InstanceID v3.UUID `json:"instance_id"`
+	SnapshotID v3.UUID `json:"snapshot_id,omitempty"`
+	Action     string  `json:"action,omitempty"` // create or delete, for failed events
+	Reason     string  `json:"reason,omitempty"`
+	Error      string  `json:"error,omitempty"`
+}
+
+// Sends the events to the configured sinks as they happen, failed deliveries are only logged. Events are written to
+// the file right away, and sent over HTTP in the background so that a slow receiver doesn't hold up the run.
+type cloudEventSink struct {
+	mu      sync.Mutex // Serializes the writes to the file
+	url     string
+	headers http.Header
+	retries int
+	file    string
+	source  string
+
+	queue   chan queuedCloudEvent
+	pending sync.WaitGroup // Events queued and not sent yet
+}
+
+// Event waiting to be sent over HTTP
+type queuedCloudEvent struct {
+	ctx       context.Context // Context the event was emitted in, for the logs
+	eventType string
+	body      []byte
+}
+
+// nil unless events are configured
+var cloudEvents *cloudEventSink
+
+func newCloudEventSink(cfg EventsConfig) *cloudEventSink {
+	if cfg.URL == "" && cfg.File == "" {
+		return nil
+	}
+
+	source := cfg.Source
+	if source == "" {
+		host, _ := os.Hostname()
+		source = "snap-o-matic/" + cmp.Or(host, "localhost")
+	}
+	headers := http.Header{}
+	for key, value := range cfg.Headers {
+		headers.Set(key, value)
+	}
+	headers.Set("Content-Type", "application/cloudevents+json")
+	retries := 3
+	if cfg.Retries != nil {
+		retries = *cfg.Retries
+	}
+
+	s := &cloudEventSink{url: cfg.URL, headers: headers, retries: retries, file: cfg.File, source: source}
+	if s.url != "" {
+		s.queue = make(chan queuedCloudEvent, cloudEventQueueSize)
+		go s.send()
+	}
+	return s
+}
+
+// Emit the event of a snapshot created, deleted or which failed to be. Dry runs and archiving emit nothing.
+func (s *cloudEventSink) snapshotEvent(ctx context.Context, action string, instanceID, snapshotID v3.UUID, reason string, dryRun bool, err error) {
+	if s == nil || dryRun {
+		return
+	}
+
+	var eventType string
+	switch {
+	case err != nil && (action == "create" || action == "delete"):
+		eventType = "snapshot.failed"
+	case action == "create":
+		eventType = "snapshot.created"
+	case action == "delete":
+		eventType = "snapshot.pruned"
+	default:
+		return
+	}
+
+	data := snapshotEventData{
+		RunID:      runID(ctx),
+		Account:    logAttr(ctx, "account"),
+		InstanceID: instanceID,
+		SnapshotID: snapshotID,
+		Action:     action,
+		Reason:     reason,
+	}
+	if err != nil {
+		data.Error = err.Error()
+	}
+	subject := "instances/" + string(instanceID)
+	if snapshotID != "" {
+		subject += "/snapshots/" + string(snapshotID)
+	}
+	s.emit(ctx, eventType, subject, data)
+}
+
+// Emit the event of an instance whose processing was aborted by an error, if it was
+func (s *cloudEventSink) instanceFailed(ctx context.Context, result instanceResult) {
+	if s == nil || result.Err == nil {
+		return
+	}
+	data := snapshotEventData{
+		RunID:      runID(ctx),
+		Account:    result.Account,
+		InstanceID: result.InstanceID,
+		Error:      result.Err.Error(),
+	}
+	s.emit(ctx, "instance.failed", "instances/"+string(result.InstanceID), data)
+}
+
+// Emit an event of the given type, prefixed with cloudEventTypePrefix, to all the configured sinks
+func (s *cloudEventSink) emit(ctx context.Context, eventType, subject string, data any) {
+	event := cloudEvent{
+		SpecVersion:     "1.0",
+		ID:              uuid.NewString(),
+		Source:          s.source,
+		Type:            cloudEventTypePrefix + eventType,
+		Subject:         subject,
+		Time:            time.Now().UTC(),
+		DataContentType: "application/json",
+		Data:            data,
+	}
+	body, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error emitting event", "type", event.Type, "err", err)
+		return
+	}
+
+	if s.file != "" {
+		if err := s.append(body); err != nil {
+			slog.ErrorContext(ctx, "Error writing event", "type", event.Type, "err", err)
+		}
+	}
+	if s.queue != nil {
+		s.pending.Add(1)
+		select {
+		case s.queue <- queuedCloudEvent{context.WithoutCancel(ctx), event.Type, body}:
+		default:
+			s.pending.Done()
+			slog.ErrorContext(ctx, "Error sending event, too many events are waiting to be sent", "type", event.Type)
+		}
+	}
+}
+
+// Send the queued events over HTTP, one at a time and in order
+func (s *cloudEventSink) send() {
+	for event := range s.queue {
+		if err := postWithRetries(event.ctx, "Event", s.url, event.body, s.headers, s.retries); err != nil {
+			slog.ErrorContext(event.ctx, "Error sending event", "type", event.eventType, "err", err)
+		}
+		s.pending.Done()
+	}
+}
+
+// Wait for the queued events to be sent, at most for the timeout of a notification
+func (s *cloudEventSink) flush(ctx context.Context) {
+	if s == nil || s.queue == nil {
+		return
+	}
+	sent := make(chan struct{})
+	go func() {
+		s.pending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+	case <-time.After(notificationTimeout):
+		slog.WarnContext(ctx, "Gave up waiting for the events to be sent")
+	}
+}
+
+// Append an event to the file sink
+func (s *cloudEventSink) append(body []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := os.MkdirAll(filepath.Dir(s.file), 0o700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(body, '\n')); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Why a snapshot is retained or deleted, as shown by the explain command
+type snapshotExplanation struct {
+	Account    string          `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID v3.UUID         `json:"instance_id" yaml:"instance_id"`
+	ID         v3.UUID         `json:"id" yaml:"id"`
+	CreatedAt  time.Time       `json:"created_at" yaml:"created_at"`
+	Now        time.Time       `json:"now" yaml:"now"`       // Time the retention decisions are computed as of
+	Action     string          `json:"action" yaml:"action"` // keep, prune, pending, protected or ignore
+	Bucket     string          `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Reason     string          `json:"reason" yaml:"reason"`
+	Steps      []retentionStep `json:"steps,omitempty" yaml:"steps,omitempty"` // Decisions of each timeframe, smallest first
+}
+
+// Decision of a retention timeframe about a snapshot
+type retentionStep struct {
+	Timeframe string `json:"timeframe" yaml:"timeframe"`
+	Outcome   string `json:"outcome" yaml:"outcome"` // retained, too close, covered or limit reached
+	Detail    string `json:"detail" yaml:"detail"`
+}
+
+type retentionTraceKey struct{}
+
+// Decisions of the retention engine about one snapshot, collected while categorizing snapshots
+type retentionTrace struct {
+	target v3.UUID
+	steps  []retentionStep
+	seen   bool // Whether the current timeframe considered the target
+	done   bool // Whether a timeframe retained the target
+}
+
+// Return a copy of ctx tracing the retention decisions about a snapshot
+func withRetentionTrace(ctx context.Context, trace *retentionTrace) context.Context {
+	return context.WithValue(ctx, retentionTraceKey{}, trace)
+}
+
+// Get the retention trace of the context, nil if not tracing. All methods are no-ops on a nil trace.
+func retentionTraceFrom(ctx context.Context) *retentionTrace {
+	trace, _ := ctx.Value(retentionTraceKey{}).(*retentionTrace)
+	return trace
+}
+
+// Record the decision of a timeframe, if it is about the target
+func (t *retentionTrace) add(snapshot v3.Snapshot, timeframe, outcome, detail string, args ...any) {
+	if t == nil || snapshot.ID != t.target {
+		return
+	}
+	t.seen, t.done = true, t.done || outcome == "retained"
+	t.steps = append(t.steps, retentionStep{Timeframe: timeframe, Outcome: outcome, Detail: fmt.Sprintf(detail, args...)})
+}
+
+// Start tracing a timeframe
+func (t *retentionTrace) start() {
+	if t != nil {
+		t.seen = false
+	}
+}
+
+// Finish tracing a timeframe, which stopped before considering the target if it didn't retain it earlier. Disabled
+// timeframes are left out.
+func (t *retentionTrace) finish(timeframe string, limit int) {
+	if t == nil || t.seen || t.done || limit == 0 {
+		return
+	}
+	t.steps = append(t.steps, retentionStep{
+		Timeframe: timeframe,
+		Outcome:   "limit reached",
+		Detail:    fmt.Sprintf("the timeframe already retained as many newer snapshots as configured (%d)", limit),
+	})
+}
+
+// Explain why the snapshot of the --snapshot flag is retained or would be deleted by its instance's retention policy
+func explainSnapshot(ctx context.Context, clients accountClients, state *stateStore, cfg config, w io.Writer) error {
+	if cfg.SnapshotID == "" {
+		return errors.New("missing --snapshot")
+	}
+	id, err := v3.ParseUUID(cfg.SnapshotID)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot ID %q: %w", cfg.SnapshotID, err)
+	}
+
+	snapshot, account, endpoint, err := findSnapshot(ctx, clients, configuredEndpoints(cfg), id)
+	if err != nil {
+		return fmt.Errorf("unable to find snapshot %s: %w", id, err)
+	}
+
+	now := retentionClock.Now()
+	explanation := snapshotExplanation{Account: account, ID: snapshot.ID, CreatedAt: snapshot.CreatedAT, Now: now}
+	if snapshot.Instance != nil {
+		explanation.InstanceID = snapshot.Instance.ID
+	}
+
+	var instance *InstanceConfig
+	for i := range cfg.Instances {
+		if cfg.Instances[i].Account == account && cfg.Instances[i].ID == explanation.InstanceID {
+			instance = &cfg.Instances[i]
+			break
+		}
+	}
+
+	switch {
+	case state.isProtected(snapshot.ID):
+		explanation.Action, explanation.Reason = "protected", "protected snapshots are never deleted"
+	case instance == nil:
+		explanation.Action, explanation.Reason = "ignore", "the instance is not configured, see the gc command"
+	case !state.isManaged(snapshot.ID) && !cfg.UnsafeDeleteAll:
+		explanation.Action, explanation.Reason = "ignore", "not created by snap-o-matic, see --unsafe-delete-all"
+	case snapshot.CreatedAT.After(now):
+		explanation.Action, explanation.Reason = "ignore", "created after the time of the run"
+	}
+	if explanation.Action != "" {
+		return writeExplanation(w, explanation, cfg.Output)
+	}
+
+	snapshots, err := newSnapshotIndex(clients[account].WithEndpoint(endpoint)).get(ctx, explanation.InstanceID)
+	if err != nil {
+		return err
+	}
+	trace := &retentionTrace{target: snapshot.ID}
+	candidates := retentionCandidates(snapshots, state, cfg.UnsafeDeleteAll)
+	retainedSnapshots := categorizeSnapshots(withRetentionTrace(ctx, trace), candidates, instance.Snapshots)
+	explanation.Steps = trace.steps
+
+	if bucket, retained := retainedSnapshots[snapshot.ID.String()]; retained {
+		explanation.Action, explanation.Bucket = "keep", bucket
+		explanation.Reason = fmt.Sprintf("retained by the %s timeframe", bucket)
+		switch bucket {
+		case "min_age":
+			explanation.Reason = "younger than the minimum age"
+		case "keep_last":
+			explanation.Reason = fmt.Sprintf("one of the %d most recent snapshots", instance.Snapshots.KeepLast)
+		}
+	} else if due, at := deletionDue(state, snapshot.ID, time.Duration(cfg.DeletionGrace), now); due {
+		explanation.Action, explanation.Reason = "prune", "not retained by any timeframe"
+	} else {
+		explanation.Action = "pending"
+		explanation.Reason = fmt.Sprintf("not retained by any timeframe, deleted after the grace period, at %s", at.Format(time.RFC3339))
+	}
+
+	return writeExplanation(w, explanation, cfg.Output)
+}
+
+// Write a snapshot explanation in the requested output format
+func writeExplanation(w io.Writer, explanation snapshotExplanation, format string) error {
+	return writeFormatted(w, explanation, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintf(tw, "Snapshot %s of instance %s, created at %s\n", explanation.ID, explanation.InstanceID, explanation.CreatedAt.Format(time.RFC3339))
+		_, _ = fmt.Fprintf(tw, "Action as of %s: %s (%s)\n", explanation.Now.Format(time.RFC3339), explanation.Action, explanation.Reason)
+		if len(explanation.Steps) == 0 {
+			return
+		}
+
+		_, _ = fmt.Fprintln(tw)
+		_, _ = fmt.Fprintln(tw, "TIMEFRAME\tOUTCOME\tDETAIL")
+		for _, s := range explanation.Steps {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\n", s.Timeframe, s.Outcome, s.Detail)
+		}
+	})
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"strings"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// Export of new snapshots to an Object Storage (SOS) bucket
+type ExportConfig struct {
+	Enabled   bool              `yaml:"enabled"`
+	Bucket    string            `yaml:"bucket"`
+	Zone      string            `yaml:"zone"`       // Zone of the bucket
+	Endpoint  string            `yaml:"endpoint"`   // SOS endpoint, instead of zone
+	Prefix    string            `yaml:"prefix"`     // Prepended to the keys of the exported objects
+	AccessKey string            `yaml:"access_key"` // Defaults to the API credentials of the command line or environment
+	SecretKey string            `yaml:"secret_key"`
+	Snapshots SnapshotRetention `yaml:"snapshots"` // Retention of the exported objects, all are kept if unset
+}
+
+// Check the export settings and fill in the credentials, unless set explicitly
+func (c *ExportConfig) setup(defaultCreds func() (*credentials.Credentials, error)) error {
+	if c.Bucket == "" {
+		return errors.New("export: missing bucket")
+	}
+	if (c.Zone == "") == (c.Endpoint == "") {
+		return errors.New("export: exactly one of zone or endpoint must be set")
+	}
+
+	if c.AccessKey == "" && c.SecretKey == "" {
+		creds, err := defaultCreds()
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		value, err := creds.Get()
+		if err != nil {
+			return fmt.Errorf("export: %w", err)
+		}
+		c.AccessKey, c.SecretKey = value.APIKey, value.APISecret
+	}
+
+	return nil
+}
+
+// Get the client of the export bucket
+func (c ExportConfig) client() *sosClient {
+	endpoint, region := c.Endpoint, c.Zone
+	if endpoint == "" {
+		endpoint = sosZoneEndpoint(c.Zone)
+	}
+	if region == "" {
+		// e.g. https://sos-ch-gva-2.exo.io
+		region = strings.TrimPrefix(strings.SplitN(strings.TrimPrefix(endpoint, "https://"), ".", 2)[0], "sos-")
+	}
+
+	return &sosClient{
+		endpoint:  endpoint,
+		region:    region,
+		bucket:    c.Bucket,
+		accessKey: c.AccessKey,
+		secretKey: c.SecretKey,
+		http:      http.DefaultClient,
+	}
+}
+
+// Prefix of the keys of the objects exported for an instance
+func (c ExportConfig) instancePrefix(instanceID v3.UUID) string {
+	return c.Prefix + string(instanceID) + "/"
+}
+
+// Export a snapshot and upload it to the export bucket
+func exportSnapshot(ctx context.Context, client *v3.Client, cfg ExportConfig, snapshot v3.Snapshot, dryRun bool) error {
+	key := path.Join(cfg.instancePrefix(snapshot.Instance.ID), snapshot.CreatedAT.UTC().Format("20060102T150405Z")+"-"+string(snapshot.ID)+".qcow2")
+	ctx = withLogAttrs(ctx, "snapshot_id", snapshot.ID, "bucket", cfg.Bucket, "key", key)
+
+	if dryRun {
+		slog.InfoContext(ctx, "Dry run: would export snapshot")
+		return nil
+	}
+	slog.InfoContext(ctx, "Exporting snapshot")
+
+	export, err := snapshotExport(ctx, client, snapshot.ID)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, export.PresignedURL, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unable to download exported snapshot: %w", &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status})
+	}
+
+	// Verify the checksum of the downloaded data, the upload is aborted if it doesn't match
+	hash := md5.New()
+	body := &checksumReader{r: io.TeeReader(resp.Body, hash), verify: func() error {
+		if sum := hex.EncodeToString(hash.Sum(nil)); export.Md5sum != "" && sum != export.Md5sum {
+			return fmt.Errorf("checksum mismatch: got %s, expected %s", sum, export.Md5sum)
+		}
+		return nil
+	}}
+
+	if err := cfg.client().upload(ctx, key, body, resp.ContentLength); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Exported snapshot")
+	return nil
+}
+
+// Reader running a verification once the underlying reader is exhausted, failing the read if it doesn't pass
+type checksumReader struct {
+	r      io.Reader
+	verify func() error
+}
+
+func (c *checksumReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if errors.Is(err, io.EOF) {
+		if verifyErr := c.verify(); verifyErr != nil {
+			return n, verifyErr
+		}
+	}
+	return n, err
+}
+
+// Delete the exported objects of an instance which are not retained by the export retention policy and return the
+// number of deleted objects
+func pruneExports(ctx context.Context, cfg ExportConfig, instanceID v3.UUID, dryRun bool) (int, error) {
+	if cfg.Snapshots.isEmpty() {
+		return 0, nil
+	}
+
+	sos := cfg.client()
+	objects, err := sos.list(ctx, cfg.instancePrefix(instanceID))
+	if err != nil {
+		return 0, fmt.Errorf("unable to list exported snapshots: %w", err)
+	}
+
+	// Exported objects go through the same retention engine as snapshots
+	exports := make([]v3.Snapshot, 0, len(objects))
+	for _, object := range objects {
+		exports = append(exports, v3.Snapshot{ID: v3.UUID(object.Key), CreatedAT: object.LastModified})
+	}
+	retained := categorizeSnapshots(withLogAttrs(ctx, "bucket", cfg.Bucket), exports, cfg.Snapshots)
+
+	deleted := 0
+	for _, object := range objects {
+		if _, ok := retained[object.Key]; ok {
+			continue
+		}
+
+		if dryRun {
+			slog.InfoContext(ctx, "Dry run: exported snapshot would be deleted", "bucket", cfg.Bucket, "key", object.Key)
+			deleted++
+			continue
+		}
+		if err := sos.delete(ctx, object.Key); err != nil {
+			return deleted, fmt.Errorf("unable to delete exported snapshot %s: %w", object.Key, err)
+		}
+		slog.InfoContext(ctx, "Deleted exported snapshot", "bucket", cfg.Bucket, "key", object.Key)
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// Check whether a retention policy keeps nothing at all
+func (r SnapshotRetention) isEmpty() bool {
+	return r.Hourly.Keep == 0 && r.Daily.Keep == 0 && r.Weekly.Keep == 0 && r.Monthly.Keep == 0 && r.Quarterly.Keep == 0 && r.Yearly.Keep == 0 &&
+		r.MinAge == 0 && r.KeepLast == 0 && len(r.Tiers) == 0
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Grace period of orphaned snapshots, unless configured
+const defaultGCGracePeriod = 7 * 24 * time.Hour
+
+// Garbage collection of the snapshots of instances which no longer exist or are no longer configured
+type GCConfig struct {
+	Enabled     bool     `yaml:"enabled"`      // Also collect garbage at the end of each run, same as --gc
+	GracePeriod duration `yaml:"grace_period"` // Orphaned snapshots younger than this are kept, defaults to 7 days
+}
+
+// Snapshot as shown by the gc command
+type orphanedSnapshot struct {
+	Account    string    `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID v3.UUID   `json:"instance_id" yaml:"instance_id"`
+	ID         v3.UUID   `json:"id" yaml:"id"`
+	CreatedAt  time.Time `json:"created_at" yaml:"created_at"`
+	Reason     string    `json:"reason" yaml:"reason"` // instance deleted or instance not configured
+	Action     string    `json:"action" yaml:"action"` // delete, keep, protected or ignore
+}
+
+// Find the snapshots whose instance no longer exists or isn't configured, in all accounts and in the zones of the
+// given API endpoints, and delete the ones past the grace period. Like retention policies, garbage collection only
+// deletes snapshots created by snap-o-matic unless told otherwise, and never deletes protected snapshots.
+func collectGarbage(ctx context.Context, clients accountClients, endpoints []v3.Endpoint, state *stateStore, budget *deletionBudget, cfg config) ([]orphanedSnapshot, []instanceResult, error) {
+	gracePeriod := time.Duration(cfg.GC.GracePeriod)
+	if gracePeriod == 0 {
+		gracePeriod = defaultGCGracePeriod
+	}
+
+	type instanceKey struct {
+		account string
+		id      v3.UUID
+	}
+	configured := make(map[instanceKey]bool)
+	for _, instance := range cfg.Instances {
+		configured[instanceKey{instance.Account, instance.ID}] = true
+	}
+
+	orphans := []orphanedSnapshot{}
+	results := []instanceResult{}
+	for _, account := range clients.names() {
+		result := instanceResult{Account: account}
+
+		for _, endpoint := range endpoints {
+			client := clients[account].WithEndpoint(endpoint)
+			ctx := withLogAttrs(ctx, "account", account, "endpoint", endpoint)
+
+			instances, err := client.ListInstances(ctx)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to list instances: %w", err)
+			}
+			existing := make(map[v3.UUID]bool)
+			labels := make(map[v3.UUID]v3.Labels)
+			for _, instance := range instances.Instances {
+				existing[instance.ID] = true
+				labels[instance.ID] = instance.Labels
+			}
+
+			// The snapshot listing is not paginated
+			snapshots, err := client.ListSnapshots(ctx)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unable to list snapshots: %w", err)
+			}
+
+			for _, snapshot := range snapshots.Snapshots {
+				if snapshot.Instance == nil || configured[instanceKey{account, snapshot.Instance.ID}] {
+					continue
+				}
+
+				orphan := orphanedSnapshot{
+					Account:    account,
+					InstanceID: snapshot.Instance.ID,
+					ID:         snapshot.ID,
+					CreatedAt:  snapshot.CreatedAT,
+					Reason:     "instance not configured",
+				}
+				if !existing[snapshot.Instance.ID] {
+					orphan.Reason = "instance deleted"
+				}
+
+				switch {
+				case state.isProtected(snapshot.ID):
+					orphan.Action = "protected"
+				case neverTouched(cfg.NeverTouch, snapshot.Instance.ID, labels[snapshot.Instance.ID]):
+					orphan.Action = "ignore"
+				case !state.isManaged(snapshot.ID) && !cfg.UnsafeDeleteAll:
+					orphan.Action = "ignore"
+				case retentionClock.Now().Sub(snapshot.CreatedAT) < gracePeriod:
+					orphan.Action = "keep"
+				case result.Err != nil:
+					orphan.Action = "keep" // Out of deletion budget
+				case !budget.reserve(1):
+					orphan.Action = "keep"
+					result.Err = fmt.Errorf("garbage collection aborted: orphaned snapshots to delete exceed what is left of the global max_deletions_per_run (%d)", cfg.MaxDeletions)
+					slog.ErrorContext(ctx, "Error collecting orphaned snapshots", "err", result.Err)
+				default:
+					orphan.Action = "delete"
+					reason := "orphaned, " + orphan.Reason
+					ctx := withLogAttrs(ctx, "instance_id", snapshot.Instance.ID, "reason", orphan.Reason)
+					if deleteSnapshot(ctx, client, state, snapshot, reason, cfg.DryRun) {
+						result.Deleted++
+					} else {
+						result.DeleteErrors++
+					}
+					result.Actions = append(result.Actions, plannedAction{
+						Action:     "delete",
+						SnapshotID: snapshot.ID,
+						CreatedAt:  snapshot.CreatedAT,
+						Reason:     reason,
+					})
+				}
+
+				orphans = append(orphans, orphan)
+			}
+		}
+
+		if result.Deleted > 0 || result.DeleteErrors > 0 || result.Err != nil {
+			results = append(results, result)
+		}
+	}
+
+	slog.InfoContext(ctx, "Collected orphaned snapshots", "orphaned", len(orphans))
+	return orphans, results, nil
+}
+
+// Write orphaned snapshots in the requested output format
+func writeOrphans(w io.Writer, orphans []orphanedSnapshot, format string) error {
+	return writeFormatted(w, orphans, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(tw, "INSTANCE\tSNAPSHOT\tCREATED\tREASON\tACTION")
+		for _, o := range orphans {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", o.InstanceID, o.ID, o.CreatedAt.Format(time.RFC3339), o.Reason, o.Action)
+		}
+	})
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Ping a healthchecks.io-style heartbeat URL, suffix is "/start", "" (success) or "/fail".
+// The run ID is passed along so that start and completion signals can be paired.
+func pingHeartbeat(ctx context.Context, heartbeatURL, suffix, runID, body string) {
+	if heartbeatURL == "" {
+		return
+	}
+
+	u, err := url.Parse(strings.TrimSuffix(heartbeatURL, "/") + suffix)
+	if err != nil {
+		slog.ErrorContext(ctx, "Invalid heartbeat URL", "err", err)
+		return
+	}
+	query := u.Query()
+	query.Set("rid", runID)
+	u.RawQuery = query.Encode()
+
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.String(), strings.NewReader(body))
+	if err != nil {
+		slog.ErrorContext(ctx, "Error pinging heartbeat URL", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error pinging heartbeat URL", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.ErrorContext(ctx, "Error pinging heartbeat URL", "err", fmt.Errorf("unexpected response status %q", resp.Status))
+	}
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Run as recorded in the history file, one JSON document per line
+type historyRun struct {
+	RunID      string            `json:"run_id"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Instances  []historyInstance `json:"instances"`
+}
+
+// Outcome of an instance in a recorded run, along with the snapshots created and deleted for it
+type historyInstance struct {
+	Account      string          `json:"account,omitempty"`
+	InstanceID   v3.UUID         `json:"instance_id,omitempty"`
+	Created      int             `json:"created"`
+	Deleted      int             `json:"deleted"`
+	DeleteErrors int             `json:"delete_errors"`
+	Error        string          `json:"error,omitempty"`
+	Actions      []plannedAction `json:"actions,omitempty"` // Only creations and deletions
+}
+
+// Event of the run history as shown by the history command
+type historyEntry struct {
+	RunID      string    `json:"run_id" yaml:"run_id"`
+	Time       time.Time `json:"time" yaml:"time"`
+	Account    string    `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID v3.UUID   `json:"instance_id,omitempty" yaml:"instance_id,omitempty"`
+	SnapshotID v3.UUID   `json:"snapshot_id,omitempty" yaml:"snapshot_id,omitempty"`
+	Action     string    `json:"action" yaml:"action"` // create, delete or error
+	Reason     string    `json:"reason" yaml:"reason"`
+}
+
+// Get the history file path, prefer the configured one, fallback to a file next to the state file
+func getHistoryPath(path, statePath string) string {
+	if path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(statePath), "history.jsonl")
+}
+
+// Append a run to the history file
+func appendHistory(path string, report runReport) error {
+	run := historyRun{RunID: report.RunID, StartedAt: report.StartedAt, FinishedAt: report.FinishedAt, Instances: []historyInstance{}}
+	for _, result := range report.Results {
+		instance := historyInstance{
+			Account:      result.Account,
+			InstanceID:   result.InstanceID,
+			Created:      result.Created,
+			Deleted:      result.Deleted,
+			DeleteErrors: result.DeleteErrors,
+		}
+		if result.Err != nil {
+			instance.Error = result.Err.Error()
+		}
+		for _, action := range result.Actions {
+			if action.Action != "keep" {
+				instance.Actions = append(instance.Actions, action)
+			}
+		}
+		run.Instances = append(run.Instances, instance)
+	}
+
+	data, err := json.Marshal(run)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return fmt.Errorf("unable to create history directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("unable to open history file: %w", err)
+	}
+	defer f.Close()
+
+	if _, err := f.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("unable to write history file: %w", err)
+	}
+	return f.Close()
+}
+
+// Read the events of the history file, optionally only the ones of an instance and/or a snapshot
+func readHistory(path string, instanceID, snapshotID v3.UUID) ([]historyEntry, error) {
+	entries := []historyEntry{}
+
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return entries, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read history file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	for {
+		var run historyRun
+		if err := decoder.Decode(&run); errors.Is(err, io.EOF) {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("unable to parse history file %s: %w", path, err)
+		}
+
+		for _, instance := range run.Instances {
+			if instanceID != "" && instance.InstanceID != instanceID {
+				continue
+			}
+
+			for _, action := range instance.Actions {
+				if snapshotID != "" && action.SnapshotID != snapshotID {
+					continue
+				}
+				at := run.StartedAt
+				if action.Action == "create" {
+					at = action.CreatedAt
+				}
+				entries = append(entries, historyEntry{
+					RunID:      run.RunID,
+					Time:       at,
+					Account:    instance.Account,
+					InstanceID: instance.InstanceID,
+					SnapshotID: action.SnapshotID,
+					Action:     action.Action,
+					Reason:     action.Reason,
+				})
+			}
+
+			if instance.Error != "" && snapshotID == "" {
+				entries = append(entries, historyEntry{
+					RunID:      run.RunID,
+					Time:       run.FinishedAt,
+					Account:    instance.Account,
+					InstanceID: instance.InstanceID,
+					Action:     "error",
+					Reason:     instance.Error,
+				})
+			}
+		}
+	}
+}
+
+// Show the run history, filtered by the --instance and --snapshot flags
+func showHistory(cfg config, w io.Writer) error {
+	var instanceID, snapshotID v3.UUID
+	var err error
+	if len(cfg.InstanceIDs) > 1 {
+		return errors.New("the history command takes at most one instance")
+	}
+	if len(cfg.InstanceIDs) == 1 {
+		if instanceID, err = v3.ParseUUID(cfg.InstanceIDs[0]); err != nil {
+			return fmt.Errorf("invalid instance ID %q: %w", cfg.InstanceIDs[0], err)
+		}
+	}
+	if cfg.SnapshotID != "" {
+		if snapshotID, err = v3.ParseUUID(cfg.SnapshotID); err != nil {
+			return fmt.Errorf("invalid snapshot ID %q: %w", cfg.SnapshotID, err)
+		}
+	}
+
+	entries, err := readHistory(cfg.HistoryFile, instanceID, snapshotID)
+	if err != nil {
+		return err
+	}
+	return writeHistory(w, entries, cfg.Output)
+}
+
+// Write history events in the requested output format
+func writeHistory(w io.Writer, entries []historyEntry, format string) error {
+	return writeFormatted(w, entries, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(tw, "TIME\tRUN\tINSTANCE\tSNAPSHOT\tACTION\tREASON")
+		for _, e := range entries {
+			instance, snapshot := string(e.InstanceID), string(e.SnapshotID)
+			if instance == "" {
+				instance = "-"
+			}
+			if snapshot == "" {
+				snapshot = "-"
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", e.Time.Format(time.RFC3339), e.RunID, instance, snapshot, e.Action, e.Reason)
+		}
+	})
+}
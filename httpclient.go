@@ -0,0 +1,48 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+)
+
+// Settings of the HTTP client of all the outgoing requests: API, object storage, notifications and heartbeats.
+// Proxies are configured with the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment variables.
+type HTTPConfig struct {
+	CABundle           string `yaml:"ca_bundle"`            // PEM file of certificate authorities trusted in addition to the system ones
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"` // Don't verify TLS certificates, only meant for troubleshooting
+}
+
+// Set up the HTTP transport shared by all the HTTP clients
+func setupHTTP(cfg HTTPConfig) error {
+	if cfg.CABundle == "" && !cfg.InsecureSkipVerify {
+		return nil
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CABundle != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return fmt.Errorf("no certificate found in CA bundle %s", cfg.CABundle)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if cfg.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is DISABLED by http.insecure_skip_verify, API credentials and data are exposed to anyone intercepting the connections")
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	http.DefaultTransport = transport
+	return nil
+}
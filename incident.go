@@ -0,0 +1,162 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Settings shared by the incident backends, which page about failed instances rather than report on every run
+type IncidentOptions struct {
+	AutoResolve bool `yaml:"auto_resolve"` // Resolve the incident of an instance once it's processed successfully
+}
+
+// Dry runs never page. Runs without failures are only of interest to resolve incidents.
+func (o IncidentOptions) wants(report runReport) bool {
+	return !report.DryRun && (o.AutoResolve || report.hasFailures())
+}
+
+// Check whether the outcome of an instance calls for an incident, and how serious it is
+func incidentSeverity(result instanceResult) (severity string, failed bool) {
+	switch {
+	case result.Err != nil, result.DeleteErrors > 0:
+		return "error", true
+	case result.Stale != "":
+		return "warning", true
+	default:
+		return "", false
+	}
+}
+
+// Key identifying the incidents of an instance, so that every run failing for it updates the same one
+func incidentKey(result instanceResult) string {
+	return "snap-o-matic/" + result.label()
+}
+
+// Describe the problem of an instance in the title of its incident
+func incidentSummary(result instanceResult) string {
+	var problems []string
+	if result.Err != nil {
+		problems = append(problems, result.Err.Error())
+	}
+	if result.DeleteErrors > 0 {
+		problems = append(problems, fmt.Sprintf("%d snapshot(s) could not be deleted", result.DeleteErrors))
+	}
+	if result.Stale != "" {
+		problems = append(problems, result.Stale)
+	}
+	return fmt.Sprintf("snap-o-matic: backup of %s failed: %s", result.label(), strings.Join(problems, ", "))
+}
+
+// PagerDuty service, through the Events API v2
+type PagerDutyConfig struct {
+	IncidentOptions `yaml:",inline"`
+	RoutingKey      string `yaml:"routing_key"` // Integration key of the service
+	URL             string `yaml:"url"`         // Events API endpoint, defaults to https://events.pagerduty.com/v2/enqueue
+}
+
+func (c PagerDutyConfig) notify(ctx context.Context, report runReport) error {
+	source, _ := os.Hostname()
+	var errs []error
+	for _, result := range report.Results {
+		severity, failed := incidentSeverity(result)
+		event := map[string]any{"routing_key": c.RoutingKey, "dedup_key": incidentKey(result)}
+		switch {
+		case failed:
+			event["event_action"] = "trigger"
+			event["payload"] = map[string]any{
+				"summary":   truncate(incidentSummary(result), 1024), // Longer summaries are truncated by PagerDuty anyway
+				"source":    cmp.Or(source, "snap-o-matic"),
+				"severity":  severity,
+				"component": result.label(),
+				"custom_details": map[string]any{
+					"run_id":  report.RunID,
+					"summary": report.summary(),
+				},
+			}
+		case c.AutoResolve:
+			event["event_action"] = "resolve"
+		default:
+			continue
+		}
+		if err := postJSON(ctx, cmp.Or(c.URL, "https://events.pagerduty.com/v2/enqueue"), event); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.label(), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("pagerduty: %w", err)
+	}
+	return nil
+}
+
+// Opsgenie team, through the Alert API
+type OpsgenieConfig struct {
+	IncidentOptions `yaml:",inline"`
+	APIKey          string `yaml:"api_key"` // Key of an API integration
+	URL             string `yaml:"url"`     // API endpoint, defaults to https://api.opsgenie.com, https://api.eu.opsgenie.com in the EU
+}
+
+func (c OpsgenieConfig) notify(ctx context.Context, report runReport) error {
+	base := strings.TrimSuffix(cmp.Or(c.URL, "https://api.opsgenie.com"), "/") + "/v2/alerts"
+	header := http.Header{}
+	header.Set("Authorization", "GenieKey "+c.APIKey)
+
+	source, _ := os.Hostname()
+	var errs []error
+	for _, result := range report.Results {
+		severity, failed := incidentSeverity(result)
+		var u string
+		var payload map[string]any
+		switch {
+		case failed:
+			priority := "P2"
+			if severity == "warning" {
+				priority = "P3"
+			}
+			u = base
+			payload = map[string]any{
+				"message":     truncate(incidentSummary(result), 130), // Longer messages are rejected
+				"alias":       incidentKey(result),
+				"description": report.summary(),
+				"priority":    priority,
+				"source":      cmp.Or(source, "snap-o-matic"),
+				"tags":        []string{"snap-o-matic"},
+				"details":     map[string]string{"run_id": report.RunID, "instance": result.label()},
+			}
+		case c.AutoResolve:
+			u = base + "/" + url.PathEscape(incidentKey(result)) + "/close?identifierType=alias"
+			payload = map[string]any{"source": cmp.Or(source, "snap-o-matic"), "note": "Backed up by run " + report.RunID}
+		default:
+			continue
+		}
+		body, err := json.Marshal(payload)
+		if err == nil {
+			err = post(ctx, u, body, header)
+		}
+		var statusErr *httpStatusError
+		if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotFound && !failed {
+			err = nil // No alert to close
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", result.label(), err))
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return fmt.Errorf("opsgenie: %w", err)
+	}
+	return nil
+}
+
+// Shorten s to at most n runes
+func truncate(s string, n int) string {
+	if runes := []rune(s); len(runes) > n {
+		return string(runes[:n-1]) + "…"
+	}
+	return s
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Retention policy of the configurations written by the init command
+const starterRetention = `defaults:
+  snapshots:
+    daily: 7    # Keep up to 7 daily snapshots
+    weekly: 4   # Keep up to 4 weekly snapshots
+    monthly: 6  # Keep up to 6 monthly snapshots
+`
+
+// Instance of the account found by the init command
+type discoveredInstance struct {
+	ID   v3.UUID
+	Name string
+	Zone string // Empty for the zone of the API endpoint
+}
+
+// List the instances of all the zones of the account, sorted by zone and name
+func accountInstances(ctx context.Context, client *v3.Client, apiEndpoint v3.Endpoint) ([]discoveredInstance, error) {
+	zones, err := client.ListZones(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list zones: %w", err)
+	}
+
+	instances := []discoveredInstance{}
+	for _, zone := range zones.Zones {
+		resp, err := client.WithEndpoint(zone.APIEndpoint).ListInstances(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("zone %s: unable to list instances: %w", zone.Name, err)
+		}
+		for _, instance := range resp.Instances {
+			discovered := discoveredInstance{ID: instance.ID, Name: instance.Name}
+			if zone.APIEndpoint != apiEndpoint {
+				discovered.Zone = string(zone.Name)
+			}
+			instances = append(instances, discovered)
+		}
+	}
+
+	sort.SliceStable(instances, func(i, j int) bool {
+		if instances[i].Zone != instances[j].Zone {
+			return instances[i].Zone < instances[j].Zone
+		}
+		return instances[i].Name < instances[j].Name
+	})
+	return instances, nil
+}
+
+// Write a starter configuration listing the given instances, with their names as comments
+func writeStarterConfig(w io.Writer, instances []discoveredInstance, now time.Time) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Generated by snap-o-matic init on %s, review the retention policy and remove the instances\n", now.Format(time.DateOnly))
+	b.WriteString("# which don't need snapshots\n")
+	fmt.Fprintf(&b, "version: %d\n", configVersion)
+	b.WriteString(starterRetention)
+	b.WriteString("\ninstances:")
+	if len(instances) == 0 {
+		b.WriteString(" []")
+	}
+	b.WriteString("\n")
+	for _, instance := range instances {
+		fmt.Fprintf(&b, "  - id: %s", instance.ID)
+		if instance.Name != "" {
+			fmt.Fprintf(&b, "  # %s", instance.Name)
+		}
+		b.WriteString("\n")
+		if instance.Zone != "" {
+			fmt.Fprintf(&b, "    zone: %s\n", instance.Zone)
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// Write a starter configuration with the instances of the account to the given file, or stdout if none is set. An
+// existing file is never overwritten.
+func initConfig(ctx context.Context, client *v3.Client, apiEndpoint v3.Endpoint, path string) error {
+	instances, err := accountInstances(ctx, client, apiEndpoint)
+	if err != nil {
+		return err
+	}
+
+	if path == "" {
+		return writeStarterConfig(os.Stdout, instances, time.Now())
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, not overwriting it", path)
+	} else if err != nil {
+		return err
+	}
+	if err := writeStarterConfig(f, instances, time.Now()); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	_, _ = fmt.Fprintf(os.Stderr, "Wrote %s with %d instance(s)\n", path, len(instances))
+	return nil
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Label excluding an instance from discovery when none is configured
+const defaultExcludeLabel = "snap-o-matic-exclude"
+
+// Automatic selection of all instances in the account
+type DiscoveryConfig struct {
+	Enabled      bool              `yaml:"enabled"`
+	Exclude      []v3.UUID         `yaml:"exclude"`       // Instances never selected by discovery
+	ExcludeLabel string            `yaml:"exclude_label"` // Instances carrying this label are never selected by discovery
+	Zones        []string          `yaml:"zones"`         // Zones to discover instances in, defaults to the zone of the API endpoint
+	Schedule     string            `yaml:"schedule"`
+	MinInterval  duration          `yaml:"min_interval"`
+	MaxDeletions int               `yaml:"max_deletions_per_run"`
+	MaxAge       duration          `yaml:"max_snapshot_age"`
+	WhenStopped  string            `yaml:"when_stopped"`
+	Policy       string            `yaml:"policy"`    // Named retention policy applied to discovered instances
+	Snapshots    SnapshotRetention `yaml:"snapshots"` // Retention policy applied to discovered instances
+}
+
+// Get the list of instances to process. Instances configured by ID take precedence over the ones matched by a
+// selector or name, which take precedence over discovered instances.
+func resolveInstances(ctx context.Context, client *v3.Client, cfg config) ([]InstanceConfig, error) {
+	instances := []InstanceConfig{}
+	selected := make(map[v3.UUID]struct{})
+
+	// The account instances of a zone are only listed if needed, and at most once
+	available := make(map[v3.Endpoint][]v3.ListInstancesResponseInstances)
+	listAvailable := func(endpoint v3.Endpoint) ([]v3.ListInstancesResponseInstances, error) {
+		if _, ok := available[endpoint]; !ok {
+			resp, err := client.WithEndpoint(endpoint).ListInstances(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to list instances: %w", err)
+			}
+			available[endpoint] = resp.Instances
+		}
+		return available[endpoint], nil
+	}
+
+	for _, instance := range cfg.Instances {
+		if err := validateInstanceSelection(instance); err != nil {
+			return nil, err
+		}
+		if instance.ID == "" {
+			continue
+		}
+
+		instances = append(instances, instance)
+		selected[instance.ID] = struct{}{}
+	}
+
+	for _, instance := range cfg.Instances {
+		if instance.ID != "" {
+			continue
+		}
+
+		matches, err := instanceMatcher(instance)
+		if err != nil {
+			return nil, err
+		}
+
+		candidates, err := listAvailable(instance.apiEndpoint(cfg.APIEndpoint))
+		if err != nil {
+			return nil, err
+		}
+
+		matched := []v3.ListInstancesResponseInstances{}
+		for _, candidate := range candidates {
+			if matches(candidate) {
+				matched = append(matched, candidate)
+			}
+		}
+
+		// A plain name must designate exactly one instance, patterns may match any number of them
+		if instance.Name != "" && !isNamePattern(instance.Name) && len(matched) != 1 {
+			if len(matched) == 0 {
+				return nil, fmt.Errorf("no instance named %q found", instance.Name)
+			}
+			return nil, fmt.Errorf("instance name %q is ambiguous (%d instances found), use its ID instead", instance.Name, len(matched))
+		}
+		if len(matched) == 0 && instance.Selector == nil {
+			slog.WarnContext(ctx, "No instance matches the configured name pattern", "name", instance.Name, "name_regex", instance.NameRegex)
+		}
+
+		for _, candidate := range matched {
+			if _, ok := selected[candidate.ID]; ok {
+				continue
+			}
+
+			slog.DebugContext(ctx, "Selected instance", "instance_id", candidate.ID, "name", candidate.Name)
+			match := instance
+			match.ID = candidate.ID
+			instances = append(instances, match)
+			selected[candidate.ID] = struct{}{}
+		}
+	}
+
+	if !cfg.Discover.Enabled {
+		return labelledInstances(ctx, cfg, instances, listAvailable)
+	}
+
+	for _, id := range cfg.Discover.Exclude {
+		selected[id] = struct{}{}
+	}
+
+	excludeLabel := cfg.Discover.ExcludeLabel
+	if excludeLabel == "" {
+		excludeLabel = defaultExcludeLabel
+	}
+
+	zones := cfg.Discover.Zones
+	if len(zones) == 0 {
+		zones = []string{""} // Zone of the API endpoint
+	}
+
+	for _, zone := range zones {
+		discovered := InstanceConfig{
+			Zone:         zone,
+			Schedule:     cfg.Discover.Schedule,
+			MinInterval:  cfg.Discover.MinInterval,
+			MaxDeletions: cfg.Discover.MaxDeletions,
+			MaxAge:       cfg.Discover.MaxAge,
+			WhenStopped:  cfg.Discover.WhenStopped,
+			Snapshots:    cfg.Discover.Snapshots,
+		}
+
+		candidates, err := listAvailable(discovered.apiEndpoint(cfg.APIEndpoint))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, candidate := range candidates {
+			if _, skip := selected[candidate.ID]; skip {
+				continue
+			}
+			if _, excluded := candidate.Labels[excludeLabel]; excluded {
+				slog.DebugContext(ctx, "Skipping instance carrying the exclude label", "instance_id", candidate.ID, "label", excludeLabel)
+				continue
+			}
+
+			slog.DebugContext(ctx, "Discovered instance", "instance_id", candidate.ID, "name", candidate.Name, "zone", zone)
+			discovered.ID = candidate.ID
+			instances = append(instances, discovered)
+			selected[candidate.ID] = struct{}{}
+		}
+	}
+
+	return labelledInstances(ctx, cfg, instances, listAvailable)
+}
+
+// Apply the labels of the resolved instances: the retention policy named by the policy label, and never_touch
+func labelledInstances(ctx context.Context, cfg config, instances []InstanceConfig, listAvailable func(v3.Endpoint) ([]v3.ListInstancesResponseInstances, error)) ([]InstanceConfig, error) {
+	if cfg.PolicyLabel != "" {
+		for i, instance := range instances {
+			if instance.retentionSet {
+				continue
+			}
+			candidates, err := listAvailable(instance.apiEndpoint(cfg.APIEndpoint))
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range candidates {
+				name, ok := candidate.Labels[cfg.PolicyLabel]
+				if candidate.ID != instance.ID || !ok {
+					continue
+				}
+				policy, ok := cfg.Policies[name]
+				if !ok {
+					return nil, fmt.Errorf("instance %s: label %s=%s refers to an unknown policy", instance.ID, cfg.PolicyLabel, name)
+				}
+				slog.DebugContext(ctx, "Applying the retention policy of the instance label", "instance_id", instance.ID, "policy", name)
+				instances[i].Policy, instances[i].Snapshots = name, policy
+			}
+		}
+	}
+
+	return skipNeverTouched(ctx, cfg, instances, listAvailable)
+}
+
+// Select the instances of an ad-hoc run among the resolved ones: the ones designated by include if any, except the ones
+// designated by exclude. Instances are designated by ID, or by name or name pattern.
+func selectInstances(ctx context.Context, clients accountClients, cfg config, include, exclude []string) ([]InstanceConfig, error) {
+	isName := func(s string) bool {
+		_, err := v3.ParseUUID(s)
+		return err != nil
+	}
+
+	// Names are only listed if needed, once per account and zone
+	names := make(map[v3.UUID]string)
+	if slices.ContainsFunc(include, isName) || slices.ContainsFunc(exclude, isName) {
+		listed := make(map[snapshotIndexKey]bool)
+		for _, instance := range cfg.Instances {
+			key := snapshotIndexKey{instance.Account, instance.apiEndpoint(cfg.APIEndpoint)}
+			if listed[key] {
+				continue
+			}
+			client, err := clients.get(key.account)
+			if err != nil {
+				return nil, err
+			}
+			resp, err := client.WithEndpoint(key.endpoint).ListInstances(ctx)
+			if err != nil {
+				return nil, fmt.Errorf("unable to list instances: %w", err)
+			}
+			for _, candidate := range resp.Instances {
+				names[candidate.ID] = candidate.Name
+			}
+			listed[key] = true
+		}
+	}
+
+	for _, s := range slices.Concat(include, exclude) {
+		if _, err := path.Match(s, ""); isName(s) && err != nil {
+			return nil, fmt.Errorf("invalid instance name pattern %q: %w", s, err)
+		}
+	}
+	designates := func(instance InstanceConfig, s string) bool {
+		if !isName(s) {
+			return instance.ID.String() == strings.ToLower(s)
+		}
+		matched, _ := path.Match(s, names[instance.ID])
+		return matched
+	}
+
+	selected := []InstanceConfig{}
+	matched := make([]bool, len(include))
+	for _, instance := range cfg.Instances {
+		included := len(include) == 0
+		for i, s := range include {
+			if designates(instance, s) {
+				included, matched[i] = true, true
+			}
+		}
+		if included && !slices.ContainsFunc(exclude, func(s string) bool { return designates(instance, s) }) {
+			selected = append(selected, instance)
+		}
+	}
+	for i, s := range include {
+		if !matched[i] {
+			return nil, fmt.Errorf("--instance %q matches no configured instance", s)
+		}
+	}
+	return selected, nil
+}
+
+// What is done with stopped instances
+const (
+	whenStoppedSnapshot = "snapshot" // Processed like running ones, the default
+	whenStoppedSkip     = "skip"     // Not processed at all
+	whenStoppedError    = "error"    // Processing fails
+)
+
+// Get what is done with an instance when it's stopped, the setting of the instance or the global one
+func (i InstanceConfig) whenStopped(cfg config) (string, error) {
+	whenStopped := cmp.Or(i.WhenStopped, cfg.WhenStopped, whenStoppedSnapshot)
+	switch whenStopped {
+	case whenStoppedSnapshot, whenStoppedSkip, whenStoppedError:
+		return whenStopped, nil
+	default:
+		return "", fmt.Errorf("invalid when_stopped %q (expected skip, snapshot or error)", whenStopped)
+	}
+}
+
+// Check whether an instance is paused with enabled: false
+func (i InstanceConfig) disabled() bool {
+	return i.Enabled != nil && !*i.Enabled
+}
+
+// Check that an instance entry selects instances in exactly one way
+func validateInstanceSelection(instance InstanceConfig) error {
+	set := 0
+	for _, isSet := range []bool{instance.ID != "", instance.Selector != nil, instance.Name != "", instance.NameRegex != ""} {
+		if isSet {
+			set++
+		}
+	}
+
+	if set != 1 {
+		return errors.New("instance entries must define exactly one of id, selector, name or name_regex")
+	}
+	if instance.Zone != "" && instance.Endpoint != "" {
+		return errors.New("instance entries must not define both zone and endpoint")
+	}
+
+	return nil
+}
+
+// Build the function matching account instances against the selector, name or name pattern of an instance entry
+func instanceMatcher(instance InstanceConfig) (func(v3.ListInstancesResponseInstances) bool, error) {
+	switch {
+	case instance.Selector != nil:
+		return func(candidate v3.ListInstancesResponseInstances) bool {
+			return matchesLabels(candidate.Labels, instance.Selector)
+		}, nil
+
+	case instance.Name != "":
+		if _, err := path.Match(instance.Name, ""); err != nil {
+			return nil, fmt.Errorf("invalid instance name pattern %q: %w", instance.Name, err)
+		}
+		return func(candidate v3.ListInstancesResponseInstances) bool {
+			matched, _ := path.Match(instance.Name, candidate.Name)
+			return matched
+		}, nil
+
+	default:
+		re, err := regexp.Compile(instance.NameRegex)
+		if err != nil {
+			return nil, fmt.Errorf("invalid instance name regex %q: %w", instance.NameRegex, err)
+		}
+		return func(candidate v3.ListInstancesResponseInstances) bool {
+			return re.MatchString(candidate.Name)
+		}, nil
+	}
+}
+
+// Check whether an instance name contains glob wildcards
+func isNamePattern(name string) bool {
+	return strings.ContainsAny(name, "*?[\\")
+}
+
+// Check whether an instance carries all the labels of a selector
+func matchesLabels(labels v3.Labels, selector map[string]string) bool {
+	for k, v := range selector {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
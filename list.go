@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Snapshot as shown by the list command
+type snapshotListing struct {
+	Account    string           `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID v3.UUID          `json:"instance_id" yaml:"instance_id"`
+	ID         v3.UUID          `json:"id" yaml:"id"`
+	CreatedAt  time.Time        `json:"created_at" yaml:"created_at"`
+	State      v3.SnapshotState `json:"state" yaml:"state"`
+	Managed    bool             `json:"managed" yaml:"managed"`
+	Protected  bool             `json:"protected" yaml:"protected"`
+	Bucket     string           `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Action     string           `json:"action" yaml:"action"` // keep, prune, pending, protected or ignore
+}
+
+// List the snapshots of all configured instances, along with the outcome of their retention policy
+func listSnapshots(ctx context.Context, clients accountClients, state *stateStore, cfg config, w io.Writer) error {
+	listings := []snapshotListing{}
+	indexes := newSnapshotIndexes(clients)
+
+	for _, instance := range cfg.Instances {
+		index, err := indexes.get(instance.Account, instance.apiEndpoint(cfg.APIEndpoint))
+		if err != nil {
+			return err
+		}
+		snapshots, err := index.get(ctx, instance.ID)
+		if err != nil {
+			return err
+		}
+
+		now := retentionClock.Now()
+		candidates := retentionCandidates(snapshots, state, cfg.UnsafeDeleteAll)
+		retainedSnapshots := categorizeSnapshots(ctx, candidates, instance.Snapshots)
+
+		for _, snapshot := range snapshots {
+			listing := snapshotListing{
+				Account:    instance.Account,
+				InstanceID: instance.ID,
+				ID:         snapshot.ID,
+				CreatedAt:  snapshot.CreatedAT,
+				State:      snapshot.State,
+				Managed:    state.isManaged(snapshot.ID),
+				Protected:  state.isProtected(snapshot.ID),
+			}
+
+			bucket, retained := retainedSnapshots[snapshot.ID.String()]
+			switch {
+			case listing.Protected:
+				listing.Action = "protected"
+			case !listing.Managed && !cfg.UnsafeDeleteAll, snapshot.CreatedAT.After(now):
+				listing.Action = "ignore"
+			case snapshot.State == v3.SnapshotStateError && cfg.DeleteErrored:
+				listing.Action = "prune"
+			case !snapshotUsable(snapshot):
+				listing.Action = "ignore"
+			case retained:
+				listing.Bucket = bucket
+				listing.Action = "keep"
+			default:
+				listing.Action = "prune"
+				if due, _ := deletionDue(state, snapshot.ID, time.Duration(cfg.DeletionGrace), now); !due {
+					listing.Action = "pending"
+				}
+			}
+
+			listings = append(listings, listing)
+		}
+	}
+
+	return writeListings(w, listings, cfg.Output)
+}
+
+// Write snapshot listings in the requested output format
+func writeListings(w io.Writer, listings []snapshotListing, format string) error {
+	return writeFormatted(w, listings, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(tw, "INSTANCE\tSNAPSHOT\tCREATED\tSTATE\tMANAGED\tPROTECTED\tBUCKET\tACTION")
+		for _, l := range listings {
+			bucket := l.Bucket
+			if bucket == "" {
+				bucket = "-"
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%t\t%t\t%s\t%s\n",
+				l.InstanceID, l.ID, l.CreatedAt.Format(time.RFC3339), l.State, l.Managed, l.Protected, bucket, l.Action)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Holder of a lock file
+type lockInfo struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// Error returned when another run holds the lock
+type lockedError struct {
+	path   string
+	holder lockInfo // Zero if the holder hasn't written it yet
+}
+
+func (e *lockedError) Error() string {
+	if e.holder.PID == 0 {
+		return fmt.Sprintf("another run is active, lock file: %s", e.path)
+	}
+	return fmt.Sprintf("another run is active (pid %d on %s since %s), lock file: %s",
+		e.holder.PID, e.holder.Hostname, e.holder.StartedAt.Format(time.RFC3339), e.path)
+}
+
+// Returned by lockFileHandle if another process holds the lock
+var errLockHeld = errors.New("lock held by another process")
+
+// Lock file preventing concurrent runs, locked with an advisory lock of the OS held as long as the file is open
+type lockFile struct {
+	path string
+	file *os.File
+}
+
+// Held by the run, released by exitWith as os.Exit doesn't run deferred functions
+var lock *lockFile
+
+// Get the lock file path, prefer the configured one, fallback to the state file directory
+func getLockPath(path, statePath string) string {
+	if path != "" {
+		return path
+	}
+	return filepath.Join(filepath.Dir(statePath), "snap-o-matic.lock")
+}
+
+// Acquire the lock file. The file is never removed, so that runs can't take over a lock another one just acquired,
+// and the OS releases the lock of runs which are gone (e.g. killed). Its content only tells who holds it.
+func acquireLock(path string) (*lockFile, error) {
+	hostname, _ := os.Hostname()
+	info, err := json.Marshal(lockInfo{PID: os.Getpid(), Hostname: hostname, StartedAt: time.Now()})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return nil, fmt.Errorf("unable to create lock directory: %w", err)
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open lock file: %w", err)
+	}
+
+	if err := lockFileHandle(f); err != nil {
+		defer f.Close()
+		if errors.Is(err, errLockHeld) {
+			var holder lockInfo
+			if data, err := io.ReadAll(f); err == nil {
+				_ = json.Unmarshal(data, &holder) // Empty until the holder writes it, which doesn't make it any less held
+			}
+			return nil, &lockedError{path: path, holder: holder}
+		}
+		return nil, fmt.Errorf("unable to lock lock file: %w", err)
+	}
+
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt(info, 0)
+	}
+	if err != nil {
+		_ = f.Close()
+		return nil, fmt.Errorf("unable to write lock file: %w", err)
+	}
+	return &lockFile{path: path, file: f}, nil
+}
+
+// Release the lock file, if held. Releasing it again does nothing.
+func (l *lockFile) release() {
+	if l == nil || l.file == nil {
+		return
+	}
+	_ = l.file.Truncate(0)
+	_ = l.file.Close() // Closing the file releases the lock
+	l.file = nil
+}
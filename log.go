@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"sync/atomic"
+
+	"github.com/google/uuid"
+)
+
+// Run ID generated at startup, carried by the logs outside of runs and used by the first run of the process, so that
+// a one-shot invocation can be correlated across systems with a single ID
+var processRunID = uuid.NewString()
+
+var processRunIDUsed atomic.Bool
+
+// Get the ID of a new run, the one of the process for its first run and a new one for each later run in daemon mode
+func newRunID() string {
+	if processRunIDUsed.CompareAndSwap(false, true) {
+		return processRunID
+	}
+	return uuid.NewString()
+}
+
+// Get the ID of the run ctx belongs to, the one of the process outside of runs
+func runID(ctx context.Context) string {
+	if id := logAttr(ctx, "run_id"); id != "" {
+		return id
+	}
+	return processRunID
+}
+
+type logAttrsKey struct{}
+
+// Return a copy of ctx carrying additional attributes added to every record logged with it
+func withLogAttrs(ctx context.Context, args ...any) context.Context {
+	record := slog.Record{}
+	record.Add(args...)
+
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	attrs = slices.Clip(attrs) // Never share the backing array with the parent context
+	record.Attrs(func(attr slog.Attr) bool {
+		attrs = append(attrs, attr)
+		return true
+	})
+
+	return context.WithValue(ctx, logAttrsKey{}, attrs)
+}
+
+// Handler adding the attributes stored in the context to each record, and the run ID of the process to the records
+// logged outside of runs
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if logAttr(ctx, "run_id") == "" {
+		r.AddAttrs(slog.String("run_id", processRunID))
+	}
+	if attrs, ok := ctx.Value(logAttrsKey{}).([]slog.Attr); ok {
+		r.AddAttrs(attrs...)
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
+
+// Install the default logger according to the configured level, format and output. Logs go to w unless they go to
+// syslog, which timestamps them already. Text logs written to a terminal are shortened and colored for humans, and the
+// progress of the run is shown along with them.
+func setupLogging(w io.Writer, cfg config) error {
+	var opts slog.HandlerOptions
+
+	level := cfg.LogLevel
+	if cfg.Quiet {
+		level = "error"
+	}
+	switch level {
+	case "debug":
+		opts.Level = slog.LevelDebug
+	case "warn":
+		opts.Level = slog.LevelWarn
+	case "error":
+		opts.Level = slog.LevelError
+	default:
+		opts.Level = slog.LevelInfo
+	}
+
+	var newHandler func(w io.Writer) slog.Handler
+	switch cfg.LogFormat {
+	case "json":
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewJSONHandler(w, &opts) }
+	case "text", "":
+		newHandler = func(w io.Writer) slog.Handler { return slog.NewTextHandler(w, &opts) }
+	default:
+		return fmt.Errorf("unsupported log format %q (expected text or json)", cfg.LogFormat)
+	}
+
+	var handler slog.Handler
+	switch cfg.LogOutput {
+	case "stderr", "":
+		if cfg.LogFormat != "json" && isTerminal(w) {
+			c := &console{w: w, color: colorEnabled(cfg.NoColor)}
+			handler = consoleHandler{console: c, level: opts.Level}
+			if !cfg.Quiet {
+				interactive = c
+			}
+			break
+		}
+		handler = newHandler(w)
+	case "syslog":
+		opts.ReplaceAttr = func(groups []string, attr slog.Attr) slog.Attr {
+			if len(groups) == 0 && attr.Key == slog.TimeKey {
+				return slog.Attr{}
+			}
+			return attr
+		}
+		var err error
+		if handler, err = newSyslogHandler(cfg.SyslogFacility, cfg.SyslogTag, newHandler); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported log output %q (expected stderr or syslog)", cfg.LogOutput)
+	}
+
+	slog.SetDefault(slog.New(contextHandler{handler}))
+
+	return nil
+}
+
+// Adapter routing the cron scheduler logs through slog
+type cronLogger struct{}
+
+func (cronLogger) Info(msg string, keysAndValues ...any) {
+	slog.Debug(msg, keysAndValues...)
+}
+
+func (cronLogger) Error(err error, msg string, keysAndValues ...any) {
+	slog.Error(msg, append(keysAndValues, "err", err)...)
+}
+
+// Get the value of an attribute stored in the context, empty if missing
+func logAttr(ctx context.Context, key string) string {
+	attrs, _ := ctx.Value(logAttrsKey{}).([]slog.Attr)
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if attrs[i].Key == key {
+			return attrs[i].Value.String()
+		}
+	}
+	return ""
+}
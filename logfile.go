@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Suffix of the rotated log files, appended to the name of the log file
+const logFileTimeFormat = "20060102-150405"
+
+// Log file rotated once it gets larger than maxSize or older than maxAge, keeping maxFiles rotated files
+type rotatingFile struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64         // Bytes, 0 for no limit
+	maxAge   time.Duration // 0 for no limit
+	maxFiles int           // Rotated files kept, 0 to keep them all
+
+	file    *os.File
+	size    int64
+	created time.Time
+}
+
+// Get the writer logs go to, the log file given with --log-file or stderr
+func logWriter(cfg config) (io.Writer, error) {
+	if cfg.LogFile == "" {
+		return os.Stderr, nil
+	}
+	if cfg.LogOutput == "syslog" {
+		return nil, errors.New("--log-file and --log-output syslog are mutually exclusive")
+	}
+	if cfg.LogMaxSize < 0 || cfg.LogMaxFiles < 0 {
+		return nil, errors.New("--log-max-size and --log-max-files must not be negative")
+	}
+	var maxAge time.Duration
+	if cfg.LogMaxAge != "" {
+		var err error
+		if maxAge, err = parseDuration(cfg.LogMaxAge); err != nil {
+			return nil, fmt.Errorf("invalid --log-max-age: %w", err)
+		}
+	}
+	return openRotatingFile(cfg.LogFile, int64(cfg.LogMaxSize)<<20, maxAge, cfg.LogMaxFiles)
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxFiles int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, maxAge: maxAge, maxFiles: maxFiles}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Open the log file for appending. The age of an existing file is the one of its first record.
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0o640)
+	if err != nil {
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return fmt.Errorf("unable to open log file: %w", err)
+	}
+	f.file, f.size, f.created = file, info.Size(), time.Now()
+	if t, ok := firstRecordTime(file); ok {
+		f.created = t
+	}
+	return nil
+}
+
+// Timestamp of the records, in both the text and JSON formats
+var recordTimeRegexp = regexp.MustCompile(`\d{4}-\d{2}-\d{2}T[0-9:.]+(Z|[+-]\d{2}:\d{2})`)
+
+// Get the time of the first record of a log file
+func firstRecordTime(r io.ReaderAt) (time.Time, bool) {
+	buf := make([]byte, 256)
+	n, _ := r.ReadAt(buf, 0)
+	line, _, _ := bytes.Cut(buf[:n], []byte("\n"))
+	t, err := time.Parse(time.RFC3339Nano, string(recordTimeRegexp.Find(line)))
+	return t, err == nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.size > 0 && (f.maxSize > 0 && f.size+int64(len(p)) > f.maxSize || f.maxAge > 0 && time.Since(f.created) >= f.maxAge) {
+		if err := f.rotate(); err != nil {
+			// Keep logging to the current file rather than losing the record
+			_, _ = fmt.Fprintf(os.Stderr, "unable to rotate log file: %v\n", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// Rename the log file with the current time as suffix, start a new one and delete the rotated files beyond maxFiles
+func (f *rotatingFile) rotate() error {
+	rotated := f.path + "." + time.Now().UTC().Format(logFileTimeFormat)
+	if _, err := os.Stat(rotated); err == nil {
+		return nil // Already rotated within the same second, the file grows a little larger instead
+	}
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	renameErr := os.Rename(f.path, rotated)
+	if err := f.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+
+	if f.maxFiles > 0 {
+		files := f.rotatedFiles()
+		for _, name := range files[:max(len(files)-f.maxFiles, 0)] {
+			if err := os.Remove(name); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Get the rotated log files, oldest first
+func (f *rotatingFile) rotatedFiles() []string {
+	matches, _ := filepath.Glob(f.path + ".*")
+	var files []string
+	for _, name := range matches {
+		if _, err := time.Parse(logFileTimeFormat, strings.TrimPrefix(name, f.path+".")); err == nil {
+			files = append(files, name)
+		}
+	}
+	slices.Sort(files) // The suffix sorts chronologically
+	return files
+}
@@ -2,14 +2,20 @@ package main
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"slices"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
+	_ "time/tzdata" // Embed the timezone database, it's not available on every system (e.g. Windows, Alpine)
 
 	v3 "github.com/exoscale/egoscale/v3"
 	"github.com/exoscale/egoscale/v3/credentials"
@@ -20,230 +26,1537 @@ import (
 
 const (
 	defaultEndpoint = v3.CHDk2
-	marginFactor    = 0.1 // 10% margin for timeframe flexibility
+	marginFactor    = 0.1 // 10% margin for timeframe flexibility, unless configured
+
+	defaultDeleteConcurrency = 4 // Deletions of an instance in flight at once, unless configured
+
+	// Exit codes
+	exitFatal          = 1 // Configuration, credentials or API error preventing the run
+	exitPartialFailure = 2 // Some instances could not be processed
+	exitLocked         = 3 // Another run holds the lock file
+	exitUsage          = 4 // Invalid command-line usage
+	exitStale          = 5 // The newest snapshot of some instances is older than their max_snapshot_age
 )
 
+// Locations searched for a configuration file when none is specified explicitly
+var defaultConfigPaths = []string{
+	"config.yaml",
+	"$XDG_CONFIG_HOME/snap-o-matic/config.yaml",
+	"$HOME/.config/snap-o-matic/config.yaml",
+	"/etc/snap-o-matic/config.yaml",
+}
+
 type config struct {
-	APIEndpoint     v3.Endpoint
-	DryRun          bool
-	Instances       []InstanceConfig // Multiple instances with retention policies
-	CredentialsFile string
-	LogLevel        string
+	Version          int `yaml:"version"` // Version of the configuration format, see configVersion
+	APIEndpoint      v3.Endpoint
+	DryRun           bool
+	Daemon           bool
+	UnsafeDeleteAll  bool
+	PruneOnly        bool                         `yaml:"-"`
+	SnapshotOnly     bool                         `yaml:"-"`
+	Concurrency      int                          `yaml:"concurrency"`
+	MaxDeletions     int                          `yaml:"max_deletions_per_run"`    // Cap on the snapshots deleted by a run, over all instances
+	DeletionGrace    duration                     `yaml:"deletion_grace_period"`    // Snapshots are pending deletion for this long before being deleted
+	PruneOnFailure   bool                         `yaml:"prune_on_create_failure"`  // Apply retention policies even if the new snapshot could not be created
+	InstanceTimeout  duration                     `yaml:"instance_timeout"`         // Maximum duration of the processing of an instance
+	WaitPoll         duration                     `yaml:"wait_poll_interval"`       // Interval at which operations are polled, defaults to 3s
+	WaitTimeout      duration                     `yaml:"wait_timeout"`             // Maximum time an operation is waited for
+	DeleteWorkers    int                          `yaml:"delete_concurrency"`       // Deletions of an instance in flight at once, defaults to 4
+	RateLimit        RateLimitConfig              `yaml:"rate_limit"`               // Limit of the rate of the API requests of each account
+	BreakerFailures  *int                         `yaml:"circuit_breaker_failures"` // Consecutive API failures aborting a run, defaults to 10, 0 for never
+	HTTP             HTTPConfig                   `yaml:"http"`
+	Tracing          TracingConfig                `yaml:"tracing"` // Export of traces of the runs over OTLP
+	ErrorTracking    ErrorTrackingConfig          `yaml:"error_tracking"`
+	Preflight        string                       `yaml:"preflight"`                // Check of the instances before a run: report, skip or abort
+	WhenStopped      string                       `yaml:"when_stopped"`             // What is done with stopped instances, unless they set it: snapshot, skip or error
+	DeleteErrored    bool                         `yaml:"delete_errored_snapshots"` // Delete the snapshots which ended up in error state
+	Instances        []InstanceConfig             // Multiple instances with retention policies
+	Defaults         DefaultsConfig               `yaml:"defaults"`
+	Policies         map[string]SnapshotRetention `yaml:"policies"` // Named retention policies referenced by instances
+	Discover         DiscoveryConfig              `yaml:"discover"`
+	NeverTouch       []NeverTouchRule             `yaml:"never_touch"`  // Instances never processed, whatever selects them
+	PolicyLabel      string                       `yaml:"policy_label"` // Label of the instances naming their retention policy
+	Accounts         []AccountConfig              `yaml:"accounts"`     // Further organizations, each with its own credentials and instances
+	Export           ExportConfig                 `yaml:"export"`       // Export of new snapshots to object storage
+	Replication      ReplicationConfig            `yaml:"replication"`  // Replication of new snapshots to another zone
+	GC               GCConfig                     `yaml:"gc"`           // Garbage collection of orphaned snapshots
+	Coverage         CoverageConfig               `yaml:"coverage"`
+	Verify           VerifyConfig                 `yaml:"verify"` // Checks of the verify command
+	Cost             CostConfig                   `yaml:"cost"`   // Pricing of the cost command
+	Notifications    NotificationsConfig          `yaml:"notifications"`
+	Events           EventsConfig                 `yaml:"events"`            // Snapshot lifecycle events sent as CloudEvents
+	HeartbeatURL     string                       `yaml:"heartbeat_url"`     // Pinged at the start and end of each run
+	UserAgentSuffix  string                       `yaml:"user_agent_suffix"` // Appended to the User-Agent of the API requests
+	CredentialsFile  string
+	LogLevel         string
+	LogFormat        string
+	LogOutput        string          `yaml:"-"` // stderr or syslog
+	SyslogFacility   string          `yaml:"-"`
+	SyslogTag        string          `yaml:"-"`
+	LogFile          string          `yaml:"-"` // --log-file, written instead of stderr
+	LogMaxSize       int             `yaml:"-"` // Megabytes
+	LogMaxAge        string          `yaml:"-"`
+	LogMaxFiles      int             `yaml:"-"`
+	Quiet            bool            `yaml:"-"` // Only log errors and don't print the run summary, for cron
+	NoColor          bool            `yaml:"-"`
+	Output           string          `yaml:"-"`
+	PlanFile         string          `yaml:"-"`
+	InstanceIDs      []string        `yaml:"-"` // --instance, instances targeted by a run or the restore command
+	ExcludeIDs       []string        `yaml:"-"` // --exclude-instance, instances skipped by a run
+	SnapshotID       string          `yaml:"-"`
+	Yes              bool            `yaml:"-"` // Skip confirmation prompts
+	IgnoreNeverTouch bool            `yaml:"-"` // Restore instances listed in never_touch anyway
+	Resolve          bool            `yaml:"-"` // Also check the configured instances against the API when validating
+	ShowVersion      bool            `yaml:"-"`
+	ShutdownTimeout  time.Duration   `yaml:"-"` // Operations in progress are waited for this long on SIGINT or SIGTERM
+	Timeout          time.Duration   `yaml:"-"` // --timeout, maximum duration of a run
+	Now              string          `yaml:"-"` // Time retention decisions are computed as of, RFC 3339
+	Clone            cloneOptions    `yaml:"-"`
+	Simulate         simulateOptions `yaml:"-"`
+	ConfigFile       string          `yaml:"-"`
+	ConfigFormat     string          `yaml:"-"` // yaml, json or toml, defaults to the one of the file extension
+	ConfigDir        string          `yaml:"-"` // Directory of configuration fragments merged into the configuration
+	StateFile        string          `yaml:"state_file"`
+	HistoryFile      string          `yaml:"history_file"`
+	AuditLog         string          `yaml:"audit_log"` // Append-only JSON lines log of snapshot creations and deletions
+	LockFile         string          `yaml:"lock_file"`
+	MetricsListen    string          `yaml:"metrics_listen"`
+	MetricsTextfile  string          `yaml:"metrics_textfile"`
+	PushgatewayURL   string          `yaml:"pushgateway_url"` // Prometheus Pushgateway the metrics are pushed to after each run
+	ReportFile       string          `yaml:"-"`               // --report-file, HTML or Markdown report of a run
+
+	pendingMigrations []string // Changes the config migrate command would make
 }
 
 type InstanceConfig struct {
 	ID        v3.UUID           `yaml:"id"`
+	Selector  map[string]string `yaml:"selector"`   // Select instances by labels instead of ID
+	Name      string            `yaml:"name"`       // Select instances by name or glob pattern instead of ID
+	NameRegex string            `yaml:"name_regex"` // Select instances by name regular expression instead of ID
+	Schedule  string            `yaml:"schedule"`   // Cron expression, only used in daemon mode
+	Policy    string            `yaml:"policy"`     // Named retention policy, overridden by the snapshots settings
+	Zone      string            `yaml:"zone"`       // Zone the instance lives in, defaults to the zone of the API endpoint
+	Endpoint  string            `yaml:"endpoint"`   // API endpoint of the zone the instance lives in, instead of zone
+	Account   string            `yaml:"-"`          // Account the instance belongs to, set when resolving instances
+	Enabled   *bool             `yaml:"enabled"`    // Instances are paused with false, defaults to true
+
+	WhenStopped string `yaml:"when_stopped"` // What is done if the instance is stopped: snapshot, skip or error
+
+	retentionSet bool // The entry sets its own policy or snapshots, which the policy label doesn't override
+
+	MinInterval  duration `yaml:"min_interval"`          // No snapshot is created if one is more recent than this
+	MaxDeletions int      `yaml:"max_deletions_per_run"` // Pruning is aborted if it would delete more snapshots than this
+	MaxAge       duration `yaml:"max_snapshot_age"`      // An alert is raised if the newest ready snapshot is older than this
+
 	Snapshots SnapshotRetention `yaml:"snapshots"`
 }
 
-type SnapshotRetention struct {
-	Hourly  int `yaml:"hourly"`
-	Daily   int `yaml:"daily"`
-	Weekly  int `yaml:"weekly"`
-	Monthly int `yaml:"monthly"`
-	Yearly  int `yaml:"yearly"`
+type SnapshotRetention struct {
+	Hourly    timeframeRetention `yaml:"hourly"`
+	Daily     timeframeRetention `yaml:"daily"`
+	Weekly    timeframeRetention `yaml:"weekly"`
+	Monthly   timeframeRetention `yaml:"monthly"`
+	Quarterly timeframeRetention `yaml:"quarterly"`
+	Yearly    timeframeRetention `yaml:"yearly"`
+
+	Margin retentionMargin `yaml:"margin"` // How much closer than a timeframe retained snapshots may be, defaults to 10%
+
+	Calendar       bool      `yaml:"calendar"`        // Align timeframes on calendar hours, days, ISO weeks, months, quarters and years
+	FixedDurations bool      `yaml:"fixed_durations"` // Sliding months, quarters and years of 30, 91 and 365 days like older versions
+	Timezone       timezone  `yaml:"timezone"`        // Timezone calendar boundaries and archived years are evaluated in, defaults to UTC, only with calendar or yearly_archive
+	WeekStart      weekStart `yaml:"week_start"`      // Day calendar weeks start on, monday (ISO weeks, the default) or sunday, only with calendar
+
+	MinAge   duration `yaml:"min_age"`   // Snapshots younger than this are never deleted
+	KeepLast int      `yaml:"keep_last"` // The most recent snapshots are never deleted, however close they are
+
+	YearlyArchive bool `yaml:"yearly_archive"` // Permanently keep the first snapshot of each year, outside of the timeframes
+
+	Tiers []RetentionTier `yaml:"tiers"` // Custom timeframes in addition to the fixed ones
+}
+
+// Custom retention timeframe, keeping snapshots at least Every apart
+type RetentionTier struct {
+	Every  duration        `yaml:"every"`
+	Keep   int             `yaml:"keep"`
+	Margin retentionMargin `yaml:"margin"` // Overrides the margin of the retention policy
+}
+
+// Time zone configured by its IANA name
+type timezone struct {
+	*time.Location
+}
+
+func (tz *timezone) UnmarshalYAML(value *yaml.Node) error {
+	loc, err := time.LoadLocation(value.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: invalid timezone %q: %w", value.Line, value.Value, err)
+	}
+	tz.Location = loc
+	return nil
+}
+
+// Get the configured location, falling back to UTC
+func (tz timezone) location() *time.Location {
+	if tz.Location == nil {
+		return time.UTC
+	}
+	return tz.Location
+}
+
+func exitWithErr(err error) {
+	exitWith(exitFatal, err)
+}
+
+func exitWith(code int, err error) {
+	slog.Error("", "err", explainAPIError(err, ""))
+	if code == exitFatal {
+		errorTracker.fatal(err)
+	}
+	lock.release() // os.Exit doesn't run deferred functions
+	os.Exit(code)
+}
+
+func main() {
+	// Load config from YAML file
+	cfg := config{
+		APIEndpoint: getAPIEndpoint(), // Getting the API endpoint via the custom function
+	}
+
+	parseFlags(&cfg)
+
+	command, args, err := findCommand(flag.Args())
+	if err == nil {
+		err = command.check(flag.CommandLine, args)
+	}
+	if err != nil {
+		exitWith(exitUsage, err)
+	}
+
+	if command.name == "help" {
+		if len(args) == 0 {
+			flag.Usage()
+			return
+		}
+		helped, _, err := findCommand(args)
+		if err != nil {
+			exitWith(exitUsage, err)
+		}
+		writeCommandUsage(os.Stdout, helped, flag.CommandLine)
+		return
+	}
+	if command.name == "prune" {
+		cfg.PruneOnly = true
+	}
+
+	switch {
+	case command.name == "version", cfg.ShowVersion:
+		if err := writeVersion(os.Stdout, currentBuild()); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case command.name == "completion":
+		if err := writeCompletionScript(os.Stdout, args[0]); err != nil {
+			exitWith(exitUsage, err)
+		}
+		return
+	case command.name == "__complete":
+		writeCompletions(os.Stdout, flag.CommandLine, args)
+		return
+	}
+
+	// Set up credentials, the ones from the command line or environment are used by the top-level instances
+	defaultCreds := func() (*credentials.Credentials, error) {
+		if cfg.CredentialsFile != "" {
+			return apiCredentialsFromFile(cfg.CredentialsFile)
+		}
+		return credentials.NewEnvCredentials(), nil
+	}
+	configCredentials = defaultCreds
+
+	// The schema doesn't depend on any configuration
+	if command.name == "schema" {
+		if err := writeSchema(os.Stdout); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	// The init command writes the configuration rather than reading it
+	if command.name == "init" {
+		creds, err := defaultCreds()
+		if err != nil {
+			exitWithErr(err)
+		}
+		client, err := v3.NewClient(creds, cfg.clientOptions("")...)
+		if err != nil {
+			exitWithErr(err)
+		}
+		if err := initConfig(context.Background(), client, cfg.APIEndpoint, cfg.PlanFile); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	configFile, err := findConfigFile(cfg.ConfigFile)
+	if err != nil {
+		exitWithErr(err)
+	}
+
+	if command.name == "config migrate" {
+		if err := migrateConfigFile(configFile, cfg.ConfigFormat, cfg.ConfigDir, cfg.PlanFile, os.Stderr); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	// Report all the problems of the configuration at once, rather than the first one
+	if command.name == "validate" {
+		problems := validateConfigFile(configFile, cfg.ConfigFormat, nil)
+		writeConfigProblems(os.Stderr, configFile, problems)
+		invalid := len(problems) > 0
+		if cfg.ConfigDir != "" && !invalid {
+			base := cfg
+			if err := loadConfig(configFile, cfg.ConfigFormat, &base); err != nil {
+				exitWithErr(err)
+			}
+			invalid = validateConfigDir(os.Stderr, cfg.ConfigDir, base)
+		}
+		if invalid {
+			os.Exit(exitFatal)
+		}
+		if !cfg.Resolve {
+			_, _ = fmt.Fprintf(os.Stdout, "%s: configuration is valid\n", configFile)
+			return
+		}
+	}
+
+	// The flags which are also configuration keys take precedence over the configuration
+	flags := cfg
+	if err := loadConfig(configFile, cfg.ConfigFormat, &cfg); err != nil {
+		exitWithErr(err)
+	}
+	if cfg.ConfigDir != "" {
+		if err := loadConfigDir(cfg.ConfigDir, &cfg); err != nil {
+			exitWithErr(err)
+		}
+	}
+	applyConfigFlags(&cfg, flags)
+
+	// Set log level, format and output
+	logOut, err := logWriter(cfg)
+	if err != nil {
+		exitWith(exitUsage, err)
+	}
+	if err := setupLogging(logOut, cfg); err != nil {
+		exitWithErr(err)
+	}
+	build := currentBuild()
+	slog.Info("Starting snap-o-matic", "version", build.Version, "commit", build.Commit)
+	warnConfigVersion(context.Background(), cfg)
+	if err := setupHTTP(cfg.HTTP); err != nil {
+		exitWithErr(err)
+	}
+
+	if cfg.PruneOnly && cfg.SnapshotOnly {
+		exitWith(exitUsage, errors.New("--prune-only and --snapshot-only are mutually exclusive"))
+	}
+	if cfg.ReportFile != "" {
+		if _, err := reportFormat(cfg.ReportFile); err != nil {
+			exitWith(exitUsage, fmt.Errorf("invalid --report-file: %w", err))
+		}
+	}
+
+	// Deciding as of another time is only safe as long as nothing gets deleted
+	if cfg.Now != "" {
+		t, err := time.Parse(time.RFC3339, cfg.Now)
+		if err != nil {
+			exitWith(exitUsage, fmt.Errorf("invalid --now: %w", err))
+		}
+		switch {
+		case cfg.DryRun, command.name == "list", command.name == "explain", command.name == "coverage", command.name == "verify", command.name == "simulate":
+		default:
+			exitWith(exitUsage, errors.New("--now requires --dry-run, or the list, explain, coverage, verify or simulate command"))
+		}
+		retentionClock = fixedClock(t)
+		slog.Info("Computing retention decisions as of another time", "now", t)
+	}
+
+	// Simulations only need the configuration
+	if command.name == "simulate" {
+		report, err := simulateRetention(context.Background(), cfg)
+		if err != nil {
+			exitWith(exitUsage, err)
+		}
+		if err := writeSimulation(os.Stdout, report, cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	slog.Info("Using API endpoint", "endpoint", cfg.APIEndpoint)
+	clients, err := newAccountClients(cfg, defaultCreds)
+	if err != nil {
+		exitWithErr(err)
+	}
+
+	if cfg.Export.Enabled {
+		if err := cfg.Export.setup(defaultCreds); err != nil {
+			exitWithErr(err)
+		}
+	}
+	if cfg.Replication.Enabled && cfg.Replication.Zone == "" {
+		exitWithErr(errors.New("replication: missing zone"))
+	}
+
+	statePath := getStatePath(cfg.StateFile)
+	cfg.HistoryFile = getHistoryPath(cfg.HistoryFile, statePath)
+	audit.path = cfg.AuditLog
+	cloudEvents = newCloudEventSink(cfg.Events)
+	if operations, err = newOperationWaiter(cfg); err != nil {
+		exitWithErr(err)
+	}
+	tracer = newSpanRecorder(cfg.Tracing)
+	if errorTracker, err = newSentryClient(cfg.ErrorTracking); err != nil {
+		exitWithErr(err)
+	}
+	defer errorTracker.recoverPanic(context.Background())
+	state, err := loadState(statePath)
+	if err != nil {
+		exitWithErr(err)
+	}
+
+	// Prevent overlapping runs from racing on snapshot creations and deletions, listing is harmless though
+	if !command.readOnly {
+		lock, err = acquireLock(getLockPath(cfg.LockFile, statePath))
+		var locked *lockedError
+		if errors.As(err, &locked) {
+			if locked.holder.PID == 0 {
+				slog.Error("Exiting, another run is active", "lock_file", locked.path)
+			} else {
+				slog.Error("Exiting, another run is active", "pid", locked.holder.PID, "hostname", locked.holder.Hostname, "started_at", locked.holder.StartedAt, "lock_file", locked.path)
+			}
+			os.Exit(exitLocked)
+		} else if err != nil {
+			exitWithErr(err)
+		}
+		defer lock.release()
+	}
+
+	// Read-only commands have nothing worth waiting for
+	shutdownTimeout := cfg.ShutdownTimeout
+	if command.readOnly {
+		shutdownTimeout = 0
+	}
+	ctx, stopSignals := handleSignals(shutdownTimeout)
+	defer stopSignals()
+
+	// Without accounts, failing to resolve the instances is fatal. Otherwise only runs go on with the other accounts.
+	instances, accountFailures := resolveAccountInstances(ctx, clients, cfg)
+	if len(accountFailures) > 0 && (len(cfg.Accounts) == 0 || cfg.Daemon || (command.name != "run" && command.name != "prune")) {
+		exitWithErr(accountFailures[0].Err)
+	}
+	configured := cfg.Instances
+	cfg.Instances = instances
+	for _, instance := range cfg.Instances {
+		if settings := instance.Snapshots.ineffectiveSettings(); len(settings) > 0 {
+			slog.Warn("Retention settings without effect, set calendar: true to align timeframes on calendar boundaries", "instance_id", instance.ID, "settings", settings)
+		}
+	}
+
+	// Ad-hoc runs of a subset of the instances, the others still count as configured for garbage collection
+	selected := cfg.Instances
+	if (command.name == "run" || command.name == "prune" || command.name == "verify") && (len(cfg.InstanceIDs) > 0 || len(cfg.ExcludeIDs) > 0) {
+		if cfg.Daemon {
+			exitWith(exitUsage, errors.New("--instance and --exclude-instance are not supported in daemon mode"))
+		}
+		if selected, err = selectInstances(ctx, clients, cfg, cfg.InstanceIDs, cfg.ExcludeIDs); err != nil {
+			exitWithErr(err)
+		}
+		slog.Info("Processing a subset of the instances", "selected", len(selected), "configured", len(cfg.Instances))
+	}
+
+	if cfg.Daemon {
+		if err := runDaemon(ctx, clients, state, cfg); err != nil {
+			exitWithErr(err)
+		}
+		return
+	}
+
+	switch command.name {
+	case "run", "prune":
+	case "list":
+		if err := listSnapshots(ctx, clients, state, cfg, os.Stdout); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "validate":
+		if problems := validateInstances(ctx, clients, cfg); len(problems) > 0 {
+			writeConfigProblems(os.Stderr, configFile, problems)
+			os.Exit(exitFatal)
+		}
+		_, _ = fmt.Fprintf(os.Stdout, "%s: configuration is valid, %d instance(s) found\n", configFile, len(cfg.Instances))
+		return
+	case "explain":
+		if err := explainSnapshot(ctx, clients, state, cfg, os.Stdout); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "protect", "unprotect":
+		if err := protectSnapshots(ctx, clients, configuredEndpoints(cfg), state, args, command.name == "protect"); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "restore":
+		if err := restoreSnapshot(ctx, clients, cfg, configured, os.Stdin, os.Stderr); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "clone":
+		if err := cloneSnapshot(ctx, clients, configuredEndpoints(cfg), state, cfg); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "history":
+		if err := showHistory(cfg, os.Stdout); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "coverage":
+		coverage, err := instancesCoverage(ctx, clients, configuredEndpoints(cfg), cfg)
+		if err != nil {
+			exitWithErr(err)
+		}
+		if err := writeCoverage(os.Stdout, coverage, cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "cost":
+		costs, err := storageCosts(ctx, clients, cfg)
+		if err != nil {
+			exitWithErr(err)
+		}
+		if err := writeCosts(os.Stdout, costs, cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "verify":
+		verifications, err := verifyInstances(ctx, clients, cfg, selected)
+		if err != nil {
+			exitWithErr(err)
+		}
+		if err := writeVerification(os.Stdout, verifications, cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+		for _, v := range verifications {
+			if v.Status == "failed" {
+				os.Exit(exitPartialFailure)
+			}
+		}
+		return
+	case "gc":
+		startedAt := time.Now()
+		orphans, results, err := collectGarbage(ctx, clients, configuredEndpoints(cfg), state, newDeletionBudget(cfg.MaxDeletions), cfg)
+		cloudEvents.flush(ctx)
+		if err != nil {
+			exitWithErr(err)
+		}
+		if !cfg.DryRun {
+			report := runReport{RunID: newRunID(), StartedAt: startedAt, FinishedAt: time.Now(), Results: results}
+			if err := appendHistory(cfg.HistoryFile, report); err != nil {
+				slog.ErrorContext(ctx, "Error recording run history", "err", err)
+			}
+		}
+		if err := writeOrphans(os.Stdout, orphans, cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+		if (runReport{Results: results}).hasFailures() {
+			lock.release() // os.Exit doesn't run deferred functions
+			os.Exit(exitPartialFailure)
+		}
+		return
+	case "plan":
+		if err := writePlanFile(ctx, clients, state, cfg); err != nil {
+			exitWithErr(err)
+		}
+		return
+	case "apply":
+		report, err := applyPlanFile(ctx, clients, state, cfg, args[0])
+		if err != nil {
+			exitWithErr(err)
+		}
+		if !cfg.Quiet {
+			if err := writeRunSummary(os.Stdout, report); err != nil {
+				exitWithErr(err)
+			}
+		}
+		if cfg.ReportFile != "" {
+			if err := writeReportFile(cfg.ReportFile, report); err != nil {
+				exitWithErr(err)
+			}
+		}
+		if len(report.failedInstances()) > 0 {
+			lock.release() // os.Exit doesn't run deferred functions
+			os.Exit(exitPartialFailure)
+		}
+		return
+	default:
+		exitWith(exitUsage, fmt.Errorf("unknown command %q", command.name))
+	}
+
+	// Nothing is done if the instances fail the preflight check
+	selected, preflightResults, err := preflightInstances(ctx, clients, cfg, selected)
+	if err != nil {
+		exitWithErr(err)
+	}
+
+	report := run(ctx, cfg, func(ctx context.Context) []instanceResult {
+		budget := newDeletionBudget(cfg.MaxDeletions) // Shared with the garbage collection
+		results := append(slices.Concat(accountFailures, preflightResults), processInstances(ctx, clients, state, budget, cfg, selected)...)
+
+		// Instances of accounts which failed to resolve would look unconfigured
+		if cfg.GC.Enabled && !cfg.SnapshotOnly {
+			if len(accountFailures) > 0 {
+				slog.WarnContext(ctx, "Skipping garbage collection as some instances could not be resolved")
+				return results
+			}
+			_, gcResults, err := collectGarbage(ctx, clients, configuredEndpoints(cfg), state, budget, cfg)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error collecting orphaned snapshots", "err", err)
+				gcResults = []instanceResult{{Err: fmt.Errorf("garbage collection failed: %w", err)}}
+			}
+			results = append(results, gcResults...)
+		}
+		return results
+	})
+
+	// Dry runs can emit the planned changes for review, the outcome of the run is summed up otherwise
+	if cfg.DryRun && cfg.Output != "table" {
+		if err := writePlan(os.Stdout, newRunPlan(report), cfg.Output); err != nil {
+			exitWithErr(err)
+		}
+	} else if !cfg.Quiet {
+		if err := writeRunSummary(os.Stdout, report); err != nil {
+			exitWithErr(err)
+		}
+	}
+
+	if cfg.MetricsTextfile != "" {
+		if err := metrics.writeTextfile(cfg.MetricsTextfile); err != nil {
+			exitWithErr(err)
+		}
+	}
+	if cfg.ReportFile != "" {
+		if err := writeReportFile(cfg.ReportFile, report); err != nil {
+			exitWithErr(err)
+		}
+	}
+
+	if len(report.failedInstances()) > 0 {
+		lock.release() // os.Exit doesn't run deferred functions
+		os.Exit(exitPartialFailure)
+	}
+	if len(report.staleInstances()) > 0 {
+		lock.release()
+		os.Exit(exitStale)
+	}
+}
+
+// Flags which are also configuration keys, by name, with how to apply them over the configuration
+var configFlags = map[string]func(cfg *config, flags config){
+	"credentials-file":  func(cfg *config, flags config) { cfg.CredentialsFile = flags.CredentialsFile },
+	"log-level":         func(cfg *config, flags config) { cfg.LogLevel = flags.LogLevel },
+	"log-format":        func(cfg *config, flags config) { cfg.LogFormat = flags.LogFormat },
+	"dry-run":           func(cfg *config, flags config) { cfg.DryRun = flags.DryRun },
+	"unsafe-delete-all": func(cfg *config, flags config) { cfg.UnsafeDeleteAll = flags.UnsafeDeleteAll },
+	"gc":                func(cfg *config, flags config) { cfg.GC.Enabled = flags.GC.Enabled },
+	"concurrency":       func(cfg *config, flags config) { cfg.Concurrency = flags.Concurrency },
+	"daemon":            func(cfg *config, flags config) { cfg.Daemon = flags.Daemon },
+	"metrics-listen":    func(cfg *config, flags config) { cfg.MetricsListen = flags.MetricsListen },
+	"metrics-textfile":  func(cfg *config, flags config) { cfg.MetricsTextfile = flags.MetricsTextfile },
+	"pushgateway-url":   func(cfg *config, flags config) { cfg.PushgatewayURL = flags.PushgatewayURL },
+}
+
+// Apply the flags set on the command line over the configuration, given the configuration as parsed from the flags
+func applyConfigFlags(cfg *config, flags config) {
+	for name, apply := range configFlags {
+		if flag.CommandLine.Changed(name) {
+			apply(cfg, flags)
+		}
+	}
+}
+
+func parseFlags(cfg *config) {
+	flag.StringVarP(&cfg.CredentialsFile, "credentials-file", "f", "",
+		"File to read API credentials from")
+
+	flag.StringVarP(&cfg.ConfigFile, "config", "c", os.Getenv("SNAPOMATIC_CONFIG"),
+		"Path to the YAML, JSON or TOML configuration file")
+	flag.StringVar(&cfg.ConfigFormat, "config-format", "", "Format of the configuration file, supported values: yaml,json,toml (default: from the file extension)")
+	flag.StringVar(&cfg.ConfigDir, "config-dir", os.Getenv("SNAPOMATIC_CONFIG_DIR"),
+		"Directory of configuration fragments adding instances, policies and accounts to the configuration file, e.g. /etc/snap-o-matic/conf.d")
+
+	flag.StringVarP(&cfg.Output, "output", "o", "table", "Output format of the list command and of the dry run plan, supported values: table,json,yaml")
+
+	flag.StringVar(&cfg.PlanFile, "out", "", "File the plan command writes the plan to, or the init and config migrate commands the configuration, instead of stdout")
+
+	flag.StringSliceVar(&cfg.InstanceIDs, "instance", nil, "Instance to process, by ID or name (repeatable, default: all the configured ones), to revert with the restore command, or to show the history of")
+	flag.StringSliceVar(&cfg.ExcludeIDs, "exclude-instance", nil, "Instance not to process, by ID or name (repeatable)")
+	flag.StringVar(&cfg.SnapshotID, "snapshot", "", "Snapshot to revert to with the restore command, to create an instance from with the clone command, to explain, or to show the history of")
+	flag.BoolVarP(&cfg.Yes, "yes", "y", false, "Don't ask for confirmation before restoring")
+	flag.BoolVar(&cfg.IgnoreNeverTouch, "ignore-never-touch", false, "Restore an instance even if it is listed in never_touch")
+	flag.BoolVar(&cfg.Resolve, "resolve", false, "Also check the configured instances against the API with the validate command")
+	flag.StringVar(&cfg.Clone.Name, "name", "", "Name of the instance created by the clone command")
+	flag.StringVar(&cfg.Clone.InstanceType, "instance-type", "", "Type of the instance created by the clone command, e.g. standard.medium (default: type of the original instance)")
+	flag.StringVar(&cfg.Clone.Zone, "zone", "", "Zone of the instance created by the clone command (default: zone of the snapshot)")
+
+	flag.StringVarP(&cfg.LogLevel, "log-level", "L", "info", "Logging level, supported values: error,warn,info,debug")
+	flag.StringVar(&cfg.LogFormat, "log-format", "text", "Logging format, supported values: text,json")
+	flag.StringVar(&cfg.LogOutput, "log-output", "stderr", "Logging output, supported values: stderr,syslog")
+	flag.StringVar(&cfg.SyslogFacility, "syslog-facility", "daemon", "Syslog facility of the logs with --log-output syslog, e.g. daemon or local0")
+	flag.StringVar(&cfg.SyslogTag, "syslog-tag", "snap-o-matic", "Syslog tag of the logs with --log-output syslog")
+	flag.BoolVarP(&cfg.Quiet, "quiet", "q", false, "Only log errors and don't print the run summary, e.g. when run by cron")
+	flag.BoolVar(&cfg.NoColor, "no-color", false, "Don't color the logs written to a terminal, like with the NO_COLOR environment variable")
+	flag.StringVar(&cfg.LogFile, "log-file", "", "File to write logs to instead of stderr, rotated according to --log-max-size and --log-max-age")
+	flag.IntVar(&cfg.LogMaxSize, "log-max-size", 100, "Size in megabytes after which the log file is rotated, 0 for no limit")
+	flag.StringVar(&cfg.LogMaxAge, "log-max-age", "", "Age after which the log file is rotated, e.g. 7d (default: none)")
+	flag.IntVar(&cfg.LogMaxFiles, "log-max-files", 5, "Number of rotated log files kept, 0 to keep them all")
+	flag.BoolVarP(&cfg.ShowVersion, "version", "V", false, "Print the version of snap-o-matic and exit")
+	flag.BoolVarP(&cfg.DryRun, "dry-run", "d", false, "Run in dry-run mode (read-only)")
+	flag.BoolVar(&cfg.UnsafeDeleteAll, "unsafe-delete-all", false,
+		"Also delete snapshots which were not created by snap-o-matic")
+	flag.BoolVar(&cfg.PruneOnly, "prune-only", false, "Only apply retention policies, don't create new snapshots")
+	flag.BoolVar(&cfg.SnapshotOnly, "snapshot-only", false, "Only create new snapshots, don't apply retention policies")
+	flag.StringVar(&cfg.Now, "now", "", "Compute retention decisions as of this time (RFC 3339), requires --dry-run unless listing")
+	flag.StringVar(&cfg.Simulate.Policy, "policy", "", "Named retention policy of the simulate command (default: the default retention policy)")
+	flag.StringVar(&cfg.Simulate.Interval, "interval", "24h", "Time between two simulated runs")
+	flag.StringVar(&cfg.Simulate.Horizon, "horizon", "1y", "Period covered by the simulation")
+	flag.BoolVar(&cfg.GC.Enabled, "gc", false, "Also delete orphaned snapshots at the end of the run, like the gc command")
+	flag.IntVarP(&cfg.Concurrency, "concurrency", "j", 1, "Number of instances to process in parallel")
+	flag.DurationVar(&cfg.Timeout, "timeout", 0, "Maximum duration of a run, after which the operations in progress are aborted and the remaining instances skipped (default: none)")
+	flag.DurationVar(&cfg.ShutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "Time the operations in progress are waited for on SIGINT or SIGTERM before being aborted, 0 to abort them right away")
+	flag.BoolVarP(&cfg.Daemon, "daemon", "D", false, "Run continuously, processing each instance according to its schedule")
+	flag.StringVar(&cfg.MetricsListen, "metrics-listen", "", "Address to serve Prometheus metrics on in daemon mode (e.g. :9090)")
+	flag.StringVar(&cfg.MetricsTextfile, "metrics-textfile", "", "File to write Prometheus metrics to at the end of a run")
+	flag.StringVar(&cfg.PushgatewayURL, "pushgateway-url", "", "Prometheus Pushgateway to push metrics to at the end of a run")
+	flag.StringVar(&cfg.ReportFile, "report-file", "", "File to write an HTML (.html) or Markdown (.md) report of the run to")
+
+	flag.ErrHelp = errors.New("") // Don't print "pflag: help requested" when the user invokes the help flags
+	flag.Usage = func() {
+		// Help of the command given so far, e.g. snap-o-matic list --help
+		if command, _, err := findCommand(flag.Args()); err == nil && flag.NArg() > 0 {
+			writeCommandUsage(os.Stderr, command, flag.CommandLine)
+			return
+		}
+
+		_, _ = fmt.Fprintln(os.Stderr, "snap-o-matic - Automatic Exoscale Compute instance volume snapshot")
+		_, _ = fmt.Fprintln(os.Stderr, "")
+		_, _ = fmt.Fprintln(os.Stderr, "*** WARNING ***")
+		_, _ = fmt.Fprintln(os.Stderr, "")
+		_, _ = fmt.Fprintln(os.Stderr, "This is experimental software and may not work as intended or may not be continued in the future. Use at your own risk.")
+		_, _ = fmt.Fprintln(os.Stderr, "")
+		_, _ = fmt.Fprintln(os.Stderr, "Usage:")
+		writeCommands(os.Stderr)
+		_, _ = fmt.Fprintln(os.Stderr, "")
+		_, _ = fmt.Fprintln(os.Stderr, "Run 'snap-o-matic help COMMAND' for the flags of a command.")
+		_, _ = fmt.Fprintln(os.Stderr, "")
+		_, _ = fmt.Fprintln(os.Stderr, "Global flags:")
+		_, _ = fmt.Fprint(os.Stderr, flagUsages(flag.CommandLine, globalFlags))
+		_, _ = fmt.Fprintf(os.Stderr, `
+Supported environment variables:
+  EXOSCALE_API_ENDPOINT    Exoscale Compute API endpoint (default %q)
+  EXOSCALE_API_KEY         Exoscale API key
+  EXOSCALE_API_SECRET      Exoscale API secret
+  SNAPOMATIC_CONFIG        Path to the YAML configuration file
+
+Configuration file lookup:
+  If no configuration file is specified, the first existing file among the
+  following locations is used:
+
+    %s
+
+API credentials file format:
+  Instead of reading Exoscale API credentials from environment variables, it
+  is possible to read those from a file formatted such as:
+
+    api_key=EXOabcdef0123456789abcdef01
+    api_secret=AbCdEfGhIjKlMnOpQrStUvWxYz-0123456789aBcDef
+`, defaultEndpoint, strings.Join(defaultConfigPaths, "\n    "))
+	}
+
+	// Invalid flags would otherwise exit with the partial failure status code
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		_, _ = fmt.Fprintln(os.Stderr, err)
+		_, _ = fmt.Fprintln(os.Stderr, "Run 'snap-o-matic --help' for usage.")
+		os.Exit(exitUsage)
+	}
+}
+
+// Find the configuration file to use, prefer the explicitly given path, fallback to the default search path
+func findConfigFile(path string) (string, error) {
+	if path != "" {
+		return path, nil
+	}
+
+	for _, candidate := range defaultConfigPaths {
+		candidate = os.ExpandEnv(candidate)
+		if strings.HasPrefix(candidate, "/snap-o-matic/") {
+			continue // Skip locations relying on an unset environment variable
+		}
+		if _, err := os.Stat(candidate); err == nil {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no configuration file found (searched: %s)", strings.Join(defaultConfigPaths, ", "))
+}
+
+// Load the configuration file, in YAML, JSON or TOML format
+func loadConfig(filename, format string, cfg *config) error {
+	data, err := readConfigFile(filename, format, true)
+	if err != nil {
+		return err
+	}
+	if err := decodeConfig(data, cfg); err != nil {
+		return withoutConvertedLines(filename, format, err)
+	}
+	fragments, _ := readConfigFragments(cfg.ConfigDir)                  // Errors are reported when the fragments are loaded
+	cfg.pendingMigrations, _ = pendingConfigMigrations(data, fragments) // Newer versions are warned about by themselves
+	return nil
+}
+
+// Drop the lines of the errors decoding a TOML file, they refer to its YAML conversion
+func withoutConvertedLines(filename, format string, err error) error {
+	if format, _ := configFormat(filename, format); err == nil || format != "toml" {
+		return err
+	}
+	messages := []string{}
+	for _, problem := range configProblems(err) {
+		messages = append(messages, problem.Message)
+	}
+	return errors.New(strings.Join(messages, "; "))
+}
+
+// Decode a YAML configuration. Unknown keys are errors, a misspelled retention field would otherwise silently keep
+// nothing.
+func decodeConfig(data []byte, cfg *config) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return err
+	}
+	if cfg.Policies == nil {
+		cfg.Policies = make(map[string]SnapshotRetention)
+	}
+
+	return applyRetentionDefaults(data, cfg)
+}
+
+// Process the given instances as a single run, then log and notify its outcome
+func runInstances(ctx context.Context, clients accountClients, state *stateStore, cfg config, instances []InstanceConfig) runReport {
+	return run(ctx, cfg, func(ctx context.Context) []instanceResult {
+		return processInstances(ctx, clients, state, newDeletionBudget(cfg.MaxDeletions), cfg, instances)
+	})
+}
+
+// Perform a run, reporting its outcome through logs, notifications and the heartbeat
+func run(ctx context.Context, cfg config, process func(ctx context.Context) []instanceResult) runReport {
+	report := runReport{
+		RunID:     newRunID(),
+		DryRun:    cfg.DryRun,
+		StartedAt: time.Now(),
+	}
+	ctx = withLogAttrs(ctx, "run_id", report.RunID)
+	ctx, span := startSpan(ctx, "run", "run_id", report.RunID, "dry_run", report.DryRun)
+	breakers.reset()
+
+	pingHeartbeat(ctx, cfg.HeartbeatURL, "/start", report.RunID, "")
+
+	processCtx := ctx
+	if cfg.Timeout > 0 {
+		var cancel context.CancelFunc
+		processCtx, cancel = context.WithTimeoutCause(ctx, cfg.Timeout, fmt.Errorf("run timeout of %s exceeded", formatDuration(cfg.Timeout)))
+		defer cancel()
+	}
+
+	report.Results = process(processCtx)
+	report.FinishedAt = time.Now()
+	report.Interrupted = shutdown.requested()
+	report.FailedFast = breakers.opened()
+
+	// The outcome is reported even if the operations in progress were aborted
+	ctx = context.WithoutCancel(ctx)
+
+	var runErr error
+	if failed := len(report.failedInstances()); failed > 0 {
+		runErr = fmt.Errorf("%d instance(s) failed", failed)
+	}
+	span.finish(runErr)
+	if err := tracer.export(ctx); err != nil {
+		slog.ErrorContext(ctx, "Error exporting traces", "err", err)
+	}
+
+	if !report.DryRun {
+		if err := appendHistory(cfg.HistoryFile, report); err != nil {
+			slog.ErrorContext(ctx, "Error recording run history", "err", err)
+		}
+	}
+
+	for _, result := range report.Results {
+		instanceCtx := withLogAttrs(ctx, "instance_id", result.InstanceID)
+		if result.Account != "" {
+			instanceCtx = withLogAttrs(instanceCtx, "account", result.Account)
+		}
+		slog.InfoContext(instanceCtx, "Instance summary",
+			"created", result.Created,
+			"kept", result.Kept,
+			"deleted", result.Deleted,
+			"skipped", result.Skipped,
+			"delete_errors", result.DeleteErrors,
+			"stale", result.Stale,
+			"failed", result.Err != nil)
+	}
+
+	failedInstances := report.failedInstances()
+	totals := report.totals()
+	slog.InfoContext(ctx, "Run finished",
+		"interrupted", report.Interrupted,
+		"failed_fast", report.FailedFast,
+		"instances", totals.Instances,
+		"succeeded", totals.Instances-totals.Failed,
+		"failed", totals.Failed,
+		"failed_instances", failedInstances,
+		"skipped", totals.Skipped,
+		"created", totals.Created,
+		"kept", totals.Kept,
+		"deleted", totals.Deleted,
+		"delete_errors", totals.DeleteErrors)
+
+	metrics.runFinished(report)
+	if cfg.PushgatewayURL != "" {
+		if err := pushMetrics(ctx, cfg.PushgatewayURL); err != nil {
+			slog.ErrorContext(ctx, "Error pushing metrics", "err", err)
+		}
+	}
+
+	cloudEvents.flush(ctx)
+	sendNotifications(ctx, cfg.Notifications, report)
+	errorTracker.runFailed(ctx, report)
+
+	if report.hasFailures() {
+		pingHeartbeat(ctx, cfg.HeartbeatURL, "/fail", report.RunID, report.summary())
+	} else {
+		pingHeartbeat(ctx, cfg.HeartbeatURL, "", report.RunID, report.summary())
+	}
+
+	return report
+}
+
+// Process instances using a pool of workers, a failing instance must not prevent the others from being processed
+// Process instances in parallel, their deletions taken from the budget of the run
+func processInstances(ctx context.Context, clients accountClients, state *stateStore, budget *deletionBudget, cfg config, instances []InstanceConfig) []instanceResult {
+	// Paused instances keep their configuration and snapshots, they are merely not processed
+	instances = slices.DeleteFunc(slices.Clone(instances), func(instance InstanceConfig) bool {
+		if instance.disabled() {
+			slog.InfoContext(ctx, "Skipping disabled instance", "instance_id", instance.ID)
+		}
+		return instance.disabled()
+	})
+
+	var wg sync.WaitGroup
+	results := make([]instanceResult, len(instances))
+
+	// Snapshots are listed once per account and zone for the whole run
+	indexes := newSnapshotIndexes(clients)
+
+	workers := make(chan struct{}, max(cfg.Concurrency, 1))
+	for i, instance := range instances {
+		workers <- struct{}{}
+		if err := notStartedError(ctx, instance.Account); err != nil {
+			<-workers
+			results[i] = instanceResult{InstanceID: instance.ID, Account: instance.Account, Endpoint: instance.apiEndpoint(cfg.APIEndpoint), Err: err}
+			continue
+		}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+			defer errorTracker.recoverPanic(withLogAttrs(ctx, "instance_id", instance.ID))
+
+			ctx, cancel := instanceContext(ctx, cfg)
+			defer cancel()
+			ctx, span := startSpan(ctx, "instance", "instance_id", instance.ID, "account", instance.Account)
+			defer func() { span.finish(results[i].Err) }()
+
+			index, err := indexes.get(instance.Account, instance.apiEndpoint(cfg.APIEndpoint))
+			if err != nil {
+				results[i] = instanceResult{InstanceID: instance.ID, Account: instance.Account, Err: err}
+			} else {
+				results[i] = processInstance(ctx, index.client, index, state, budget, instance, cfg)
+				if instance.MaxAge > 0 {
+					stale, err := snapshotAgeAlert(ctx, index, instance, results[i].Created > 0 && cfg.DryRun)
+					results[i].Stale = stale
+					if results[i].Err == nil {
+						results[i].Err = err
+					}
+				}
+			}
+			results[i].Err = explainAPIError(withCancelCause(ctx, results[i].Err), fmt.Sprintf("instance %s not found in %s, check its id and zone", instance.ID, instance.apiEndpoint(cfg.APIEndpoint)))
+			if results[i].Err != nil {
+				slog.ErrorContext(ctx, "Error processing instance", "instance_id", instance.ID, "err", results[i].Err)
+			}
+			if !cfg.DryRun {
+				cloudEvents.instanceFailed(ctx, results[i])
+			}
+			interactive.instanceDone(results[i], len(instances))
+		}()
+	}
+	wg.Wait()
+
+	return results
 }
 
-func exitWithErr(err error) {
-	slog.Error("", "err", err)
-	os.Exit(-1)
-}
+// Process a specific instance by creating snapshots and managing retention
+func processInstance(ctx context.Context, client *v3.Client, index *snapshotIndex, state *stateStore, budget *deletionBudget, instance InstanceConfig, cfg config) (result instanceResult) {
+	ctx = withLogAttrs(ctx, "instance_id", instance.ID)
+	if instance.Account != "" {
+		ctx = withLogAttrs(ctx, "account", instance.Account)
+	}
+	slog.InfoContext(ctx, "Processing instance")
 
-func main() {
-	// Load config from YAML file
-	cfg := config{
-		APIEndpoint: getAPIEndpoint(), // Getting the API endpoint via the custom function
+	result.InstanceID = instance.ID
+	result.Account = instance.Account
+	result.Endpoint = instance.apiEndpoint(cfg.APIEndpoint)
+
+	start := time.Now()
+	defer func() { metrics.observeRun(instance.ID, time.Since(start), result.Err) }()
+
+	// Stopped instances are only looked for if they aren't snapshotted like running ones
+	whenStopped, err := instance.whenStopped(cfg)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	if whenStopped != whenStoppedSnapshot {
+		vm, err := client.GetInstance(ctx, instance.ID)
+		if err != nil {
+			result.Err = fmt.Errorf("unable to get instance: %w", err)
+			return result
+		}
+		if vm.State == v3.InstanceStateStopped {
+			if whenStopped == whenStoppedError {
+				result.Err = errors.New("instance is stopped (when_stopped: error)")
+				return result
+			}
+			slog.InfoContext(ctx, "Skipping stopped instance")
+			result.Skipped = "instance is stopped"
+			return result
+		}
 	}
 
-	parseFlags(&cfg)
+	// Skip the creation if a snapshot was taken recently, e.g. when the run is retried shortly after a previous one
+	skipCreation := cfg.PruneOnly
+	var recent *v3.Snapshot
+	if !skipCreation && instance.MinInterval > 0 {
+		snapshots, err := index.get(ctx, instance.ID)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		if recent = newestSnapshot(snapshots); recent != nil && retentionClock.Now().Sub(recent.CreatedAT) < time.Duration(instance.MinInterval) {
+			slog.InfoContext(ctx, "Skipping snapshot creation, a recent snapshot exists", "snapshot_id", recent.ID, "created_at", recent.CreatedAT, "min_interval", instance.MinInterval)
+			skipCreation = true
+			result.Skipped = "a recent snapshot exists"
+		}
+	}
 
-	if err := loadConfig("config.yaml", &cfg); err != nil {
-		exitWithErr(err)
+	// Create a new snapshot for the instance
+	var created *v3.Snapshot
+	if !skipCreation {
+		snapshot, err := createSnapshot(ctx, client, state, instance.ID, "new snapshot", cfg.DryRun)
+		switch {
+		case err == nil:
+			slog.InfoContext(ctx, "Created snapshot", "snapshot_id", snapshot.ID)
+			result.Created++
+			created = &snapshot
+
+			if !cfg.DryRun {
+				index.add(snapshot)
+			}
+
+		// Repeated creation failures must not erode the existing snapshots, unless told otherwise
+		case cfg.PruneOnFailure:
+			slog.ErrorContext(ctx, "Error creating snapshot, applying the retention policy anyway", "err", err)
+			defer func() { result.Err = errors.Join(err, result.Err) }() // Keeping the errors of the pruning
+
+		default:
+			result.Err = err
+			return result
+		}
 	}
 
-	// Set log level
-	switch cfg.LogLevel {
-	case "debug":
-		slog.SetLogLoggerLevel(slog.LevelDebug)
-	case "error":
-		slog.SetLogLoggerLevel(slog.LevelError)
-	default:
-		slog.SetLogLoggerLevel(slog.LevelInfo)
+	// Export the new snapshot to object storage and replicate it to the disaster recovery zone, failures don't prevent
+	// the retention policy from being applied
+	if cfg.Export.Enabled && created != nil {
+		if err := exportSnapshot(ctx, client, cfg.Export, *created, cfg.DryRun); err != nil {
+			slog.ErrorContext(ctx, "Error exporting snapshot", "snapshot_id", created.ID, "err", err)
+			defer func() {
+				if result.Err == nil {
+					result.Err = fmt.Errorf("unable to export snapshot %s: %w", created.ID, err)
+				}
+			}()
+		} else {
+			result.Exported++
+		}
+	}
+	if cfg.Replication.Enabled && created != nil {
+		if err := replicateSnapshot(ctx, client, state, cfg.Replication, instance.Account, *created, cfg.DryRun); err != nil {
+			slog.ErrorContext(ctx, "Error replicating snapshot", "snapshot_id", created.ID, "err", err)
+			defer func() {
+				if result.Err == nil {
+					result.Err = fmt.Errorf("unable to replicate snapshot %s: %w", created.ID, err)
+				}
+			}()
+		} else {
+			result.Replicated++
+		}
 	}
 
-	// Set up credentials
-	var creds *credentials.Credentials
-	if cfg.CredentialsFile != "" {
-		var err error
-		creds, err = apiCredentialsFromFile(cfg.CredentialsFile)
-		if err != nil {
-			exitWithErr(err)
+	if cfg.SnapshotOnly {
+		// The newest snapshot is exported without retention too, so that its age can be alerted on
+		switch {
+		case created != nil && !cfg.DryRun:
+			metrics.setNewest(instance.ID, created.CreatedAT)
+		case recent != nil:
+			metrics.setNewest(instance.ID, recent.CreatedAT)
 		}
-	} else {
-		creds = credentials.NewEnvCredentials()
+		if !skipCreation {
+			result.Actions = []plannedAction{{Action: "create", CreatedAt: retentionClock.Now(), Reason: "new snapshot"}}
+		}
+		setCreatedID(result.Actions, created, cfg.DryRun)
+		return result
 	}
 
-	fmt.Println("Using endpoint: ", cfg.APIEndpoint)
-	client, err := v3.NewClient(creds, v3.ClientOptWithEndpoint(cfg.APIEndpoint))
+	// Get and manage snapshots based on retention policies
+	instanceSnapshots, err := index.get(ctx, instance.ID)
 	if err != nil {
-		exitWithErr(err)
+		result.Err = err
+		return result
 	}
 
-	ctx := context.Background()
+	// Leave protected snapshots alone, as well as the ones not created by snap-o-matic unless told otherwise
+	snapshots := retentionCandidates(instanceSnapshots, state, cfg.UnsafeDeleteAll)
+	var errored []v3.Snapshot
+	if cfg.DeleteErrored {
+		errored = erroredSnapshots(instanceSnapshots, state, cfg.UnsafeDeleteAll)
+	}
+	for _, snapshot := range instanceSnapshots {
+		if !snapshotUsable(snapshot) && !slices.ContainsFunc(errored, func(s v3.Snapshot) bool { return s.ID == snapshot.ID }) {
+			slog.DebugContext(ctx, "Snapshot is not ready, left out of retention and not deleted", "snapshot_id", snapshot.ID, "state", snapshot.State)
+		}
+	}
 
-	// Process each instance in the config
-	for _, instance := range cfg.Instances {
-		if err := processInstance(ctx, client, instance, cfg.DryRun); err != nil {
-			exitWithErr(err)
+	// In dry run mode, account for the snapshot a real run would have created so the retention decisions match
+	var createdID v3.UUID
+	if created != nil {
+		createdID = created.ID
+	}
+	if cfg.DryRun && created != nil {
+		snapshots = append(snapshots, *created)
+		instanceSnapshots = append(instanceSnapshots, *created)
+	}
+
+	// Archived snapshots are protected for good, they don't take the place of other snapshots in the timeframes
+	var archived []v3.Snapshot
+	if instance.Snapshots.YearlyArchive {
+		if archived, err = archiveYearlySnapshots(ctx, state, instanceSnapshots, snapshots, instance.Snapshots, cfg.DryRun); err != nil {
+			result.Err = err
+			return result
 		}
+		snapshots = slices.DeleteFunc(snapshots, func(s v3.Snapshot) bool {
+			return slices.ContainsFunc(archived, func(a v3.Snapshot) bool { return a.ID == s.ID })
+		})
 	}
-}
 
-func parseFlags(cfg *config) {
-	flag.StringVarP(&cfg.CredentialsFile, "credentials-file", "f", "",
-		"File to read API credentials from")
+	// Step 1: Categorize snapshots into their respective retention slots
+	retainedSnapshots := categorizeSnapshots(ctx, snapshots, instance.Snapshots)
+	for _, snapshot := range archived {
+		retainedSnapshots[snapshot.ID.String()] = yearlyArchive
+	}
+	result.RetentionPlanned = true
+	result.Actions = planSnapshots(instanceSnapshots, state, instance.Snapshots, retainedSnapshots, cfg.UnsafeDeleteAll, cfg.DeleteErrored, createdID, time.Duration(cfg.DeletionGrace))
+	setCreatedID(result.Actions, created, cfg.DryRun)
+	for _, action := range result.Actions {
+		if action.Action == "keep" {
+			result.Kept++
+		}
+	}
 
-	flag.StringVarP(&cfg.LogLevel, "log-level", "L", "info", "Logging level, supported values: error,info,debug")
-	flag.BoolVarP(&cfg.DryRun, "dry-run", "d", false, "Run in dry-run mode (read-only)")
+	// Snapshots which are not retained anymore wait for the grace period before being deleted
+	due, err := dueForDeletion(ctx, state, snapshots, retainedSnapshots, time.Duration(cfg.DeletionGrace), cfg.DryRun)
+	if err != nil {
+		result.Err = err
+		return result
+	}
 
-	flag.ErrHelp = errors.New("") // Don't print "pflag: help requested" when the user invokes the help flags
-	flag.Usage = func() {
-		_, _ = fmt.Fprintln(os.Stderr, "snap-o-matic - Automatic Exoscale Compute instance volume snapshot")
-		_, _ = fmt.Fprintln(os.Stderr, "")
-		_, _ = fmt.Fprintln(os.Stderr, "*** WARNING ***")
-		_, _ = fmt.Fprintln(os.Stderr, "")
-		_, _ = fmt.Fprintln(os.Stderr, "This is experimental software and may not work as intended or may not be continued in the future. Use at your own risk.")
-		_, _ = fmt.Fprintln(os.Stderr, "")
-		_, _ = fmt.Fprintln(os.Stderr, "Usage:")
-		flag.PrintDefaults()
-		_, _ = fmt.Fprintf(os.Stderr, `
-Supported environment variables:
-  EXOSCALE_API_ENDPOINT    Exoscale Compute API endpoint (default %q)
-  EXOSCALE_API_KEY         Exoscale API key
-  EXOSCALE_API_SECRET      Exoscale API secret
+	// A misconfigured retention policy or a clock problem must not mass-delete snapshots
+	if deletions := len(due) + len(errored); instance.MaxDeletions > 0 && deletions > instance.MaxDeletions {
+		result.Err = fmt.Errorf("pruning aborted: %d snapshot(s) to delete exceed the max_deletions_per_run of the instance (%d)", deletions, instance.MaxDeletions)
+		return result
+	}
+	if deletions := len(due) + len(errored); !budget.reserve(deletions) {
+		result.Err = fmt.Errorf("pruning aborted: %d snapshot(s) to delete exceed what is left of the global max_deletions_per_run (%d)", deletions, cfg.MaxDeletions)
+		return result
+	}
 
-API credentials file format:
-  Instead of reading Exoscale API credentials from environment variables, it
-  is possible to read those from a file formatted such as:
+	// Step 2: Delete snapshots that were not retained, and the ones in error state if told so
+	result.Deleted, result.DeleteErrors = cleanupSnapshots(ctx, client, state, due, "not retained by any timeframe", cfg.DeleteWorkers, cfg.DryRun)
+	if len(errored) > 0 {
+		deleted, failed := cleanupSnapshots(ctx, client, state, errored, "snapshot in error state", cfg.DeleteWorkers, cfg.DryRun)
+		result.Deleted, result.DeleteErrors = result.Deleted+deleted, result.DeleteErrors+failed
+	}
 
-    api_key=EXOabcdef0123456789abcdef01
-    api_secret=AbCdEfGhIjKlMnOpQrStUvWxYz-0123456789aBcDef
-`, defaultEndpoint)
+	metrics.setSnapshots(instance.ID, snapshots, retainedSnapshots)
+
+	// Step 3: Delete exported snapshots and replicas that were not retained
+	if cfg.Export.Enabled {
+		if _, err := pruneExports(ctx, cfg.Export, instance.ID, cfg.DryRun); err != nil {
+			result.Err = err
+		}
+	}
+	if cfg.Replication.Enabled {
+		// Replicas follow the retention policy of the snapshots unless they have their own
+		retention := cfg.Replication.Snapshots
+		if retention.isEmpty() {
+			retention = instance.Snapshots
+		}
+		if _, err := pruneReplicas(ctx, client, state, cfg.Replication, instance.Account, instance.ID, retention, cfg.DryRun); err != nil {
+			result.Err = err
+		}
+	}
+	if _, err := pruneCloneTemplates(ctx, client, state, instance.Account, instance.ID, cfg.DryRun); err != nil {
+		result.Err = err
 	}
 
-	flag.Parse()
+	return result
 }
 
-// Load the YAML configuration file
-func loadConfig(filename string, cfg *config) error {
-	file, err := os.Open(filename)
-	if err != nil {
-		return err
+// Fill in the ID of the snapshot created by a real run in its planned action, for the run history. Plans leave it out
+// as the snapshot doesn't exist yet.
+func setCreatedID(actions []plannedAction, created *v3.Snapshot, dryRun bool) {
+	if dryRun || created == nil {
+		return
+	}
+	for i := range actions {
+		if actions[i].Action == "create" {
+			actions[i].SnapshotID = created.ID
+		}
 	}
-	defer file.Close()
-
-	decoder := yaml.NewDecoder(file)
-	return decoder.Decode(cfg)
 }
 
-// Process a specific instance by creating snapshots and managing retention
-func processInstance(ctx context.Context, client *v3.Client, instance InstanceConfig, dryRun bool) error {
-	fmt.Printf("Processing instance: %s\n", instance.ID)
+// Create a new snapshot for an instance and wait for it to be ready. In dry run mode, the returned snapshot stands in
+// for the one a real run would have created. The reason ends up in the audit log.
+func createSnapshot(ctx context.Context, client *v3.Client, state *stateStore, instanceID v3.UUID, reason string, dryRun bool) (created v3.Snapshot, err error) {
+	ctx, span := startSpan(ctx, "create snapshot", "instance_id", instanceID, "dry_run", dryRun)
+	defer func() {
+		span.finish(err)
+		id := created.ID
+		if dryRun {
+			id = ""
+		}
+		audit.record(ctx, "create", instanceID, id, reason, dryRun, err)
+		cloudEvents.snapshotEvent(ctx, "create", instanceID, id, reason, dryRun, err)
+	}()
 
-	// Create a new snapshot for the instance
-	snapshotID, err := createSnapshot(ctx, client, instance.ID, dryRun)
+	if dryRun {
+		slog.InfoContext(ctx, "Dry run: would create snapshot")
+		return v3.Snapshot{
+			ID:        "dry-run-snapshot-id",
+			CreatedAT: retentionClock.Now(),
+			Instance:  &v3.Instance{ID: instanceID},
+			State:     v3.SnapshotStateReady,
+		}, nil
+	} else {
+		slog.InfoContext(ctx, "Creating snapshot")
+	}
+
+	op, err := client.CreateSnapshot(ctx, instanceID)
 	if err != nil {
-		return err
+		return v3.Snapshot{}, err
 	}
-	fmt.Printf("  Created snapshot: %s\n", snapshotID)
 
-	// Get and manage snapshots based on retention policies
-	snapshots, err := getSnapshots(ctx, client, instance.ID)
+	// Wait for the snapshot operation to complete before looking at the resulting snapshot
+	op, err = operations.wait(ctx, client, op)
 	if err != nil {
-		return err
+		return v3.Snapshot{}, fmt.Errorf("snapshot creation failed: %w", err)
+	}
+	if op.Reference == nil {
+		return v3.Snapshot{}, fmt.Errorf("snapshot creation operation %s did not reference a snapshot", op.ID)
 	}
 
-	// Step 1: Categorize snapshots into their respective retention slots
-	retainedSnapshots := categorizeSnapshots(snapshots, instance.Snapshots)
+	snapshot, err := client.GetSnapshot(ctx, op.Reference.ID)
+	if err != nil {
+		return v3.Snapshot{}, fmt.Errorf("unable to retrieve created snapshot %s: %w", op.Reference.ID, err)
+	}
+	if snapshot.State != v3.SnapshotStateReady {
+		return v3.Snapshot{}, fmt.Errorf("snapshot %s is in state %q, expected %q", snapshot.ID, snapshot.State, v3.SnapshotStateReady)
+	}
 
-	// Step 2: Delete snapshots that were not retained
-	cleanupSnapshots(ctx, client, snapshots, retainedSnapshots, dryRun)
+	if err := state.addSnapshot(snapshot.ID, instanceID, snapshot.CreatedAT); err != nil {
+		return v3.Snapshot{}, fmt.Errorf("unable to record snapshot %s: %w", snapshot.ID, err)
+	}
+	metrics.snapshotCreated(instanceID)
 
-	return nil
+	return *snapshot, nil
 }
 
-// Create a new snapshot for an instance
-func createSnapshot(ctx context.Context, client *v3.Client, instanceID v3.UUID, dryRun bool) (v3.UUID, error) {
-	if dryRun {
-		fmt.Println("Dry run: Would create snapshot.")
-		return "dry-run-snapshot-id", nil
-	} else {
-		fmt.Println("Creating snapshot for", instanceID)
+// Snapshots of the account indexed by instance, listed at most once
+type snapshotIndex struct {
+	mu         sync.Mutex
+	client     *v3.Client
+	byInstance map[v3.UUID][]v3.Snapshot
+}
+
+func newSnapshotIndex(client *v3.Client) *snapshotIndex {
+	return &snapshotIndex{client: client}
+}
+
+// Retrieve existing snapshots for an instance, listing the snapshots of the account on first use
+func (i *snapshotIndex) get(ctx context.Context, instanceID v3.UUID) ([]v3.Snapshot, error) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.byInstance == nil {
+		// The snapshot listing of the Exoscale API is not paginated: all the snapshots of the zone are returned in a
+		// single response, so there are no further pages to iterate over
+		ctx, span := startSpan(ctx, "list snapshots")
+		snapshots, err := i.client.ListSnapshots(ctx)
+		span.finish(err)
+		if err != nil {
+			return nil, err
+		}
+
+		i.byInstance = make(map[v3.UUID][]v3.Snapshot)
+		for _, snapshot := range snapshots.Snapshots {
+			if snapshot.Instance != nil {
+				i.byInstance[snapshot.Instance.ID] = append(i.byInstance[snapshot.Instance.ID], snapshot)
+			}
+		}
 	}
 
-	snapshot, err := client.CreateSnapshot(ctx, instanceID)
-	if err != nil {
-		return "", err
+	return append([]v3.Snapshot{}, i.byInstance[instanceID]...), nil
+}
+
+// Record a snapshot created after the snapshots were listed
+func (i *snapshotIndex) add(snapshot v3.Snapshot) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	// Not listed yet, the snapshot will be part of the listing
+	if i.byInstance == nil || snapshot.Instance == nil {
+		return
 	}
 
-	return snapshot.ID, nil
+	instanceSnapshots := i.byInstance[snapshot.Instance.ID]
+	for _, s := range instanceSnapshots {
+		if s.ID == snapshot.ID {
+			return
+		}
+	}
+	i.byInstance[snapshot.Instance.ID] = append(instanceSnapshots, snapshot)
 }
 
-// Retrieve existing snapshots for an instance
-func getSnapshots(ctx context.Context, client *v3.Client, instanceID v3.UUID) ([]v3.Snapshot, error) {
-	snapshots, err := client.ListSnapshots(ctx)
-	if err != nil {
-		return nil, err
+// Check whether a snapshot comes before another one from the newest to the oldest. Snapshots created at the same time
+// are ordered by ID, so that retention decisions don't depend on the order of the API listings.
+func newerSnapshot(a, b v3.Snapshot) bool {
+	if !a.CreatedAT.Equal(b.CreatedAT) {
+		return a.CreatedAT.After(b.CreatedAT)
+	}
+	return a.ID < b.ID
+}
+
+// Get the most recently created snapshot, if any
+func newestSnapshot(snapshots []v3.Snapshot) *v3.Snapshot {
+	var newest *v3.Snapshot
+	for i := range snapshots {
+		if newest == nil || newerSnapshot(snapshots[i], *newest) {
+			newest = &snapshots[i]
+		}
 	}
+	return newest
+}
+
+// Check whether a snapshot can be restored. Snapshots still being taken, exported or deleted, as well as the ones in
+// error state, can't.
+func snapshotUsable(snapshot v3.Snapshot) bool {
+	return snapshot.State == v3.SnapshotStateReady || snapshot.State == v3.SnapshotStateExported
+}
+
+// Keep only the snapshots subject to retention: usable, not protected, and created by snap-o-matic unless
+// includeUnmanaged is set. Snapshots which aren't usable don't take retention slots, and aren't deleted for not
+// being retained either, so that e.g. snapshots being exported are left alone until they are done.
+func retentionCandidates(snapshots []v3.Snapshot, state *stateStore, includeUnmanaged bool) []v3.Snapshot {
+	return manageableSnapshots(snapshots, state, includeUnmanaged, snapshotUsable)
+}
+
+// Keep only the snapshots in error state which could be deleted, with the same rules as retentionCandidates
+func erroredSnapshots(snapshots []v3.Snapshot, state *stateStore, includeUnmanaged bool) []v3.Snapshot {
+	return manageableSnapshots(snapshots, state, includeUnmanaged, func(s v3.Snapshot) bool { return s.State == v3.SnapshotStateError })
+}
 
-	instanceSnapshots := []v3.Snapshot{}
+// Keep only the snapshots matching a filter which are not protected, and created by snap-o-matic unless
+// includeUnmanaged is set
+func manageableSnapshots(snapshots []v3.Snapshot, state *stateStore, includeUnmanaged bool, filter func(v3.Snapshot) bool) []v3.Snapshot {
+	candidates := []v3.Snapshot{}
+	now := retentionClock.Now()
 
-	for _, snapshot := range snapshots.Snapshots {
-		if snapshot.Instance.ID == instanceID {
-			instanceSnapshots = append(instanceSnapshots, snapshot)
+	for _, snapshot := range snapshots {
+		if !filter(snapshot) || state.isProtected(snapshot.ID) {
+			continue
+		}
+		// Snapshots from the future of a run as of another time are left alone
+		if snapshot.CreatedAT.After(now) {
+			continue
+		}
+		if includeUnmanaged || state.isManaged(snapshot.ID) {
+			candidates = append(candidates, snapshot)
 		}
 	}
 
-	return instanceSnapshots, nil
+	return candidates
+}
+
+// Retention timeframe, either one of the fixed tiers or a custom one
+type retentionTimeframe struct {
+	name     string
+	duration time.Duration               // Nominal length, months and years actually vary
+	length   string                      // Length as shown to users
+	before   func(t time.Time) time.Time // Same point in time one timeframe earlier
+	period   func(t time.Time) string    // Calendar period a point in time belongs to
+	limit    int
+	margin   float64 // Fraction of the length by which retained snapshots may be closer
+}
+
+// Go back a fixed duration
+func fixedLength(d time.Duration) func(time.Time) time.Time {
+	return func(t time.Time) time.Time { return t.Add(-d) }
+}
+
+// Go back a number of calendar months, unless using fixed 30-day months like older versions
+func monthsLength(months int, fixed bool, days int) func(time.Time) time.Time {
+	if fixed {
+		return fixedLength(time.Duration(days) * 24 * time.Hour)
+	}
+	return func(t time.Time) time.Time { return addMonths(t, -months) }
+}
+
+// Add months to a point in time, clamping the day to the end of shorter months (e.g. March 31 minus a month is the
+// last day of February)
+func addMonths(t time.Time, months int) time.Time {
+	first := time.Date(t.Year(), t.Month(), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location()).AddDate(0, months, 0)
+	lastDay := first.AddDate(0, 1, -1).Day()
+	return first.AddDate(0, 0, min(t.Day(), lastDay)-1)
+}
+
+// Get the timeframes of a retention policy, smallest first
+func (r SnapshotRetention) timeframes() []retentionTimeframe {
+	margin := r.Margin.or(marginFactor)
+	monthLength, quarterLength, yearLength := "1 month", "3 months", "1 year"
+	if r.FixedDurations {
+		monthLength, quarterLength, yearLength = "30d", "91d", "365d"
+	}
+	timeframes := []retentionTimeframe{
+		{"hourly", time.Hour, "1h", fixedLength(time.Hour), func(t time.Time) string { return t.Format("2006-01-02T15") }, r.Hourly.Keep, r.Hourly.Margin.or(margin)},
+		{"daily", 24 * time.Hour, "1d", fixedLength(24 * time.Hour), func(t time.Time) string { return t.Format("2006-01-02") }, r.Daily.Keep, r.Daily.Margin.or(margin)},
+		{"weekly", 7 * 24 * time.Hour, "7d", fixedLength(7 * 24 * time.Hour), r.WeekStart.week, r.Weekly.Keep, r.Weekly.Margin.or(margin)},
+		{"monthly", 30 * 24 * time.Hour, monthLength, monthsLength(1, r.FixedDurations, 30), func(t time.Time) string { return t.Format("2006-01") }, r.Monthly.Keep, r.Monthly.Margin.or(margin)},
+		{"quarterly", 91 * 24 * time.Hour, quarterLength, monthsLength(3, r.FixedDurations, 91), quarter, r.Quarterly.Keep, r.Quarterly.Margin.or(margin)},
+		{"yearly", 365 * 24 * time.Hour, yearLength, monthsLength(12, r.FixedDurations, 365), func(t time.Time) string { return t.Format("2006") }, r.Yearly.Keep, r.Yearly.Margin.or(margin)},
+	}
+
+	// Custom tiers are processed along with the fixed ones, smaller timeframes first
+	for _, tier := range r.Tiers {
+		every := time.Duration(tier.Every)
+		timeframes = append(timeframes, retentionTimeframe{
+			name:     "every " + tier.Every.String(),
+			duration: every,
+			length:   tier.Every.String(),
+			before:   fixedLength(every),
+			period: func(t time.Time) string {
+				_, offset := t.Zone()
+				return strconv.FormatInt((t.Unix()+int64(offset))/int64(every.Seconds()), 10)
+			},
+			limit:  tier.Keep,
+			margin: tier.Margin.or(margin),
+		})
+	}
+	sort.SliceStable(timeframes, func(i, j int) bool { return timeframes[i].duration < timeframes[j].duration })
+	return timeframes
 }
 
-// Categorize snapshots into hourly, daily, weekly, etc. slots and return the list of retained snapshots
-func categorizeSnapshots(snapshots []v3.Snapshot, retention SnapshotRetention) map[string]struct{} {
+// Categorize snapshots into hourly, daily, weekly, etc. slots and return the retained snapshots mapped to their slot
+func categorizeSnapshots(ctx context.Context, snapshots []v3.Snapshot, retention SnapshotRetention) map[string]string {
 	// Sort snapshots by creation date (newest first)
 	sort.Slice(snapshots, func(i, j int) bool {
-		return snapshots[i].CreatedAT.After(snapshots[j].CreatedAT)
+		return newerSnapshot(snapshots[i], snapshots[j])
 	})
 
-	// Track retained snapshots by ID
-	retainedSnapshots := make(map[string]struct{})
+	// Track retained snapshots by ID, along with the name of the timeframe which retained them
+	retainedSnapshots := make(map[string]string)
 
-	// Define the timeframes
-	timeframes := []struct {
-		duration time.Duration
-		limit    int
-	}{
-		{time.Hour, retention.Hourly},
-		{24 * time.Hour, retention.Daily},
-		{7 * 24 * time.Hour, retention.Weekly},
-		{30 * 24 * time.Hour, retention.Monthly},
-		{365 * 24 * time.Hour, retention.Yearly},
+	// Iterate through timeframes and retain snapshots
+	for _, timeframe := range retention.timeframes() {
+		if retention.Calendar {
+			retainForCalendarPeriod(ctx, snapshots, timeframe.name, timeframe.period, retention.Timezone.location(), timeframe.limit, retainedSnapshots)
+		} else {
+			retainForTimeframe(ctx, snapshots, timeframe, retainedSnapshots)
+		}
 	}
 
-	// Iterate through timeframes and retain snapshots
-	for _, timeframe := range timeframes {
-		retainForTimeframe(snapshots, timeframe.duration, timeframe.limit, retainedSnapshots)
+	// Whatever the timeframes decided, never let go of snapshots which are too young
+	if retention.MinAge > 0 {
+		for _, snapshot := range snapshots {
+			if _, exists := retainedSnapshots[snapshot.ID.String()]; !exists && retentionClock.Now().Sub(snapshot.CreatedAT) < time.Duration(retention.MinAge) {
+				retainedSnapshots[snapshot.ID.String()] = "min_age"
+				retentionTraceFrom(ctx).add(snapshot, "min_age", "retained", "%s old, younger than the minimum age of %s",
+					formatDuration(retentionClock.Now().Sub(snapshot.CreatedAT)), retention.MinAge)
+				slog.DebugContext(ctx, "Retaining snapshot younger than the minimum age", "snapshot_id", snapshot.ID, "created_at", snapshot.CreatedAT, "min_age", retention.MinAge)
+			}
+		}
+	}
+
+	// Nor of the most recent snapshots, e.g. a burst of manual snapshots taken minutes apart
+	for i, snapshot := range snapshots {
+		if i >= retention.KeepLast {
+			break
+		}
+		if _, exists := retainedSnapshots[snapshot.ID.String()]; !exists {
+			retainedSnapshots[snapshot.ID.String()] = "keep_last"
+			retentionTraceFrom(ctx).add(snapshot, "keep_last", "retained", "one of the %d most recent snapshots", retention.KeepLast)
+			slog.DebugContext(ctx, "Retaining one of the most recent snapshots", "snapshot_id", snapshot.ID, "created_at", snapshot.CreatedAT, "keep_last", retention.KeepLast)
+		}
 	}
 
 	return retainedSnapshots
 }
 
 // Retain snapshots for a specific timeframe and update the map of retained snapshots
-func retainForTimeframe(snapshots []v3.Snapshot, timeframe time.Duration, limit int, retainedSnapshots map[string]struct{}) {
-	margin := time.Duration(float64(timeframe) * marginFactor) // some % margin to account for slight differences in cron run intervals
+func retainForTimeframe(ctx context.Context, snapshots []v3.Snapshot, timeframe retentionTimeframe, retainedSnapshots map[string]string) {
+	name, limit := timeframe.name, timeframe.limit
 	var lastRetained time.Time
 	retainedCount := 0
 
-	fmt.Printf("Retaining %d snapshots for %s\n", limit, timeframe)
+	slog.DebugContext(ctx, "Applying retention timeframe", "timeframe", name, "limit", limit)
+
+	trace := retentionTraceFrom(ctx)
+	trace.start()
+	defer trace.finish(name, limit)
 
 	if limit == 0 {
 		return
@@ -254,48 +1567,255 @@ func retainForTimeframe(snapshots []v3.Snapshot, timeframe time.Duration, limit
 			continue // Skip if this snapshot is already retained
 		}
 
+		// Months and years vary in length, so does the distance between the snapshots they retain
 		created := snapshot.CreatedAT
-		if lastRetained.IsZero() || created.Before(lastRetained.Add(-timeframe+margin)) {
+		length := lastRetained.Sub(timeframe.before(lastRetained))
+		margin := time.Duration(float64(length) * timeframe.margin) // some % margin to account for slight differences in cron run intervals
+		if lastRetained.IsZero() || created.Before(lastRetained.Add(-length+margin)) {
 			// Retain this snapshot if it doesn't violate the minimum distance rule
+			if lastRetained.IsZero() {
+				trace.add(snapshot, name, "retained", "newest snapshot not retained by a smaller timeframe")
+			} else {
+				trace.add(snapshot, name, "retained", "%s before the snapshot retained at %s, at least %s required (%s minus a %s margin), %d of %d",
+					formatDuration(lastRetained.Sub(created)), lastRetained.Format(time.RFC3339), formatDuration(length-margin), formatDuration(length), formatDuration(margin), retainedCount+1, limit)
+			}
 			lastRetained = created
-			retainedSnapshots[snapshot.ID.String()] = struct{}{}
-			fmt.Printf("  Retaining %s (%s)\n", snapshot.ID, snapshot.CreatedAT)
+			retainedSnapshots[snapshot.ID.String()] = name
+			slog.DebugContext(ctx, "Retaining snapshot", "snapshot_id", snapshot.ID, "created_at", snapshot.CreatedAT, "timeframe", name)
 			retainedCount++
 
 			if retainedCount >= limit {
 				break
 			}
+		} else {
+			trace.add(snapshot, name, "too close", "only %s before the snapshot retained at %s, at least %s required (%s minus a %s margin)",
+				formatDuration(lastRetained.Sub(created)), lastRetained.Format(time.RFC3339), formatDuration(length-margin), formatDuration(length), formatDuration(margin))
 		}
 	}
 }
 
-// Cleanup snapshots that were not retained
-func cleanupSnapshots(ctx context.Context, client *v3.Client, snapshots []v3.Snapshot, retainedSnapshots map[string]struct{}, dryRun bool) {
+// Retain the newest snapshot of each calendar period (day, week, ...) and update the map of retained snapshots
+func retainForCalendarPeriod(ctx context.Context, snapshots []v3.Snapshot, name string, period func(time.Time) string, loc *time.Location, limit int, retainedSnapshots map[string]string) {
+	slog.DebugContext(ctx, "Applying retention calendar period", "timeframe", name, "limit", limit, "timezone", loc)
+
+	trace := retentionTraceFrom(ctx)
+	trace.start()
+	defer trace.finish(name, limit)
+
+	if limit == 0 {
+		return
+	}
+
+	seenPeriods := make(map[string]time.Time) // Creation time of the snapshot retained for each period
+
 	for _, snapshot := range snapshots {
-		// If the snapshot was not retained, delete it
-		if _, retained := retainedSnapshots[snapshot.ID.String()]; !retained {
-			deleteSnapshot(ctx, client, snapshot, dryRun)
+		if _, exists := retainedSnapshots[snapshot.ID.String()]; exists {
+			continue // Skip if this snapshot is already retained
+		}
+
+		p := period(snapshot.CreatedAT.In(loc))
+		if newer, seen := seenPeriods[p]; seen {
+			trace.add(snapshot, name, "covered", "the snapshot created at %s is retained for period %s", newer.Format(time.RFC3339), p)
+			continue // A newer snapshot already covers this period
+		}
+
+		trace.add(snapshot, name, "retained", "newest snapshot of period %s (%s), %d of %d", p, loc, len(seenPeriods)+1, limit)
+		seenPeriods[p] = snapshot.CreatedAT
+		retainedSnapshots[snapshot.ID.String()] = name
+		slog.DebugContext(ctx, "Retaining snapshot", "snapshot_id", snapshot.ID, "created_at", snapshot.CreatedAT, "timeframe", name, "period", p)
+
+		if len(seenPeriods) >= limit {
+			break
 		}
 	}
 }
 
-// Delete a snapshot
-func deleteSnapshot(ctx context.Context, client *v3.Client, snapshot v3.Snapshot, dryRun bool) {
-	if dryRun {
-		fmt.Printf("Dry run: Snapshot %s would be deleted\n", snapshot.ID)
-	} else {
-		op, err := client.DeleteSnapshot(ctx, snapshot.ID)
-		if err != nil {
-			fmt.Printf("Error deleting snapshot %s: %s\n", snapshot.ID, err)
+// Format the ISO 8601 week a point in time belongs to
+func isoWeek(t time.Time) string {
+	year, week := t.ISOWeek()
+	return fmt.Sprintf("%d-W%02d", year, week)
+}
+
+// Day calendar weeks start on
+type weekStart string
+
+const (
+	weekStartMonday weekStart = "monday"
+	weekStartSunday weekStart = "sunday"
+)
+
+func (w *weekStart) UnmarshalYAML(value *yaml.Node) error {
+	switch day := weekStart(strings.ToLower(value.Value)); day {
+	case weekStartMonday, weekStartSunday:
+		*w = day
+		return nil
+	default:
+		return fmt.Errorf("line %d: invalid week start %q (expected monday or sunday)", value.Line, value.Value)
+	}
+}
+
+// Format the calendar week a point in time belongs to. Weeks starting on Sunday are named after the ISO week of
+// their Monday.
+func (w weekStart) week(t time.Time) string {
+	if w == weekStartSunday {
+		return isoWeek(t.AddDate(0, 0, 1))
+	}
+	return isoWeek(t)
+}
+
+// Format the calendar quarter a point in time belongs to
+func quarter(t time.Time) string {
+	return fmt.Sprintf("%d-Q%d", t.Year(), (int(t.Month())+2)/3)
+}
+
+// Number of snapshots a run may still delete over all instances
+type deletionBudget struct {
+	mu        sync.Mutex
+	limited   bool
+	remaining int
+}
+
+// Create the deletion budget of a run, 0 means unlimited
+func newDeletionBudget(max int) *deletionBudget {
+	return &deletionBudget{limited: max > 0, remaining: max}
+}
+
+// Reserve deletions, all or nothing, and return whether they fit in the budget
+func (b *deletionBudget) reserve(n int) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !b.limited {
+		return true
+	}
+	if n > b.remaining {
+		return false
+	}
+	b.remaining -= n
+	return true
+}
+
+// Check whether a snapshot which is not retained is due for deletion, and get when it is
+func deletionDue(state *stateStore, id v3.UUID, gracePeriod time.Duration, now time.Time) (bool, time.Time) {
+	if gracePeriod <= 0 {
+		return true, now
+	}
+	markedAt, pending := state.pendingDeletionSince(id)
+	if !pending {
+		markedAt = now
+	}
+	due := markedAt.Add(gracePeriod)
+	return !now.Before(due), due
+}
+
+// Get the snapshots which are not retained and due for deletion. With a grace period, the other snapshots which are
+// not retained are marked as pending deletion, and the retained ones are rescued from a pending deletion.
+func dueForDeletion(ctx context.Context, state *stateStore, snapshots []v3.Snapshot, retainedSnapshots map[string]string, gracePeriod time.Duration, dryRun bool) ([]v3.Snapshot, error) {
+	now := retentionClock.Now()
+	due := []v3.Snapshot{}
+
+	for _, snapshot := range snapshots {
+		_, retained := retainedSnapshots[snapshot.ID.String()]
+		if gracePeriod <= 0 {
+			if !retained {
+				due = append(due, snapshot)
+			}
+			continue
+		}
+
+		if retained {
+			if _, pending := state.pendingDeletionSince(snapshot.ID); pending && !dryRun {
+				slog.InfoContext(ctx, "Snapshot is retained again, no longer pending deletion", "snapshot_id", snapshot.ID)
+				if err := state.unmarkPendingDeletion(snapshot.ID); err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		if isDue, at := deletionDue(state, snapshot.ID, gracePeriod, now); isDue {
+			due = append(due, snapshot)
 		} else {
-			_, err = client.Wait(ctx, op, v3.OperationStateSuccess)
-			if err != nil {
-				fmt.Printf("Error deleting snapshot: %s\n", err)
-			} else {
-				fmt.Printf("Deleted snapshot: %s\n", snapshot.ID)
+			slog.InfoContext(ctx, "Snapshot pending deletion", "snapshot_id", snapshot.ID, "delete_after", at)
+			if !dryRun {
+				if err := state.markPendingDeletion(snapshot.ID); err != nil {
+					return nil, err
+				}
 			}
 		}
 	}
+
+	return due, nil
+}
+
+// Delete snapshots for the given reason, up to the given number at once (4 if zero), and return the number of deleted
+// snapshots and failed deletions
+func cleanupSnapshots(ctx context.Context, client *v3.Client, state *stateStore, snapshots []v3.Snapshot, reason string, concurrency int, dryRun bool) (deleted, failed int) {
+	if concurrency <= 0 {
+		concurrency = defaultDeleteConcurrency
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	workers := make(chan struct{}, concurrency)
+	for _, snapshot := range snapshots {
+		workers <- struct{}{}
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-workers
+				wg.Done()
+			}()
+
+			ok := deleteSnapshot(ctx, client, state, snapshot, reason, dryRun)
+			mu.Lock()
+			defer mu.Unlock()
+			if ok {
+				deleted++
+			} else {
+				failed++
+			}
+		}()
+	}
+	wg.Wait()
+
+	return deleted, failed
+}
+
+// Delete a snapshot, return whether it succeeded. The reason ends up in the audit log.
+func deleteSnapshot(ctx context.Context, client *v3.Client, state *stateStore, snapshot v3.Snapshot, reason string, dryRun bool) bool {
+	ctx = withLogAttrs(ctx, "snapshot_id", snapshot.ID)
+	ctx, span := startSpan(ctx, "delete snapshot", "snapshot_id", snapshot.ID, "reason", reason, "dry_run", dryRun)
+	var err error
+	defer func() { span.finish(err) }()
+
+	if dryRun {
+		slog.InfoContext(ctx, "Dry run: snapshot would be deleted")
+		audit.record(ctx, "delete", snapshot.Instance.ID, snapshot.ID, reason, true, nil)
+		return true
+	}
+
+	op, err := client.DeleteSnapshot(ctx, snapshot.ID)
+	if err == nil {
+		_, err = operations.wait(ctx, client, op)
+	}
+	err = explainAPIError(err, fmt.Sprintf("snapshot %s not found, it may have been deleted already", snapshot.ID))
+	audit.record(ctx, "delete", snapshot.Instance.ID, snapshot.ID, reason, false, err)
+	cloudEvents.snapshotEvent(ctx, "delete", snapshot.Instance.ID, snapshot.ID, reason, false, err)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error deleting snapshot", "err", err)
+		metrics.error(snapshot.Instance.ID)
+		return false
+	}
+
+	slog.InfoContext(ctx, "Deleted snapshot")
+	metrics.snapshotDeleted(snapshot.Instance.ID)
+	if err := state.removeSnapshot(snapshot.ID); err != nil {
+		slog.ErrorContext(ctx, "Error updating state file", "err", err)
+	}
+
+	return true
 }
 
 // Get the API endpoint, prefer env `EXOSCALE_API_ENDPOINT`, fallback to default
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+var testNow = time.Date(2024, 6, 1, 3, 0, 0, 0, time.UTC)
+
+func testSnapshotID(n int) v3.UUID {
+	return v3.UUID(fmt.Sprintf("00000000-0000-0000-0000-%012d", n))
+}
+
+// Two ready snapshots a day for two weeks, taken at the same time, so that only their IDs tell them apart
+func testSnapshots() []v3.Snapshot {
+	var snapshots []v3.Snapshot
+	for day := 0; day < 14; day++ {
+		created := testNow.Add(-time.Duration(day) * 24 * time.Hour)
+		for i := 0; i < 2; i++ {
+			snapshots = append(snapshots, v3.Snapshot{ID: testSnapshotID(day*2 + i), CreatedAT: created, State: v3.SnapshotStateReady})
+		}
+	}
+	return snapshots
+}
+
+func testRetention() SnapshotRetention {
+	return SnapshotRetention{
+		Daily:  timeframeRetention{Keep: 3},
+		Weekly: timeframeRetention{Keep: 2},
+	}
+}
+
+// Shuffle a copy of the snapshots, deterministically
+func shuffledSnapshots(snapshots []v3.Snapshot, seed int64) []v3.Snapshot {
+	shuffled := slices.Clone(snapshots)
+	rand.New(rand.NewSource(seed)).Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return shuffled
+}
+
+func setTestClock(t *testing.T) {
+	t.Helper()
+	previous := retentionClock
+	retentionClock = fixedClock(testNow)
+	t.Cleanup(func() { retentionClock = previous })
+}
+
+func TestNewerSnapshot(t *testing.T) {
+	older := v3.Snapshot{ID: testSnapshotID(1), CreatedAT: testNow.Add(-time.Hour)}
+	newer := v3.Snapshot{ID: testSnapshotID(2), CreatedAT: testNow}
+	lowID := v3.Snapshot{ID: testSnapshotID(3), CreatedAT: testNow}
+	highID := v3.Snapshot{ID: testSnapshotID(4), CreatedAT: testNow}
+
+	tests := []struct {
+		name string
+		a, b v3.Snapshot
+		want bool
+	}{
+		{"newer first", newer, older, true},
+		{"older last", older, newer, false},
+		{"equal times, lower ID first", lowID, highID, true},
+		{"equal times, higher ID last", highID, lowID, false},
+		{"same snapshot", lowID, lowID, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := newerSnapshot(tt.a, tt.b); got != tt.want {
+				t.Errorf("newerSnapshot(%s, %s) = %v, want %v", tt.a.ID, tt.b.ID, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCategorizeSnapshotsIgnoresInputOrder(t *testing.T) {
+	setTestClock(t)
+	snapshots := testSnapshots()
+	want := categorizeSnapshots(context.Background(), slices.Clone(snapshots), testRetention())
+
+	// Of two snapshots taken at the same time, the daily timeframe retains the one with the lower ID
+	for day := 0; day < 3; day++ {
+		if bucket := want[testSnapshotID(day*2).String()]; bucket != "daily" {
+			t.Errorf("snapshot %s of day %d retained by %q, want daily", testSnapshotID(day*2), day, bucket)
+		}
+		if bucket := want[testSnapshotID(day*2+1).String()]; bucket == "daily" {
+			t.Errorf("snapshot %s of day %d retained by daily, want the one with the lower ID", testSnapshotID(day*2+1), day)
+		}
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		if got := categorizeSnapshots(context.Background(), shuffledSnapshots(snapshots, seed), testRetention()); !reflect.DeepEqual(got, want) {
+			t.Fatalf("seed %d: retained %v, want %v", seed, got, want)
+		}
+	}
+}
+
+func TestPlanSnapshotsIgnoresInputOrder(t *testing.T) {
+	setTestClock(t)
+	state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshots := testSnapshots()
+	for _, snapshot := range snapshots {
+		state.Snapshots[snapshot.ID] = snapshotRecord{CreatedAt: snapshot.CreatedAT}
+	}
+
+	plan := func(snapshots []v3.Snapshot) []plannedAction {
+		retained := categorizeSnapshots(context.Background(), slices.Clone(snapshots), testRetention())
+		return planSnapshots(snapshots, state, testRetention(), retained, false, false, "", 0)
+	}
+	want := plan(snapshots)
+
+	// Newest first, the lower ID first among snapshots taken at the same time
+	for i := 1; i < len(want); i++ {
+		previous, action := want[i-1], want[i]
+		if action.CreatedAt.After(previous.CreatedAt) || action.CreatedAt.Equal(previous.CreatedAt) && action.SnapshotID < previous.SnapshotID {
+			t.Errorf("action %d on %s planned after %s", i, action.SnapshotID, previous.SnapshotID)
+		}
+	}
+
+	for seed := int64(0); seed < 20; seed++ {
+		if got := plan(shuffledSnapshots(snapshots, seed)); !reflect.DeepEqual(got, want) {
+			t.Fatalf("seed %d: planned %v, want %v", seed, got, want)
+		}
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Upper bounds of the run duration histogram buckets, in seconds
+var durationBuckets = []float64{1, 5, 10, 30, 60, 120, 300, 600, 1800, 3600}
+
+// Histogram of observed values
+type histogram struct {
+	counts []uint64 // Per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	if h.counts == nil {
+		h.counts = make([]uint64, len(durationBuckets))
+	}
+	for i, bound := range durationBuckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// Per-instance metrics collected during runs, exported in the Prometheus text format
+type metricsRegistry struct {
+	mu sync.Mutex
+
+	created   map[v3.UUID]float64
+	deleted   map[v3.UUID]float64
+	errors    map[v3.UUID]float64
+	snapshots map[v3.UUID]float64
+	sizes     map[v3.UUID]float64
+	newest    map[v3.UUID]time.Time
+	durations map[v3.UUID]*histogram
+
+	// Outcome of the last run over all instances
+	lastRunID    string
+	lastDuration time.Duration
+	lastFinished time.Time
+	lastSuccess  time.Time
+}
+
+var metrics = newMetricsRegistry()
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		created:   make(map[v3.UUID]float64),
+		deleted:   make(map[v3.UUID]float64),
+		errors:    make(map[v3.UUID]float64),
+		snapshots: make(map[v3.UUID]float64),
+		sizes:     make(map[v3.UUID]float64),
+		newest:    make(map[v3.UUID]time.Time),
+		durations: make(map[v3.UUID]*histogram),
+	}
+}
+
+func (m *metricsRegistry) snapshotCreated(instanceID v3.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.created[instanceID]++
+}
+
+func (m *metricsRegistry) snapshotDeleted(instanceID v3.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.deleted[instanceID]++
+}
+
+func (m *metricsRegistry) error(instanceID v3.UUID) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.errors[instanceID]++
+}
+
+// Record the snapshots remaining for an instance after retention was applied
+func (m *metricsRegistry) setSnapshots(instanceID v3.UUID, snapshots []v3.Snapshot, retainedSnapshots map[string]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	count := 0
+	var size int64
+	var newest time.Time
+	for _, snapshot := range snapshots {
+		if _, retained := retainedSnapshots[snapshot.ID.String()]; !retained {
+			continue
+		}
+		count++
+		size += snapshot.Size
+		if snapshot.CreatedAT.After(newest) {
+			newest = snapshot.CreatedAT
+		}
+	}
+
+	m.snapshots[instanceID] = float64(count)
+	m.sizes[instanceID] = float64(size)
+	if !newest.IsZero() {
+		m.newest[instanceID] = newest
+	}
+}
+
+// Record a snapshot of an instance as its newest one, unless a newer one is known. Used when retention isn't applied,
+// as the snapshots remaining aren't known then.
+func (m *metricsRegistry) setNewest(instanceID v3.UUID, created time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if created.After(m.newest[instanceID]) {
+		m.newest[instanceID] = created
+	}
+}
+
+// Record the duration and outcome of processing an instance
+func (m *metricsRegistry) observeRun(instanceID v3.UUID, duration time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h, ok := m.durations[instanceID]
+	if !ok {
+		h = &histogram{}
+		m.durations[instanceID] = h
+	}
+	h.observe(duration.Seconds())
+
+	if err != nil {
+		m.errors[instanceID]++
+	}
+}
+
+// Record the duration and outcome of a run over all instances
+func (m *metricsRegistry) runFinished(report runReport) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lastRunID = report.RunID
+	m.lastDuration = report.FinishedAt.Sub(report.StartedAt)
+	m.lastFinished = report.FinishedAt
+	if !report.hasFailures() {
+		m.lastSuccess = report.FinishedAt
+	}
+}
+
+// Write all metrics in the Prometheus text exposition format
+func (m *metricsRegistry) write(w io.Writer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := time.Now()
+	newestAge := make(map[v3.UUID]float64, len(m.newest))
+	newestTimestamp := make(map[v3.UUID]float64, len(m.newest))
+	for id, t := range m.newest {
+		newestAge[id] = now.Sub(t).Seconds()
+		newestTimestamp[id] = float64(t.Unix())
+	}
+
+	families := []struct {
+		name, kind, help string
+		values           map[v3.UUID]float64
+	}{
+		{"snapomatic_snapshots_created_total", "counter", "Number of snapshots created.", m.created},
+		{"snapomatic_snapshots_deleted_total", "counter", "Number of snapshots deleted.", m.deleted},
+		{"snapomatic_errors_total", "counter", "Number of errors encountered while processing an instance.", m.errors},
+		{"snapomatic_snapshots", "gauge", "Number of snapshots retained after the last run.", m.snapshots},
+		{"snapomatic_snapshots_size_gib", "gauge", "Size of the snapshots retained after the last run, in GiB.", m.sizes},
+		{"snapomatic_newest_snapshot_timestamp_seconds", "gauge", "Creation time of the newest retained snapshot.", newestTimestamp},
+		{"snapomatic_newest_snapshot_age_seconds", "gauge", "Age of the newest retained snapshot.", newestAge},
+	}
+
+	for _, family := range families {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family.name, family.help, family.name, family.kind); err != nil {
+			return err
+		}
+		for _, id := range sortedInstanceIDs(family.values) {
+			if _, err := fmt.Fprintf(w, "%s{instance_id=%q} %g\n", family.name, id, family.values[id]); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !m.lastFinished.IsZero() {
+		type gauge struct {
+			name, help string
+			value      float64
+		}
+		runFamilies := []gauge{
+			{"snapomatic_last_run_duration_seconds", "Duration of the last run over all instances.", m.lastDuration.Seconds()},
+			{"snapomatic_last_run_timestamp_seconds", "Time the last run finished.", float64(m.lastFinished.Unix())},
+		}
+		if !m.lastSuccess.IsZero() {
+			runFamilies = append(runFamilies, gauge{"snapomatic_last_success_timestamp_seconds", "Time the last run without failures finished.", float64(m.lastSuccess.Unix())})
+		}
+		for _, family := range runFamilies {
+			if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %g\n", family.name, family.help, family.name, family.name, family.value); err != nil {
+				return err
+			}
+		}
+		const info = "snapomatic_last_run_info"
+		if _, err := fmt.Fprintf(w, "# HELP %s ID of the last run, to correlate the metrics with its logs.\n# TYPE %s gauge\n%s{run_id=%q} 1\n", info, info, info, m.lastRunID); err != nil {
+			return err
+		}
+	}
+
+	const name = "snapomatic_run_duration_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Duration of processing an instance.\n# TYPE %s histogram\n", name, name); err != nil {
+		return err
+	}
+	for _, id := range sortedInstanceIDs(m.durations) {
+		h := m.durations[id]
+		var cumulative uint64
+		for i, bound := range durationBuckets {
+			cumulative += h.counts[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket{instance_id=%q,le=\"%g\"} %d\n", name, id, bound, cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{instance_id=%q,le=\"+Inf\"} %d\n%s_sum{instance_id=%q} %g\n%s_count{instance_id=%q} %d\n",
+			name, id, h.count, name, id, h.sum, name, id, h.count); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Write the metrics to a file suitable for the node_exporter textfile collector
+func (m *metricsRegistry) writeTextfile(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".snap-o-matic-metrics-*")
+	if err != nil {
+		return fmt.Errorf("unable to write metrics file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if err := m.write(tmp); err != nil {
+		tmp.Close()
+		return fmt.Errorf("unable to write metrics file: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("unable to write metrics file: %w", err)
+	}
+	if err := os.Chmod(tmp.Name(), 0o644); err != nil {
+		return fmt.Errorf("unable to write metrics file: %w", err)
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+// Serve the metrics over HTTP on /metrics in the background
+func (m *metricsRegistry) serve(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("unable to listen for metrics requests: %w", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		_ = m.write(w)
+	})
+
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			slog.Error("Error serving metrics", "err", err)
+		}
+	}()
+	slog.Info("Serving metrics", "url", fmt.Sprintf("http://%s/metrics", listener.Addr()))
+
+	return nil
+}
+
+func sortedInstanceIDs[V any](values map[v3.UUID]V) []v3.UUID {
+	ids := make([]v3.UUID, 0, len(values))
+	for id := range values {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
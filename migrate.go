@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Migrations of configuration files, from the version at their index + 1 to the next one. Each one updates the
+// document in place and describes the changes it made. Configuration fragments have no version of their own, they are
+// passed along read-only so that the settings they inherit from the document can be migrated.
+var configMigrations = []func(root *yaml.Node, fragments []*yaml.Node) []string{
+	migrateFixedDurations,
+}
+
+// Current version of the configuration format
+var configVersion = len(configMigrations) + 1
+
+// Version 2 made sliding months, quarters and years calendar ones rather than 30, 91 and 365 days long. Retention
+// policies relying on them keep the fixed durations, including the ones of configuration fragments which inherit the
+// defaults.
+func migrateFixedDurations(root *yaml.Node, fragments []*yaml.Node) []string {
+	changes := []string{}
+	usesCalendarLengths := func(node *yaml.Node) bool {
+		for i := 0; node != nil && node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+			if slices.Contains([]string{"monthly", "quarterly", "yearly"}, node.Content[i].Value) {
+				return true
+			}
+		}
+		return false
+	}
+	anyUsesCalendarLengths := false
+	var walk func(node *yaml.Node)
+	walk = func(node *yaml.Node) {
+		anyUsesCalendarLengths = anyUsesCalendarLengths || usesCalendarLengths(node)
+		for _, child := range node.Content {
+			walk(child)
+		}
+	}
+	walk(root)
+	for _, fragment := range fragments {
+		walk(fragment)
+	}
+	if !anyUsesCalendarLengths {
+		return changes
+	}
+
+	// Retention policies inherit the defaults, except the export and replication ones
+	for _, path := range [][]string{{"defaults", "snapshots"}, {"export", "snapshots"}, {"replication", "snapshots"}} {
+		if path[0] != "defaults" && !usesCalendarLengths(yamlNode(root, path[0], path[1])) {
+			continue
+		}
+		block := ensureMapping(root, path...)
+		if yamlNode(block, "calendar") != nil || yamlNode(block, "fixed_durations") != nil {
+			continue
+		}
+		setMappingValue(block, "fixed_durations", &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: "true"})
+		changes = append(changes, fmt.Sprintf("set %s.%s.fixed_durations to keep 30-day months, 91-day quarters and 365-day years, remove it to use calendar ones", path[0], path[1]))
+	}
+	return changes
+}
+
+// Get the mapping at a path of keys of a YAML document, creating the missing ones
+func ensureMapping(root *yaml.Node, path ...string) *yaml.Node {
+	node := yamlNode(root)
+	for _, key := range path {
+		child := yamlNode(node, key)
+		if child == nil || child.Kind != yaml.MappingNode {
+			child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			setMappingValue(node, key, child)
+		}
+		node = child
+	}
+	return node
+}
+
+// Set the value of a key of a YAML mapping, appending the key if missing
+func setMappingValue(mapping *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			mapping.Content[i+1] = value
+			return
+		}
+	}
+	mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
+
+// Bring a configuration document to the current version of the format, returning the changes made. The fragments
+// merged into it are left as they are.
+func migrateConfig(root *yaml.Node, fragments []*yaml.Node) ([]string, error) {
+	if root.Kind == 0 {
+		*root = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if yamlNode(root).Kind != yaml.MappingNode {
+		return nil, errors.New("the configuration must be a mapping")
+	}
+
+	version := 1 // Configuration files had no version before version 2
+	if node := yamlNode(root, "version"); node != nil {
+		if err := node.Decode(&version); err != nil {
+			return nil, err
+		}
+	}
+	if version > configVersion {
+		return nil, fmt.Errorf("unsupported configuration version %d (expected at most %d)", version, configVersion)
+	}
+	version = max(version, 1)
+
+	changes := []string{}
+	for _, migrate := range configMigrations[version-1:] {
+		changes = append(changes, migrate(root, fragments)...)
+	}
+
+	// The version goes first
+	mapping := yamlNode(root)
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == "version" {
+			mapping.Content = slices.Delete(mapping.Content, i, i+2)
+			break
+		}
+	}
+	mapping.Content = slices.Insert(mapping.Content, 0,
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "version"},
+		&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!int", Value: strconv.Itoa(configVersion)})
+	return changes, nil
+}
+
+// Get the changes migrating a configuration to the current version of the format would make
+func pendingConfigMigrations(data []byte, fragments []*yaml.Node) ([]string, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	return migrateConfig(&root, fragments)
+}
+
+// Warn about configurations of another version of the format
+func warnConfigVersion(ctx context.Context, cfg config) {
+	switch {
+	case cfg.Version > configVersion:
+		slog.WarnContext(ctx, "The configuration file is of a newer version than supported, upgrade snap-o-matic", "version", cfg.Version, "supported_version", configVersion)
+	case len(cfg.pendingMigrations) > 0:
+		slog.WarnContext(ctx, "The configuration file is of an older version, run 'snap-o-matic config migrate' to update it", "version", max(cfg.Version, 1), "changes", cfg.pendingMigrations)
+	}
+}
+
+// Write a configuration document as YAML
+func writeConfigDocument(w io.Writer, root *yaml.Node) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(root); err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// Write a configuration file migrated to the current version of the format to the given file, or stdout if none is
+// set, and report the changes made. Environment variable references are kept as they are, and an existing file is
+// never overwritten. The fragments of the configuration directory, if any, are taken into account but not changed.
+func migrateConfigFile(filename, format, configDir, out string, report io.Writer) error {
+	data, err := readConfigFile(filename, format, false)
+	if err != nil {
+		return err
+	}
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	fragments, err := readConfigFragments(configDir)
+	if err != nil {
+		return err
+	}
+	changes, err := migrateConfig(&root, fragments)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		if err := writeConfigDocument(os.Stdout, &root); err != nil {
+			return err
+		}
+	} else {
+		f, err := os.OpenFile(out, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, os.ErrExist) {
+			return fmt.Errorf("%s already exists, not overwriting it", out)
+		} else if err != nil {
+			return err
+		}
+		if err := writeConfigDocument(f, &root); err != nil {
+			_ = f.Close()
+			return err
+		}
+		if err := f.Close(); err != nil {
+			return err
+		}
+	}
+
+	for _, change := range changes {
+		_, _ = fmt.Fprintf(report, "%s: %s\n", filename, change)
+	}
+	_, _ = fmt.Fprintf(report, "%s: migrated to version %d\n", filename, configVersion)
+	return nil
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"slices"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestMigrateFixedDurations(t *testing.T) {
+	tests := []struct {
+		name      string
+		config    string
+		fragments []string
+		want      []string // Retention policies given fixed_durations
+	}{
+		{
+			name:   "no calendar lengths",
+			config: "instances:\n  - id: a\n    snapshots:\n      daily: 7\n",
+		},
+		{
+			name:   "instance",
+			config: "instances:\n  - id: a\n    snapshots:\n      monthly: 3\n",
+			want:   []string{"defaults"},
+		},
+		{
+			name:   "export",
+			config: "export:\n  snapshots:\n    yearly: 1\n",
+			want:   []string{"defaults", "export"},
+		},
+		{
+			name:   "replication",
+			config: "replication:\n  snapshots:\n    quarterly: 2\nexport:\n  snapshots:\n    daily: 2\n",
+			want:   []string{"defaults", "replication"},
+		},
+		{
+			name:   "calendar defaults",
+			config: "defaults:\n  snapshots:\n    calendar: true\ninstances:\n  - id: a\n    snapshots:\n      monthly: 3\n",
+		},
+		{
+			name:   "already fixed",
+			config: "defaults:\n  snapshots:\n    fixed_durations: false\npolicies:\n  long:\n    yearly: 5\n",
+		},
+		{
+			name:      "fragment",
+			config:    "instances: []\n",
+			fragments: []string{"instances:\n  - id: a\n    snapshots:\n      daily: 7\n", "policies:\n  long:\n    monthly: 12\n"},
+			want:      []string{"defaults"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var root yaml.Node
+			if err := yaml.Unmarshal([]byte(tt.config), &root); err != nil {
+				t.Fatal(err)
+			}
+			fragments := []*yaml.Node{}
+			for _, fragment := range tt.fragments {
+				var node yaml.Node
+				if err := yaml.Unmarshal([]byte(fragment), &node); err != nil {
+					t.Fatal(err)
+				}
+				fragments = append(fragments, &node)
+			}
+
+			changes := migrateFixedDurations(&root, fragments)
+			if len(changes) != len(tt.want) {
+				t.Errorf("changes %q, want %d", changes, len(tt.want))
+			}
+			for _, policy := range []string{"defaults", "export", "replication"} {
+				node := yamlNode(&root, policy, "snapshots", "fixed_durations")
+				if got, want := node != nil && node.Value == "true", slices.Contains(tt.want, policy); got != want {
+					t.Errorf("%s.snapshots.fixed_durations set: %v, want %v", policy, got, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Instance which is never processed, whatever selects it, designated by ID or by labels
+type NeverTouchRule struct {
+	ID       v3.UUID           `yaml:"id"`
+	Selector map[string]string `yaml:"selector"`
+}
+
+// Check that a never_touch entry designates instances in exactly one way
+func validateNeverTouchRule(rule NeverTouchRule) error {
+	if (rule.ID == "") == (rule.Selector == nil) {
+		return errors.New("never_touch entries must define exactly one of id or selector")
+	}
+	return nil
+}
+
+// Check whether an instance is designated by one of the never_touch entries
+func neverTouched(rules []NeverTouchRule, id v3.UUID, labels v3.Labels) bool {
+	for _, rule := range rules {
+		if rule.ID != "" && rule.ID == id || rule.Selector != nil && matchesLabels(labels, rule.Selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// Drop the resolved instances designated by the never_touch entries, listing the instances of their zone for the
+// labels when entries have selectors
+func skipNeverTouched(ctx context.Context, cfg config, instances []InstanceConfig, listAvailable func(v3.Endpoint) ([]v3.ListInstancesResponseInstances, error)) ([]InstanceConfig, error) {
+	if len(cfg.NeverTouch) == 0 {
+		return instances, nil
+	}
+	for _, rule := range cfg.NeverTouch {
+		if err := validateNeverTouchRule(rule); err != nil {
+			return nil, err
+		}
+	}
+
+	needsLabels := false
+	for _, rule := range cfg.NeverTouch {
+		needsLabels = needsLabels || rule.Selector != nil
+	}
+
+	kept := []InstanceConfig{}
+	for _, instance := range instances {
+		var labels v3.Labels
+		if needsLabels {
+			candidates, err := listAvailable(instance.apiEndpoint(cfg.APIEndpoint))
+			if err != nil {
+				return nil, err
+			}
+			for _, candidate := range candidates {
+				if candidate.ID == instance.ID {
+					labels = candidate.Labels
+				}
+			}
+		}
+
+		if neverTouched(cfg.NeverTouch, instance.ID, labels) {
+			slog.WarnContext(ctx, "Skipping instance listed in never_touch", "instance_id", instance.ID)
+			continue
+		}
+		kept = append(kept, instance)
+	}
+	return kept, nil
+}
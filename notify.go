@@ -0,0 +1,213 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Timeout of the HTTP requests sent by notification backends
+const notificationTimeout = 30 * time.Second
+
+// Notification backends informed about the outcome of runs
+type NotificationsConfig struct {
+	Slack      []SlackConfig      `yaml:"slack"`
+	Teams      []TeamsConfig      `yaml:"teams"`
+	GoogleChat []GoogleChatConfig `yaml:"google_chat"`
+	Telegram   []TelegramConfig   `yaml:"telegram"`
+	Ntfy       []NtfyConfig       `yaml:"ntfy"`
+	PagerDuty  []PagerDutyConfig  `yaml:"pagerduty"`
+	Opsgenie   []OpsgenieConfig   `yaml:"opsgenie"`
+	Webhooks   []WebhookConfig    `yaml:"webhooks"`
+	Email      []EmailConfig      `yaml:"email"`
+}
+
+// Settings shared by all notification backends
+type NotifierOptions struct {
+	FailuresOnly bool `yaml:"failures_only"` // Only notify about runs which encountered errors
+}
+
+// Check whether a run should be notified
+func (o NotifierOptions) wants(report runReport) bool {
+	return !o.FailuresOnly || report.hasFailures()
+}
+
+type notifier interface {
+	wants(report runReport) bool
+	notify(ctx context.Context, report runReport) error
+}
+
+// Get all the configured notification backends
+func (c NotificationsConfig) notifiers() []notifier {
+	notifiers := []notifier{}
+	for _, n := range c.Slack {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Teams {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.GoogleChat {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Telegram {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Ntfy {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.PagerDuty {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Opsgenie {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Webhooks {
+		notifiers = append(notifiers, n)
+	}
+	for _, n := range c.Email {
+		notifiers = append(notifiers, n)
+	}
+	return notifiers
+}
+
+// Inform all interested notification backends about the outcome of a run, failing backends are only logged
+func sendNotifications(ctx context.Context, cfg NotificationsConfig, report runReport) {
+	for _, n := range cfg.notifiers() {
+		if !n.wants(report) {
+			continue
+		}
+		if err := n.notify(ctx, report); err != nil {
+			slog.ErrorContext(ctx, "Error sending notification", "err", err)
+		}
+	}
+}
+
+// Slack incoming webhook
+type SlackConfig struct {
+	NotifierOptions `yaml:",inline"`
+	WebhookURL      string `yaml:"webhook_url"`
+}
+
+func (c SlackConfig) notify(ctx context.Context, report runReport) error {
+	if err := postJSON(ctx, c.WebhookURL, map[string]string{"text": report.summary()}); err != nil {
+		return fmt.Errorf("slack: %w", err)
+	}
+	return nil
+}
+
+// Generic webhook receiving the run report as a JSON document
+type WebhookConfig struct {
+	NotifierOptions `yaml:",inline"`
+	URL             string `yaml:"url"`
+	Secret          string `yaml:"secret"`  // Key used to sign the payload with HMAC-SHA256, if set
+	Retries         *int   `yaml:"retries"` // Additional attempts after a failed delivery, defaults to 3
+}
+
+// Delay before the first retry of a failed webhook delivery, doubled after each attempt
+const webhookRetryDelay = time.Second
+
+func (c WebhookConfig) notify(ctx context.Context, report runReport) error {
+	body, err := json.Marshal(struct {
+		runReport
+		Summary string `json:"summary"`
+	}{report, report.summary()})
+	if err != nil {
+		return fmt.Errorf("webhook: %w", err)
+	}
+
+	header := http.Header{}
+	if c.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(c.Secret))
+		mac.Write(body)
+		header.Set("X-Snapomatic-Signature-256", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	retries := 3
+	if c.Retries != nil {
+		retries = *c.Retries
+	}
+	if err := postWithRetries(ctx, "Webhook", c.URL, body, header, retries); err != nil {
+		return fmt.Errorf("webhook %s: %w", c.URL, err)
+	}
+	return nil
+}
+
+// Send a body like post, retrying up to the given number of times after connection errors, 5xx and 429 responses,
+// with an exponential backoff. What is sent names the failed deliveries in the logs.
+func postWithRetries(ctx context.Context, what, url string, body []byte, header http.Header, retries int) error {
+	delay := webhookRetryDelay
+	for attempt := 0; ; attempt++ {
+		err := post(ctx, url, body, header)
+
+		var statusErr *httpStatusError
+		retryable := !errors.As(err, &statusErr) || statusErr.StatusCode >= 500 || statusErr.StatusCode == http.StatusTooManyRequests
+		if err == nil || !retryable || attempt >= retries {
+			return err
+		}
+
+		slog.WarnContext(ctx, what+" delivery failed, retrying", "url", url, "attempt", attempt+1, "err", err)
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+}
+
+// Non-2xx HTTP response
+type httpStatusError struct {
+	StatusCode int
+	Status     string
+}
+
+func (e *httpStatusError) Error() string {
+	return fmt.Sprintf("unexpected response status %q", e.Status)
+}
+
+// Send a JSON document with a POST request, any non-2xx response is an error
+func postJSON(ctx context.Context, url string, payload any) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return post(ctx, url, body, nil)
+}
+
+// Send a body, JSON unless the additional headers set another content type, with a POST request. Any non-2xx response
+// is an error. The request carries the ID of the run in the X-Snapomatic-Run-Id header.
+func post(ctx context.Context, url string, body []byte, header http.Header) error {
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	req.Header.Set("X-Snapomatic-Run-Id", runID(ctx))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	return nil
+}
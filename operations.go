@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Interval at which operations are polled unless configured otherwise, the same as the egoscale one
+const defaultWaitPollInterval = 3 * time.Second
+
+// Waiting for asynchronous API operations, e.g. snapshot creations and deletions
+type operationWaiter struct {
+	pollInterval time.Duration
+	timeout      time.Duration // Maximum time an operation is waited for, none if zero
+}
+
+// Settings of the operation waits, set from the configuration
+var operations = operationWaiter{pollInterval: defaultWaitPollInterval}
+
+// Get the settings of the operation waits of a configuration
+func newOperationWaiter(cfg config) (operationWaiter, error) {
+	w := operationWaiter{pollInterval: time.Duration(cfg.WaitPoll), timeout: time.Duration(cfg.WaitTimeout)}
+	switch {
+	case w.pollInterval == 0:
+		w.pollInterval = defaultWaitPollInterval
+	case w.pollInterval < time.Second:
+		return w, fmt.Errorf("wait_poll_interval %s must be at least 1s", cfg.WaitPoll)
+	}
+	return w, nil
+}
+
+// Wait for an operation to succeed, polling its state at the poll interval for at most the wait timeout
+func (w operationWaiter) wait(ctx context.Context, client *v3.Client, op *v3.Operation) (_ *v3.Operation, err error) {
+	if op == nil {
+		return nil, errors.New("operation is nil")
+	}
+	ctx, span := startSpan(ctx, "wait", "operation_id", op.ID)
+	defer func() { span.finish(err) }()
+	if w.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, w.timeout, fmt.Errorf("wait timeout of %s exceeded for operation %s", formatDuration(w.timeout), op.ID))
+		defer cancel()
+	}
+
+	ticker := time.NewTicker(w.pollInterval)
+	defer ticker.Stop()
+
+	for op.State == v3.OperationStatePending {
+		select {
+		case <-ticker.C:
+			polled, err := client.GetOperation(ctx, op.ID)
+			if err != nil {
+				return nil, err
+			}
+			op = polled
+		case <-ctx.Done():
+			return nil, context.Cause(ctx)
+		}
+	}
+
+	if op.State != v3.OperationStateSuccess {
+		return nil, fmt.Errorf("operation %s %s, reason: %q, message: %q", op.ID, op.State, op.Reason, op.Message)
+	}
+	return op, nil
+}
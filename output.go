@@ -0,0 +1,34 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Write a value in the requested output format: JSON, YAML, or a table written by the given function, which the
+// tabwriter is flushed after
+func writeFormatted(w io.Writer, v any, format string, table func(tw *tabwriter.Writer)) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		return encoder.Encode(v)
+
+	case "table", "":
+		tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+		table(tw)
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unsupported output format %q (expected table, json or yaml)", format)
+	}
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sort"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Bucket of the snapshots which are kept until the deletion grace period is over
+const pendingDeletionBucket = "pending_deletion"
+
+// Action planned for a snapshot
+type plannedAction struct {
+	Action     string    `json:"action" yaml:"action"` // create, keep or delete
+	SnapshotID v3.UUID   `json:"snapshot_id,omitempty" yaml:"snapshot_id,omitempty"`
+	CreatedAt  time.Time `json:"created_at" yaml:"created_at"`
+	Bucket     string    `json:"bucket,omitempty" yaml:"bucket,omitempty"`
+	Reason     string    `json:"reason" yaml:"reason"`
+}
+
+// Actions planned for an instance
+type instancePlan struct {
+	Account    string          `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID v3.UUID         `json:"instance_id" yaml:"instance_id"`
+	Endpoint   v3.Endpoint     `json:"endpoint" yaml:"endpoint"`
+	Actions    []plannedAction `json:"actions" yaml:"actions"`
+	Retention  bool            `json:"retention,omitempty" yaml:"retention,omitempty"` // Whether the actions cover all the snapshots, false e.g. with --snapshot-only
+	Error      string          `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// Changes a run would apply, as emitted by a dry run
+type runPlan struct {
+	RunID     string         `json:"run_id" yaml:"run_id"`
+	CreatedAt time.Time      `json:"created_at" yaml:"created_at"`
+	Instances []instancePlan `json:"instances" yaml:"instances"`
+}
+
+// Get the API endpoint of the zone the planned instance lives in, defaulting to the configured API endpoint
+func (p instancePlan) endpoint(fallback v3.Endpoint) v3.Endpoint {
+	if p.Endpoint == "" {
+		return fallback
+	}
+	return p.Endpoint
+}
+
+// Build the plan of a (dry) run from its report
+func newRunPlan(report runReport) runPlan {
+	plan := runPlan{
+		RunID:     report.RunID,
+		CreatedAt: report.StartedAt,
+		Instances: []instancePlan{},
+	}
+	for _, result := range report.Results {
+		instance := instancePlan{
+			Account:    result.Account,
+			InstanceID: result.InstanceID,
+			Endpoint:   result.Endpoint,
+			Actions:    result.Actions,
+			Retention:  result.RetentionPlanned,
+		}
+		if instance.Actions == nil {
+			instance.Actions = []plannedAction{}
+		}
+		if result.Err != nil {
+			instance.Error = result.Err.Error()
+		}
+		plan.Instances = append(plan.Instances, instance)
+	}
+	return plan
+}
+
+// Describe what happens to each snapshot of an instance, newest first. The created snapshot, if any, is reported
+// as a create action rather than a keep or delete one.
+func planSnapshots(snapshots []v3.Snapshot, state *stateStore, retention SnapshotRetention, retainedSnapshots map[string]string, includeUnmanaged, deleteErrored bool, createdID v3.UUID, gracePeriod time.Duration) []plannedAction {
+	now := retentionClock.Now()
+
+	// Sliding timeframes retain snapshots which are a bit closer than the timeframe, by its margin
+	spacing := make(map[string]string)
+	if !retention.Calendar {
+		for _, timeframe := range retention.timeframes() {
+			spacing[timeframe.name] = fmt.Sprintf(" (snapshots %s apart, minus a %g%% margin)", timeframe.length, timeframe.margin*100)
+		}
+	}
+
+	snapshots = append([]v3.Snapshot(nil), snapshots...)
+	sort.Slice(snapshots, func(i, j int) bool { return newerSnapshot(snapshots[i], snapshots[j]) })
+
+	actions := []plannedAction{}
+	for _, snapshot := range snapshots {
+		action := plannedAction{SnapshotID: snapshot.ID, CreatedAt: snapshot.CreatedAT}
+		bucket, retained := retainedSnapshots[snapshot.ID.String()]
+
+		switch {
+		case snapshot.ID == createdID:
+			action = plannedAction{Action: "create", CreatedAt: snapshot.CreatedAT, Bucket: bucket, Reason: "new snapshot"}
+			if !retained {
+				action.Reason = "new snapshot, not retained by any timeframe"
+			}
+		case bucket == yearlyArchive:
+			action.Action, action.Bucket, action.Reason = "keep", bucket, "first snapshot of the year, archived permanently"
+		case state.isProtected(snapshot.ID):
+			action.Action, action.Reason = "keep", "protected"
+			if reason := state.protectionReason(snapshot.ID); reason != "" {
+				action.Bucket = reason
+			}
+		case snapshot.CreatedAT.After(now):
+			action.Action, action.Reason = "keep", "created after the time of the run"
+		case !includeUnmanaged && !state.isManaged(snapshot.ID):
+			action.Action, action.Reason = "keep", "not created by snap-o-matic"
+		case snapshot.State == v3.SnapshotStateError && deleteErrored:
+			action.Action, action.Reason = "delete", "snapshot in error state"
+		case !snapshotUsable(snapshot):
+			action.Action, action.Reason = "keep", fmt.Sprintf("in state %s, not counted by the retention policy", snapshot.State)
+		case bucket == "min_age":
+			action.Action, action.Bucket, action.Reason = "keep", bucket, "younger than the minimum age"
+		case bucket == "keep_last":
+			action.Action, action.Bucket, action.Reason = "keep", bucket, fmt.Sprintf("one of the %d most recent snapshots", retention.KeepLast)
+		case retained:
+			action.Action, action.Bucket, action.Reason = "keep", bucket, fmt.Sprintf("retained by the %s timeframe%s", bucket, spacing[bucket])
+		default:
+			action.Action, action.Reason = "delete", "not retained by any timeframe"
+			if due, at := deletionDue(state, snapshot.ID, gracePeriod, now); !due {
+				action.Action, action.Bucket = "keep", pendingDeletionBucket
+				action.Reason = "not retained by any timeframe, pending deletion until " + at.Format(time.RFC3339)
+			}
+		}
+
+		actions = append(actions, action)
+	}
+	return actions
+}
+
+// Write a plan in the requested output format
+func writePlan(w io.Writer, plan runPlan, format string) error {
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+
+	case "yaml":
+		encoder := yaml.NewEncoder(w)
+		defer encoder.Close()
+		return encoder.Encode(plan)
+
+	default:
+		return fmt.Errorf("unsupported plan output format %q (expected json or yaml)", format)
+	}
+}
+
+// Plan the changes of a run and write them as JSON to the plan file, or stdout if none is set
+func writePlanFile(ctx context.Context, clients accountClients, state *stateStore, cfg config) error {
+	cfg.DryRun = true
+	report := runReport{RunID: newRunID(), DryRun: true, StartedAt: time.Now()}
+	report.Results = processInstances(withLogAttrs(ctx, "run_id", report.RunID), clients, state, newDeletionBudget(cfg.MaxDeletions), cfg, cfg.Instances)
+	plan := newRunPlan(report)
+
+	if cfg.PlanFile == "" {
+		return writePlan(os.Stdout, plan, "json")
+	}
+
+	f, err := os.Create(cfg.PlanFile)
+	if err != nil {
+		return err
+	}
+	if err := writePlan(f, plan, "json"); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Wrote plan", "plan_file", cfg.PlanFile, "instances", len(plan.Instances))
+	return nil
+}
+
+// Apply a plan file, refusing to do so if the snapshots of its instances changed since it was created
+func applyPlanFile(ctx context.Context, clients accountClients, state *stateStore, cfg config, path string) (runReport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return runReport{}, err
+	}
+	var plan runPlan
+	if err := json.Unmarshal(data, &plan); err != nil {
+		return runReport{}, fmt.Errorf("unable to parse plan file %s: %w", path, err)
+	}
+
+	indexes := newSnapshotIndexes(clients)
+	if err := checkPlanDrift(ctx, indexes, state, cfg, plan); err != nil {
+		return runReport{}, err
+	}
+
+	cfg.DryRun = false
+	return run(ctx, cfg, func(ctx context.Context) []instanceResult {
+		results := make([]instanceResult, 0, len(plan.Instances))
+		for _, instance := range plan.Instances {
+			if err := notStartedError(ctx, instance.Account); err != nil {
+				results = append(results, instanceResult{InstanceID: instance.InstanceID, Account: instance.Account, Err: err})
+				continue
+			}
+			index, _ := indexes.get(instance.Account, instance.endpoint(cfg.APIEndpoint)) // Checked along with the drift
+			instanceCtx, cancel := instanceContext(ctx, cfg)
+			result := applyInstancePlan(instanceCtx, index.client, state, instance)
+			result.Err = explainAPIError(withCancelCause(instanceCtx, result.Err), fmt.Sprintf("instance %s not found in %s, check its id and zone", instance.InstanceID, instance.endpoint(cfg.APIEndpoint)))
+			cancel()
+			if result.Err != nil {
+				slog.ErrorContext(ctx, "Error processing instance", "instance_id", instance.InstanceID, "err", result.Err)
+			}
+			results = append(results, result)
+		}
+		return results
+	}), nil
+}
+
+// Check that the snapshots of the planned instances are still the ones the plan was created from
+func checkPlanDrift(ctx context.Context, indexes *snapshotIndexes, state *stateStore, cfg config, plan runPlan) error {
+	for _, instance := range plan.Instances {
+		if instance.Error != "" {
+			return fmt.Errorf("plan for instance %s failed: %s", instance.InstanceID, instance.Error)
+		}
+
+		index, err := indexes.get(instance.Account, instance.endpoint(cfg.APIEndpoint))
+		if err != nil {
+			return fmt.Errorf("instance %s: %w", instance.InstanceID, err)
+		}
+		snapshots, err := index.get(ctx, instance.InstanceID)
+		if err != nil {
+			return err
+		}
+
+		current := map[v3.UUID]bool{}
+		for _, snapshot := range snapshots {
+			current[snapshot.ID] = true
+		}
+
+		planned := 0
+		for _, action := range instance.Actions {
+			switch action.Action {
+			case "create":
+				continue
+			case "keep", "delete":
+			default:
+				return fmt.Errorf("instance %s: unknown planned action %q", instance.InstanceID, action.Action)
+			}
+			planned++
+			if !current[action.SnapshotID] {
+				return fmt.Errorf("instance %s: snapshot %s no longer exists, the plan is out of date", instance.InstanceID, action.SnapshotID)
+			}
+			if action.Action == "delete" && state.isProtected(action.SnapshotID) {
+				return fmt.Errorf("instance %s: snapshot %s was protected since the plan was created", instance.InstanceID, action.SnapshotID)
+			}
+		}
+		// Plans without retention, e.g. of stopped instances or with --snapshot-only, leave the snapshots alone. Plans of
+		// older versions don't tell, their keep and delete actions do.
+		if (instance.Retention || planned > 0) && planned != len(current) {
+			return fmt.Errorf("instance %s: %d snapshot(s) were created since the plan was created, the plan is out of date", instance.InstanceID, len(current)-planned)
+		}
+	}
+	return nil
+}
+
+// Create and delete the snapshots of an instance as planned
+func applyInstancePlan(ctx context.Context, client *v3.Client, state *stateStore, plan instancePlan) (result instanceResult) {
+	ctx = withLogAttrs(ctx, "instance_id", plan.InstanceID)
+	if plan.Account != "" {
+		ctx = withLogAttrs(ctx, "account", plan.Account)
+	}
+	slog.InfoContext(ctx, "Applying plan to instance")
+
+	result.InstanceID = plan.InstanceID
+	result.Account = plan.Account
+	result.Endpoint = plan.Endpoint
+
+	start := time.Now()
+	defer func() { metrics.observeRun(plan.InstanceID, time.Since(start), result.Err) }()
+
+	for _, action := range plan.Actions {
+		if action.Action != "create" {
+			continue
+		}
+		snapshot, err := createSnapshot(ctx, client, state, plan.InstanceID, action.Reason, false)
+		if err != nil {
+			result.Err = err
+			return result
+		}
+		slog.InfoContext(ctx, "Created snapshot", "snapshot_id", snapshot.ID)
+		result.Created++
+		action.SnapshotID = snapshot.ID
+		result.Actions = append(result.Actions, action)
+		if action.Bucket == yearlyArchive {
+			if err := archiveSnapshot(ctx, state, plan.InstanceID, snapshot.ID); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+	}
+
+	for _, action := range plan.Actions {
+		// Start the grace period of the snapshots the plan keeps until then, and archive snapshots, as a run would
+		switch {
+		case action.Action == "keep" && action.Bucket == pendingDeletionBucket:
+			if err := state.markPendingDeletion(action.SnapshotID); err != nil {
+				result.Err = err
+				return result
+			}
+		case action.Action == "keep" && action.Bucket == yearlyArchive && !state.isProtected(action.SnapshotID):
+			if err := archiveSnapshot(ctx, state, plan.InstanceID, action.SnapshotID); err != nil {
+				result.Err = err
+				return result
+			}
+		}
+		if action.Action != "delete" {
+			continue
+		}
+		snapshot := v3.Snapshot{ID: action.SnapshotID, CreatedAT: action.CreatedAt, Instance: &v3.Instance{ID: plan.InstanceID}}
+		if deleteSnapshot(ctx, client, state, snapshot, action.Reason, false) {
+			result.Deleted++
+		} else {
+			result.DeleteErrors++
+		}
+		result.Actions = append(result.Actions, action)
+	}
+
+	return result
+}
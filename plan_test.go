@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+func TestCheckPlanDrift(t *testing.T) {
+	const endpoint = v3.Endpoint("https://api-ch-gva-2.exoscale.com/v2")
+	instanceID := v3.UUID("11111111-1111-1111-1111-111111111111")
+	snapshot := func(n int) v3.Snapshot {
+		return v3.Snapshot{ID: testSnapshotID(n), CreatedAT: testNow, Instance: &v3.Instance{ID: instanceID}}
+	}
+	action := func(name string, n int) plannedAction {
+		return plannedAction{Action: name, SnapshotID: testSnapshotID(n), CreatedAt: testNow}
+	}
+
+	tests := []struct {
+		name      string
+		snapshots []v3.Snapshot
+		plan      instancePlan
+		protected v3.UUID
+		wantErr   string // Empty if the plan is up to date
+	}{
+		{
+			name:      "up to date",
+			snapshots: []v3.Snapshot{snapshot(1), snapshot(2)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{{Action: "create"}, action("keep", 1), action("delete", 2)}},
+		},
+		{
+			name:      "snapshot created since",
+			snapshots: []v3.Snapshot{snapshot(1), snapshot(2), snapshot(3)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{action("keep", 1), action("delete", 2)}},
+			wantErr:   "1 snapshot(s) were created since the plan was created",
+		},
+		{
+			name:      "first snapshot created since",
+			snapshots: []v3.Snapshot{snapshot(1)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{}},
+			wantErr:   "1 snapshot(s) were created since the plan was created",
+		},
+		{
+			name:      "snapshot deleted since",
+			snapshots: []v3.Snapshot{snapshot(1)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{action("keep", 1), action("delete", 2)}},
+			wantErr:   "no longer exists",
+		},
+		{
+			name:      "snapshot protected since",
+			snapshots: []v3.Snapshot{snapshot(1), snapshot(2)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{action("keep", 1), action("delete", 2)}},
+			protected: testSnapshotID(2),
+			wantErr:   "was protected since the plan was created",
+		},
+		{
+			name:      "snapshot only",
+			snapshots: []v3.Snapshot{snapshot(1), snapshot(2)},
+			plan:      instancePlan{Actions: []plannedAction{{Action: "create"}}},
+		},
+		{
+			name:      "skipped stopped instance",
+			snapshots: []v3.Snapshot{snapshot(1)},
+			plan:      instancePlan{Actions: []plannedAction{}},
+		},
+		{
+			name:      "plan of an older version",
+			snapshots: []v3.Snapshot{snapshot(1), snapshot(2)},
+			plan:      instancePlan{Actions: []plannedAction{action("keep", 1)}},
+			wantErr:   "1 snapshot(s) were created since the plan was created",
+		},
+		{
+			name:    "planning failed",
+			plan:    instancePlan{Error: "unable to get instance"},
+			wantErr: "plan for instance 11111111-1111-1111-1111-111111111111 failed",
+		},
+		{
+			name:      "unknown action",
+			snapshots: []v3.Snapshot{snapshot(1)},
+			plan:      instancePlan{Retention: true, Actions: []plannedAction{action("archive", 1)}},
+			wantErr:   `unknown planned action "archive"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			state, err := loadState(filepath.Join(t.TempDir(), "state.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.protected != "" {
+				if err := state.setProtected(tt.protected, true); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			// Snapshots already listed, so that no API request is made
+			indexes := newSnapshotIndexes(accountClients{})
+			indexes.indexes[snapshotIndexKey{"", endpoint}] = &snapshotIndex{byInstance: map[v3.UUID][]v3.Snapshot{instanceID: tt.snapshots}}
+
+			tt.plan.InstanceID, tt.plan.Endpoint = instanceID, endpoint
+			err = checkPlanDrift(context.Background(), indexes, state, config{}, runPlan{Instances: []instancePlan{tt.plan}})
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("unexpected error: %v", err)
+			case tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)):
+				t.Errorf("error %v, want one containing %q", err, tt.wantErr)
+			}
+		})
+	}
+}
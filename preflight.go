@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Check of the instances of a run against the API before anything is done
+const (
+	preflightOff    = ""       // No check
+	preflightReport = "report" // Missing and stopped instances are logged, all instances are processed
+	preflightSkip   = "skip"   // Missing instances fail, and stopped ones are skipped or fail as per when_stopped
+	preflightAbort  = "abort"  // The run is aborted if any instance is missing
+)
+
+// Check up front that the instances of a run exist and are running, returning the instances to process and the
+// results of the other ones: failed when missing, skipped or failed when stopped
+func preflightInstances(ctx context.Context, clients accountClients, cfg config, instances []InstanceConfig) ([]InstanceConfig, []instanceResult, error) {
+	switch cfg.Preflight {
+	case preflightOff:
+		return instances, nil, nil
+	case preflightReport, preflightSkip, preflightAbort:
+	default:
+		return nil, nil, fmt.Errorf("invalid preflight %q (expected report, skip or abort)", cfg.Preflight)
+	}
+
+	// Instances are listed once per account and zone
+	type zoneKey struct {
+		account  string
+		endpoint v3.Endpoint
+	}
+	states := make(map[zoneKey]map[v3.UUID]v3.InstanceState)
+	process := []InstanceConfig{}
+	results := []instanceResult{}
+	missing := 0
+	for _, instance := range instances {
+		key := zoneKey{instance.Account, instance.apiEndpoint(cfg.APIEndpoint)}
+		if _, ok := states[key]; !ok {
+			client, err := clients.get(key.account)
+			if err != nil {
+				return nil, nil, err
+			}
+			resp, err := client.WithEndpoint(key.endpoint).ListInstances(ctx)
+			if err != nil {
+				return nil, nil, explainAPIError(fmt.Errorf("preflight: unable to list instances: %w", err), "")
+			}
+			states[key] = make(map[v3.UUID]v3.InstanceState)
+			for _, candidate := range resp.Instances {
+				states[key][candidate.ID] = candidate.State
+			}
+		}
+
+		ctx := withLogAttrs(ctx, "instance_id", instance.ID)
+		state, exists := states[key][instance.ID]
+		switch {
+		case !exists:
+			missing++
+			slog.ErrorContext(ctx, "Instance not found", "endpoint", key.endpoint)
+			if cfg.Preflight == preflightSkip {
+				err := fmt.Errorf("not processed: instance %s not found in %s, check its id and zone", instance.ID, key.endpoint)
+				results = append(results, instanceResult{InstanceID: instance.ID, Account: instance.Account, Endpoint: key.endpoint, Err: err})
+				continue
+			}
+		case state != v3.InstanceStateRunning:
+			slog.WarnContext(ctx, "Instance is not running", "state", state)
+			whenStopped, err := instance.whenStopped(cfg)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch {
+			case cfg.Preflight != preflightSkip || state != v3.InstanceStateStopped:
+			case whenStopped == whenStoppedSkip:
+				slog.InfoContext(ctx, "Skipping stopped instance")
+				results = append(results, instanceResult{InstanceID: instance.ID, Account: instance.Account, Endpoint: key.endpoint, Skipped: "instance is stopped"})
+				continue
+			case whenStopped == whenStoppedError:
+				err := errors.New("not processed: instance is stopped (when_stopped: error)")
+				results = append(results, instanceResult{InstanceID: instance.ID, Account: instance.Account, Endpoint: key.endpoint, Err: err})
+				continue
+			}
+		}
+		process = append(process, instance)
+	}
+
+	if missing > 0 && cfg.Preflight == preflightAbort {
+		return nil, nil, fmt.Errorf("preflight: aborting the run, %d configured instance(s) not found", missing)
+	}
+	slog.InfoContext(ctx, "Checked the instances of the run", "instances", len(instances), "missing", missing, "processed", len(process))
+	return process, results, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Protect snapshots from deletion by retention policies, or remove their protection. Snapshots are looked up in all
+// accounts, in the zones of the given API endpoints.
+func protectSnapshots(ctx context.Context, clients accountClients, endpoints []v3.Endpoint, state *stateStore, ids []string, protect bool) error {
+	if len(ids) == 0 {
+		return errors.New("no snapshot ID given")
+	}
+
+	for _, arg := range ids {
+		id, err := v3.ParseUUID(arg)
+		if err != nil {
+			return fmt.Errorf("invalid snapshot ID %q: %w", arg, err)
+		}
+
+		// Make sure the snapshot exists, unprotecting a snapshot which is already gone is fine though
+		if protect {
+			if _, _, _, err := findSnapshot(ctx, clients, endpoints, id); err != nil {
+				return fmt.Errorf("unable to retrieve snapshot %s: %w", id, err)
+			}
+		}
+
+		if err := state.setProtected(id, protect); err != nil {
+			return err
+		}
+		slog.InfoContext(ctx, "Updated snapshot protection", "snapshot_id", id, "protected", protect)
+	}
+
+	return nil
+}
+
+// Find a snapshot in one of the accounts, in one of the zones of the given API endpoints, and return it along with
+// the account and API endpoint it was found with
+func findSnapshot(ctx context.Context, clients accountClients, endpoints []v3.Endpoint, id v3.UUID) (*v3.Snapshot, string, v3.Endpoint, error) {
+	for _, account := range clients.names() {
+		for _, endpoint := range endpoints {
+			snapshot, err := clients[account].WithEndpoint(endpoint).GetSnapshot(ctx, id)
+			if err == nil {
+				return snapshot, account, endpoint, nil
+			}
+			if !errors.Is(err, v3.ErrNotFound) {
+				return nil, "", "", err
+			}
+		}
+	}
+	return nil, "", "", v3.ErrNotFound
+}
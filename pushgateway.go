@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Job label of the metrics pushed to the Pushgateway
+const pushgatewayJob = "snap-o-matic"
+
+// Push the metrics of a run to a Prometheus Pushgateway, replacing the ones previously pushed by this host. Cron
+// runs don't live long enough to be scraped.
+func pushMetrics(ctx context.Context, pushgatewayURL string) error {
+	host, err := os.Hostname()
+	if err != nil {
+		return fmt.Errorf("unable to push metrics: %w", err)
+	}
+
+	var body bytes.Buffer
+	if err := metrics.write(&body); err != nil {
+		return fmt.Errorf("unable to push metrics: %w", err)
+	}
+
+	u := strings.TrimSuffix(pushgatewayURL, "/") + "/metrics/job/" + url.PathEscape(pushgatewayJob) + "/instance/" + url.PathEscape(host)
+
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, &body)
+	if err != nil {
+		return fmt.Errorf("unable to push metrics: %w", err)
+	}
+	req.Header.Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("unable to push metrics: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unable to push metrics: unexpected response status %q", resp.Status)
+	}
+	return nil
+}
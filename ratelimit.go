@@ -0,0 +1,138 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Retries of the API requests rejected with 429 Too Many Requests, unless configured otherwise
+const defaultRateLimitRetries = 5
+
+// Longest delay before retrying a rate limited API request
+const maxRateLimitDelay = time.Minute
+
+// Client-side limit of the rate of the API requests of each account
+type RateLimitConfig struct {
+	RequestsPerSecond float64 `yaml:"requests_per_second"` // No limit if zero
+	Burst             int     `yaml:"burst"`               // Requests sent at once after a pause, defaults to requests_per_second
+	MaxRetries        *int    `yaml:"max_retries"`         // Retries of the requests rejected with 429, defaults to 5
+}
+
+// Token bucket limiting the rate of requests
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // Tokens added per second
+	burst  float64 // Maximum number of tokens
+	tokens float64 // Negative once tokens are reserved ahead
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst <= 0 {
+		burst = int(math.Ceil(rate))
+	}
+	return &tokenBucket{rate: rate, burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Take a token, waiting until one is available
+func (b *tokenBucket) wait(ctx context.Context) error {
+	b.mu.Lock()
+	now := time.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens--
+	delay := time.Duration(-b.tokens / b.rate * float64(time.Second))
+	b.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// Transport limiting the rate of the API requests and retrying the ones rejected with 429 Too Many Requests
+type rateLimitedTransport struct {
+	limiter *tokenBucket // No limit if nil
+	retries int
+	next    http.RoundTripper
+}
+
+func newRateLimitedTransport(cfg RateLimitConfig, next http.RoundTripper) *rateLimitedTransport {
+	t := &rateLimitedTransport{retries: defaultRateLimitRetries, next: next}
+	if cfg.RequestsPerSecond > 0 {
+		t.limiter = newTokenBucket(cfg.RequestsPerSecond, cfg.Burst)
+	}
+	if cfg.MaxRetries != nil {
+		t.retries = *cfg.MaxRetries
+	}
+	return t
+}
+
+func (t *rateLimitedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if t.limiter != nil {
+			if err := t.limiter.wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+
+		resp, err := t.next.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || attempt >= t.retries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+
+		delay := rateLimitDelay(resp.Header, attempt)
+		_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+		resp.Body.Close()
+		slog.WarnContext(ctx, "API rate limit exceeded, retrying", "method", req.Method, "path", req.URL.Path, "attempt", attempt+1, "delay", delay)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, context.Cause(ctx)
+		}
+
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, err
+			}
+			req = req.Clone(ctx)
+			req.Body = body
+		}
+	}
+}
+
+// Get the delay before retrying a rate limited request: the one of the Retry-After or RateLimit-Reset header, or an
+// exponential backoff from one second
+func rateLimitDelay(header http.Header, attempt int) time.Duration {
+	delay := time.Second << min(attempt, 6)
+	for _, name := range []string{"Retry-After", "RateLimit-Reset", "X-RateLimit-Reset"} {
+		value := header.Get(name)
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			delay = time.Duration(seconds) * time.Second
+			break
+		}
+		if at, err := http.ParseTime(value); err == nil && name == "Retry-After" {
+			delay = time.Until(at)
+			break
+		}
+	}
+	return min(max(delay, 0), maxRateLimitDelay)
+}
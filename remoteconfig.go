@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/exoscale/egoscale/v3/credentials"
+)
+
+// Time allowed to fetch a remote configuration file
+const remoteConfigTimeout = 30 * time.Second
+
+// Credentials remote configuration files are fetched from object storage with, the ones of the command line or
+// environment
+var configCredentials = func() (*credentials.Credentials, error) {
+	return credentials.NewEnvCredentials(), nil
+}
+
+// Check whether a configuration file is fetched over HTTPS or from object storage rather than read locally
+func isRemoteConfig(location string) bool {
+	for _, scheme := range []string{"https://", "http://", "s3://", "sos://"} {
+		if strings.HasPrefix(location, scheme) {
+			return true
+		}
+	}
+	return false
+}
+
+// Get the path of the file name of a location, without the query of URLs
+func configPath(location string) string {
+	if !isRemoteConfig(location) {
+		return location
+	}
+	if u, err := url.Parse(location); err == nil {
+		return u.Path
+	}
+	return location
+}
+
+// Fetch a remote configuration file. The last fetched copy is cached along with its ETag, so that it is only
+// downloaded again once changed, and used if the remote configuration can't be fetched.
+func readRemoteConfig(location string) ([]byte, error) {
+	cacheFile := remoteConfigCacheFile(location)
+	cached, cacheErr := os.ReadFile(cacheFile)
+	etag := ""
+	if cacheErr == nil {
+		if data, err := os.ReadFile(cacheFile + ".etag"); err == nil {
+			etag = string(data)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), remoteConfigTimeout)
+	defer cancel()
+	data, etag, err := fetchRemoteConfig(ctx, location, etag)
+	switch {
+	case err != nil && cacheErr == nil:
+		slog.Warn("Unable to fetch the configuration, using the cached copy", "config", location, "cache_file", cacheFile, "err", err)
+		return cached, nil
+	case err != nil:
+		return nil, fmt.Errorf("unable to fetch configuration: %w", err)
+	case data == nil:
+		slog.Debug("Configuration not modified, using the cached copy", "config", location, "cache_file", cacheFile)
+		return cached, nil
+	}
+
+	if err := writeConfigCache(cacheFile, data, etag); err != nil {
+		slog.Warn("Unable to cache the configuration", "config", location, "cache_file", cacheFile, "err", err)
+	}
+	return data, nil
+}
+
+// Download a remote configuration file, unless its ETag is still the given one. Returns nil data if it didn't change.
+func fetchRemoteConfig(ctx context.Context, location, etag string) ([]byte, string, error) {
+	u, err := url.Parse(location)
+	if err != nil {
+		return nil, "", err
+	}
+
+	switch u.Scheme {
+	case "https":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+		if err != nil {
+			return nil, "", err
+		}
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return nil, "", err
+		}
+		defer resp.Body.Close()
+
+		switch {
+		case resp.StatusCode == http.StatusNotModified && etag != "":
+			return nil, etag, nil
+		case resp.StatusCode != http.StatusOK:
+			return nil, "", &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+		}
+		data, err := io.ReadAll(resp.Body)
+		if err != nil {
+			return nil, "", err
+		}
+		return data, resp.Header.Get("ETag"), nil
+
+	case "s3", "sos":
+		// e.g. s3://bucket/config.yaml?zone=ch-gva-2, in the zone of the API endpoint by default
+		key := strings.TrimPrefix(u.Path, "/")
+		if u.Host == "" || key == "" {
+			return nil, "", errors.New("object storage locations must be of the form s3://bucket/key")
+		}
+		endpoint, zone := u.Query().Get("endpoint"), u.Query().Get("zone")
+		if endpoint == "" && zone == "" {
+			// e.g. https://api-ch-gva-2.exoscale.com/v2
+			endpointURL, _ := url.Parse(string(getAPIEndpoint()))
+			zone, _, _ = strings.Cut(strings.TrimPrefix(endpointURL.Host, "api-"), ".")
+		}
+
+		creds, err := configCredentials()
+		if err != nil {
+			return nil, "", err
+		}
+		value, err := creds.Get()
+		if err != nil {
+			return nil, "", err
+		}
+		bucket := ExportConfig{Bucket: u.Host, Zone: zone, Endpoint: endpoint, AccessKey: value.APIKey, SecretKey: value.APISecret}
+		return bucket.client().get(ctx, key, etag)
+
+	default:
+		return nil, "", fmt.Errorf("unsupported configuration location scheme %q (expected https, s3 or sos), configuration files must not be fetched over plain HTTP", u.Scheme)
+	}
+}
+
+// Get the file a remote configuration file is cached in
+func remoteConfigCacheFile(location string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		dir = os.TempDir()
+	}
+	hash := sha256.Sum256([]byte(location))
+	return filepath.Join(dir, "snap-o-matic", "config", hex.EncodeToString(hash[:16])+filepath.Ext(configPath(location)))
+}
+
+// Atomically cache a fetched configuration file, then its ETag so that it never designates an older copy
+func writeConfigCache(cacheFile string, data []byte, etag string) error {
+	if err := os.MkdirAll(filepath.Dir(cacheFile), 0o700); err != nil {
+		return err
+	}
+	for _, file := range []struct {
+		path    string
+		content []byte
+	}{{cacheFile, data}, {cacheFile + ".etag", []byte(etag)}} {
+		tmp := file.path + ".tmp"
+		if err := os.WriteFile(tmp, file.content, 0o600); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, file.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
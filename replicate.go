@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Prefix of the names of the templates replicating snapshots to the disaster recovery zone
+const replicaTemplatePrefix = "snap-o-matic-dr-"
+
+// Replication of new snapshots to a secondary zone, as templates registered from the exported snapshots
+type ReplicationConfig struct {
+	Enabled   bool              `yaml:"enabled"`
+	Zone      string            `yaml:"zone"`      // Disaster recovery zone
+	Snapshots SnapshotRetention `yaml:"snapshots"` // Retention of the replicas, all are kept if unset
+}
+
+// Prefix of the names of the replicas of an instance
+func replicaPrefix(instanceID v3.UUID) string {
+	return replicaTemplatePrefix + string(instanceID) + "-"
+}
+
+// Export a snapshot, unless it was already, and get the information needed to download it
+func snapshotExport(ctx context.Context, client *v3.Client, snapshotID v3.UUID) (*v3.SnapshotExport, error) {
+	snapshot, err := client.GetSnapshot(ctx, snapshotID)
+	if err != nil {
+		return nil, err
+	}
+
+	if snapshot.Export == nil || snapshot.Export.PresignedURL == "" {
+		op, err := client.ExportSnapshot(ctx, snapshotID)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := operations.wait(ctx, client, op); err != nil {
+			return nil, fmt.Errorf("snapshot export failed: %w", err)
+		}
+
+		if snapshot, err = client.GetSnapshot(ctx, snapshotID); err != nil {
+			return nil, err
+		}
+	}
+
+	if snapshot.Export == nil || snapshot.Export.PresignedURL == "" {
+		return nil, errors.New("snapshot export did not provide a download URL")
+	}
+	return snapshot.Export, nil
+}
+
+// Replicate a snapshot to the disaster recovery zone by registering a template from it there
+func replicateSnapshot(ctx context.Context, client *v3.Client, state *stateStore, cfg ReplicationConfig, account string, snapshot v3.Snapshot, dryRun bool) error {
+	name := replicaPrefix(snapshot.Instance.ID) + snapshot.CreatedAT.UTC().Format("20060102T150405Z")
+	ctx = withLogAttrs(ctx, "snapshot_id", snapshot.ID, "zone", cfg.Zone, "template_name", name)
+
+	if dryRun {
+		slog.InfoContext(ctx, "Dry run: would replicate snapshot")
+		return nil
+	}
+	slog.InfoContext(ctx, "Replicating snapshot")
+
+	description := fmt.Sprintf("Replica of snapshot %s of instance %s", snapshot.ID, snapshot.Instance.ID)
+	drEndpoint := zoneEndpoint(cfg.Zone)
+	templateID, err := registerSnapshotTemplate(ctx, client, client.WithEndpoint(drEndpoint), snapshot, name, description)
+	if err != nil {
+		return err
+	}
+	record := templateRecord{
+		Kind:       templateKindReplica,
+		Account:    account,
+		Endpoint:   drEndpoint,
+		InstanceID: snapshot.Instance.ID,
+		SnapshotID: snapshot.ID,
+		CreatedAt:  time.Now(),
+	}
+	if err := state.addTemplate(templateID, record); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "Replicated snapshot")
+	return nil
+}
+
+// Register a template from a snapshot in the zone of zoneClient and return its ID. Instances created from the
+// template boot like the original instance.
+func registerSnapshotTemplate(ctx context.Context, client, zoneClient *v3.Client, snapshot v3.Snapshot, name, description string) (v3.UUID, error) {
+	export, err := snapshotExport(ctx, client, snapshot.ID)
+	if err != nil {
+		return "", err
+	}
+
+	req := v3.RegisterTemplateRequest{
+		Name:            name,
+		Description:     description,
+		URL:             export.PresignedURL,
+		Checksum:        export.Md5sum,
+		PasswordEnabled: ptr(false),
+		SSHKeyEnabled:   ptr(true),
+	}
+	if template, err := instanceTemplate(ctx, client, snapshot.Instance.ID); err != nil {
+		slog.WarnContext(ctx, "Unable to retrieve the template of the instance, registering the template with default settings", "err", err)
+	} else {
+		req.BootMode = v3.RegisterTemplateRequestBootMode(template.BootMode)
+		req.DefaultUser = template.DefaultUser
+		if template.PasswordEnabled != nil {
+			req.PasswordEnabled = template.PasswordEnabled
+		}
+		if template.SSHKeyEnabled != nil {
+			req.SSHKeyEnabled = template.SSHKeyEnabled
+		}
+	}
+
+	op, err := zoneClient.RegisterTemplate(ctx, req)
+	if err != nil {
+		return "", err
+	}
+	if op, err = operations.wait(ctx, zoneClient, op); err != nil {
+		return "", fmt.Errorf("template registration failed: %w", err)
+	}
+	if op.Reference == nil {
+		return "", errors.New("template registration did not return a template")
+	}
+	return op.Reference.ID, nil
+}
+
+// Get the template an instance was created from
+func instanceTemplate(ctx context.Context, client *v3.Client, instanceID v3.UUID) (*v3.Template, error) {
+	instance, err := client.GetInstance(ctx, instanceID)
+	if err != nil {
+		return nil, err
+	}
+	if instance.Template == nil {
+		return nil, errors.New("instance has no template")
+	}
+	return client.GetTemplate(ctx, instance.Template.ID)
+}
+
+// Delete the replicas of an instance which are not retained by the given retention policy and return the number of
+// deleted replicas. Replicas are the templates recorded as such in the state file, or named like one.
+func pruneReplicas(ctx context.Context, client *v3.Client, state *stateStore, cfg ReplicationConfig, account string, instanceID v3.UUID, retention SnapshotRetention, dryRun bool) (int, error) {
+	if retention.isEmpty() {
+		return 0, nil
+	}
+
+	drEndpoint := zoneEndpoint(cfg.Zone)
+	drClient := client.WithEndpoint(drEndpoint)
+	templates, err := drClient.ListTemplates(ctx, v3.ListTemplatesWithVisibility(v3.ListTemplatesVisibilityPrivate))
+	if err != nil {
+		return 0, fmt.Errorf("unable to list replicas: %w", err)
+	}
+
+	// Replicas go through the same retention engine as snapshots
+	recorded := state.instanceTemplates(templateKindReplica, account, instanceID)
+	replicas := []v3.Snapshot{}
+	for _, template := range templates.Templates {
+		_, managed := recorded[template.ID]
+		if managed || strings.HasPrefix(template.Name, replicaPrefix(instanceID)) {
+			replicas = append(replicas, v3.Snapshot{ID: template.ID, CreatedAT: template.CreatedAT})
+		}
+		delete(recorded, template.ID)
+	}
+	retained := categorizeSnapshots(withLogAttrs(ctx, "zone", cfg.Zone), replicas, retention)
+
+	// Forget the replicas which were deleted by other means
+	for id, record := range recorded {
+		if record.Endpoint == drEndpoint && !dryRun {
+			if err := state.removeTemplate(id); err != nil {
+				return 0, err
+			}
+		}
+	}
+
+	deleted := 0
+	for _, replica := range replicas {
+		if _, ok := retained[replica.ID.String()]; ok {
+			continue
+		}
+
+		ctx := withLogAttrs(ctx, "template_id", replica.ID, "zone", cfg.Zone)
+		if dryRun {
+			slog.InfoContext(ctx, "Dry run: replica would be deleted")
+			deleted++
+			continue
+		}
+
+		if err := deleteTemplate(ctx, drClient, state, replica.ID); err != nil {
+			return deleted, fmt.Errorf("unable to delete replica %s: %w", replica.ID, err)
+		}
+		slog.InfoContext(ctx, "Deleted replica")
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+func ptr[T any](v T) *T {
+	return &v
+}
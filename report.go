@@ -0,0 +1,191 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Outcome of processing an instance
+type instanceResult struct {
+	Account      string  `json:"account,omitempty"` // Account the instance belongs to, empty for the top-level instances
+	InstanceID   v3.UUID `json:"instance_id"`
+	Created      int     `json:"created"`           // Snapshots created
+	Exported     int     `json:"exported"`          // Snapshots exported to object storage
+	Replicated   int     `json:"replicated"`        // Snapshots replicated to the disaster recovery zone
+	Kept         int     `json:"kept"`              // Snapshots kept by the retention policy, or left alone
+	Deleted      int     `json:"deleted"`           // Snapshots deleted
+	DeleteErrors int     `json:"delete_errors"`     // Snapshots which could not be deleted
+	Skipped      string  `json:"skipped,omitempty"` // Why no snapshot was created, e.g. the instance is stopped
+	Stale        string  `json:"stale,omitempty"`   // Why the newest ready snapshot is too old, see max_snapshot_age
+	Err          error   `json:"-"`                 // Error which aborted the processing of the instance
+
+	Endpoint v3.Endpoint `json:"-"` // API endpoint of the zone the instance lives in
+
+	Actions          []plannedAction `json:"-"` // What was (or would have been) done to each snapshot
+	RetentionPlanned bool            `json:"-"` // Whether Actions cover all the snapshots, unlike when retention isn't applied
+}
+
+func (r instanceResult) MarshalJSON() ([]byte, error) {
+	type plain instanceResult // Prevent recursing into MarshalJSON
+	doc := struct {
+		plain
+		Error string `json:"error,omitempty"`
+	}{plain: plain(r)}
+	if r.Err != nil {
+		doc.Error = r.Err.Error()
+	}
+	return json.Marshal(doc)
+}
+
+// Name the instance of a result in summaries, along with its account if any
+func (r instanceResult) label() string {
+	switch {
+	case r.Account == "" && r.InstanceID == "":
+		return "default account"
+	case r.Account == "":
+		return string(r.InstanceID)
+	case r.InstanceID == "":
+		return "account " + r.Account
+	default:
+		return r.Account + "/" + string(r.InstanceID)
+	}
+}
+
+// Outcome of a run over one or more instances
+type runReport struct {
+	RunID       string           `json:"run_id"`
+	DryRun      bool             `json:"dry_run"`
+	StartedAt   time.Time        `json:"started_at"`
+	FinishedAt  time.Time        `json:"finished_at"`
+	Interrupted bool             `json:"interrupted,omitempty"` // Stopped by SIGINT or SIGTERM
+	FailedFast  []string         `json:"failed_fast,omitempty"` // Accounts aborted by their circuit breaker
+	Results     []instanceResult `json:"instances"`
+}
+
+// Get the instances whose processing was aborted by an error
+func (r runReport) failedInstances() []v3.UUID {
+	failed := []v3.UUID{}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			failed = append(failed, result.InstanceID)
+		}
+	}
+	return failed
+}
+
+// Get the instances whose newest ready snapshot is older than their max_snapshot_age
+func (r runReport) staleInstances() []v3.UUID {
+	stale := []v3.UUID{}
+	for _, result := range r.Results {
+		if result.Stale != "" {
+			stale = append(stale, result.InstanceID)
+		}
+	}
+	return stale
+}
+
+// Check whether anything went wrong during the run, including instances without a recent enough snapshot
+func (r runReport) hasFailures() bool {
+	for _, result := range r.Results {
+		if result.Err != nil || result.DeleteErrors > 0 || result.Stale != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// Totals of a run over all instances
+type runTotals struct {
+	Instances    int
+	Failed       int // Instances whose processing was aborted by an error
+	Skipped      int // Instances for which no snapshot was created, e.g. stopped ones
+	Created      int
+	Kept         int
+	Deleted      int
+	DeleteErrors int
+}
+
+// Sum the outcomes of the instances of the run
+func (r runReport) totals() runTotals {
+	totals := runTotals{Instances: len(r.Results)}
+	for _, result := range r.Results {
+		if result.Err != nil {
+			totals.Failed++
+		}
+		if result.Skipped != "" {
+			totals.Skipped++
+		}
+		totals.Created += result.Created
+		totals.Kept += result.Kept
+		totals.Deleted += result.Deleted
+		totals.DeleteErrors += result.DeleteErrors
+	}
+	return totals
+}
+
+// Write the outcome of each instance of the run and the totals as a table
+func writeRunSummary(w io.Writer, r runReport) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "INSTANCE\tCREATED\tKEPT\tDELETED\tSKIPPED\tERRORS")
+	for _, result := range r.Results {
+		errs := result.DeleteErrors
+		if result.Err != nil {
+			errs++
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%d\t%s\t%d\n",
+			result.label(), result.Created, result.Kept, result.Deleted, cmp.Or(result.Skipped, "-"), errs)
+	}
+	totals := r.totals()
+	_, _ = fmt.Fprintf(tw, "TOTAL (%d)\t%d\t%d\t%d\t%d\t%d\n",
+		totals.Instances, totals.Created, totals.Kept, totals.Deleted, totals.Skipped, totals.Failed+totals.DeleteErrors)
+	return tw.Flush()
+}
+
+// Human-readable summary of the run, used by notifications
+func (r runReport) summary() string {
+	totals := r.totals()
+
+	var b strings.Builder
+	mode := ""
+	if r.DryRun {
+		mode = " (dry run)"
+	}
+	if r.Interrupted {
+		mode += " (interrupted)"
+	}
+	if len(r.FailedFast) > 0 {
+		mode += " (failed fast for " + strings.Join(r.FailedFast, ", ") + ")"
+	}
+	fmt.Fprintf(&b, "snap-o-matic run %s%s finished in %s: %d instance(s) processed, %d failed, %d snapshot(s) created, %d deleted, %d deletion error(s)",
+		r.RunID, mode, r.FinishedAt.Sub(r.StartedAt).Round(time.Second), totals.Instances, totals.Failed, totals.Created, totals.Deleted, totals.DeleteErrors)
+
+	for _, problem := range r.problems() {
+		b.WriteString("\n- " + problem)
+	}
+
+	return b.String()
+}
+
+// Describe what went wrong with each instance of the run, if anything
+func (r runReport) problems() []string {
+	var problems []string
+	for _, result := range r.Results {
+		switch {
+		case result.Err != nil:
+			problems = append(problems, fmt.Sprintf("%s: %s", result.label(), result.Err))
+		case result.DeleteErrors > 0:
+			problems = append(problems, fmt.Sprintf("%s: %d snapshot(s) could not be deleted", result.label(), result.DeleteErrors))
+		}
+		if result.Stale != "" {
+			problems = append(problems, fmt.Sprintf("%s: %s", result.label(), result.Stale))
+		}
+	}
+	return problems
+}
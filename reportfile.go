@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	htmltemplate "html/template"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const markdownReportTemplate = `# snap-o-matic run {{.Report.RunID}}{{if .Report.DryRun}} (dry run){{end}}
+
+- Started: {{time .Report.StartedAt}}
+- Finished: {{time .Report.FinishedAt}} ({{duration .Report.StartedAt .Report.FinishedAt}})
+{{- if .Report.Interrupted}}
+- Interrupted by a signal
+{{- end}}
+{{- range .Report.FailedFast}}
+- Aborted by the circuit breaker of {{.}}
+{{- end}}
+
+## Instances
+
+| Instance | Created | Kept | Deleted | Skipped | Errors |
+|---|---|---|---|---|---|
+{{- range .Report.Results}}
+| {{cell (label .)}} | {{.Created}} | {{.Kept}} | {{.Deleted}} | {{cell (or .Skipped "-")}} | {{errors .}} |
+{{- end}}
+| **Total ({{.Totals.Instances}})** | {{.Totals.Created}} | {{.Totals.Kept}} | {{.Totals.Deleted}} | {{.Totals.Skipped}} | {{add .Totals.Failed .Totals.DeleteErrors}} |
+{{- if .Failed}}
+
+## Errors
+{{range .Report.Results}}{{if .Err}}
+- {{label .}}: {{.Err}}
+{{- else if .DeleteErrors}}
+- {{label .}}: {{.DeleteErrors}} snapshot(s) could not be deleted
+{{- end}}{{if .Stale}}
+- {{label .}}: {{.Stale}}
+{{- end}}{{end}}
+{{- end}}
+
+## Retention Decisions
+{{range .Report.Results}}{{if .Actions}}
+### {{label .}}
+
+| Snapshot | Created | Age | Action | Bucket | Reason |
+|---|---|---|---|---|---|
+{{- range .Actions}}
+| {{or .SnapshotID "(new)"}} | {{time .CreatedAt}} | {{age .CreatedAt}} | {{.Action}} | {{or .Bucket "-"}} | {{cell .Reason}} |
+{{- end}}
+{{end}}{{end}}`
+
+const htmlReportTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>snap-o-matic run {{.Report.RunID}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 1.5em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+th { background: #f0f0f0; }
+tr.total td { font-weight: bold; }
+.failed { color: #b00020; }
+.delete { color: #b00020; }
+.create { color: #1b5e20; }
+</style>
+</head>
+<body>
+<h1>snap-o-matic run {{.Report.RunID}}{{if .Report.DryRun}} (dry run){{end}}</h1>
+<ul>
+<li>Started: {{time .Report.StartedAt}}</li>
+<li>Finished: {{time .Report.FinishedAt}} ({{duration .Report.StartedAt .Report.FinishedAt}})</li>
+{{- if .Report.Interrupted}}
+<li class="failed">Interrupted by a signal</li>
+{{- end}}
+{{- range .Report.FailedFast}}
+<li class="failed">Aborted by the circuit breaker of {{.}}</li>
+{{- end}}
+</ul>
+
+<h2>Instances</h2>
+<table>
+<tr><th>Instance</th><th>Created</th><th>Kept</th><th>Deleted</th><th>Skipped</th><th>Errors</th></tr>
+{{- range .Report.Results}}
+<tr{{if .Err}} class="failed"{{end}}><td>{{label .}}</td><td>{{.Created}}</td><td>{{.Kept}}</td><td>{{.Deleted}}</td><td>{{or .Skipped "-"}}</td><td>{{errors .}}</td></tr>
+{{- end}}
+<tr class="total"><td>Total ({{.Totals.Instances}})</td><td>{{.Totals.Created}}</td><td>{{.Totals.Kept}}</td><td>{{.Totals.Deleted}}</td><td>{{.Totals.Skipped}}</td><td>{{add .Totals.Failed .Totals.DeleteErrors}}</td></tr>
+</table>
+{{- if .Failed}}
+
+<h2>Errors</h2>
+<ul>
+{{- range .Report.Results}}{{if .Err}}
+<li class="failed">{{label .}}: {{.Err}}</li>
+{{- else if .DeleteErrors}}
+<li class="failed">{{label .}}: {{.DeleteErrors}} snapshot(s) could not be deleted</li>
+{{- end}}{{if .Stale}}
+<li class="failed">{{label .}}: {{.Stale}}</li>
+{{- end}}{{end}}
+</ul>
+{{- end}}
+
+<h2>Retention Decisions</h2>
+{{- range .Report.Results}}{{if .Actions}}
+<h3>{{label .}}</h3>
+<table>
+<tr><th>Snapshot</th><th>Created</th><th>Age</th><th>Action</th><th>Bucket</th><th>Reason</th></tr>
+{{- range .Actions}}
+<tr><td>{{or .SnapshotID "(new)"}}</td><td>{{time .CreatedAt}}</td><td>{{age .CreatedAt}}</td><td class="{{.Action}}">{{.Action}}</td><td>{{or .Bucket "-"}}</td><td>{{.Reason}}</td></tr>
+{{- end}}
+</table>
+{{- end}}{{end}}
+</body>
+</html>
+`
+
+// Data available to the report templates
+type reportData struct {
+	Report runReport
+	Totals runTotals
+	Failed bool
+}
+
+// Get the format of a report file from its extension, html or markdown
+func reportFormat(path string) (string, error) {
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".html", ".htm":
+		return "html", nil
+	case ".md", ".markdown":
+		return "markdown", nil
+	default:
+		return "", fmt.Errorf("unsupported report file extension %q (expected .html or .md)", ext)
+	}
+}
+
+// Write the report of a run to a file, as HTML or Markdown depending on its extension
+func writeReportFile(path string, report runReport) error {
+	funcs := map[string]any{
+		"time":     func(t time.Time) string { return t.Format(time.RFC3339) },
+		"duration": func(from, to time.Time) string { return formatDuration(to.Sub(from).Round(time.Second)) },
+		"age":      func(t time.Time) string { return formatDuration(max(report.FinishedAt.Sub(t), 0).Round(time.Minute)) },
+		"add":      func(a, b int) int { return a + b },
+		"label":    func(result instanceResult) string { return result.label() },
+		"errors": func(result instanceResult) int {
+			if result.Err != nil {
+				return result.DeleteErrors + 1
+			}
+			return result.DeleteErrors
+		},
+		// Pipes and line breaks would end Markdown table cells
+		"cell": func(s string) string {
+			return strings.NewReplacer("|", `\|`, "\n", " ").Replace(s)
+		},
+	}
+
+	format, err := reportFormat(path)
+	if err != nil {
+		return err
+	}
+	var render func(w io.Writer, data reportData) error
+	if format == "html" {
+		tmpl := htmltemplate.Must(htmltemplate.New("report").Funcs(funcs).Parse(htmlReportTemplate))
+		render = func(w io.Writer, data reportData) error { return tmpl.Execute(w, data) }
+	} else {
+		tmpl := template.Must(template.New("report").Funcs(funcs).Parse(markdownReportTemplate))
+		render = func(w io.Writer, data reportData) error { return tmpl.Execute(w, data) }
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := render(f, reportData{Report: report, Totals: report.totals(), Failed: report.hasFailures()}); err != nil {
+		_ = f.Close()
+		return fmt.Errorf("unable to render the report: %w", err)
+	}
+	return f.Close()
+}
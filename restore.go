@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Revert the volume of an instance to one of its snapshots, stopping the instance during the operation if needed.
+// The instance is looked up in the account and zone it is configured in, if any, configured holding the top-level
+// entries before they were resolved. Instances listed in never_touch are refused unless explicitly overridden.
+func restoreSnapshot(ctx context.Context, clients accountClients, cfg config, configured []InstanceConfig, in io.Reader, out io.Writer) error {
+	if len(cfg.InstanceIDs) != 1 || cfg.SnapshotID == "" {
+		return errors.New("usage: snap-o-matic restore --instance ID --snapshot ID")
+	}
+	instanceID, err := v3.ParseUUID(cfg.InstanceIDs[0])
+	if err != nil {
+		return fmt.Errorf("invalid instance ID %q: %w", cfg.InstanceIDs[0], err)
+	}
+	snapshotID, err := v3.ParseUUID(cfg.SnapshotID)
+	if err != nil {
+		return fmt.Errorf("invalid snapshot ID %q: %w", cfg.SnapshotID, err)
+	}
+
+	target := configuredInstance(cfg, configured, instanceID)
+	client, err := clients.get(target.Account)
+	if err != nil {
+		return err
+	}
+	client = client.WithEndpoint(target.apiEndpoint(cfg.APIEndpoint))
+	ctx = withLogAttrs(ctx, "instance_id", instanceID, "snapshot_id", snapshotID)
+
+	instance, err := client.GetInstance(ctx, instanceID)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve instance %s: %w", instanceID, err)
+	}
+	snapshot, err := client.GetSnapshot(ctx, snapshotID)
+	if err != nil {
+		return fmt.Errorf("unable to retrieve snapshot %s: %w", snapshotID, err)
+	}
+	if snapshot.Instance == nil || snapshot.Instance.ID != instanceID {
+		return fmt.Errorf("snapshot %s is not a snapshot of instance %s", snapshotID, instanceID)
+	}
+	if neverTouched(cfg.NeverTouch, instanceID, instance.Labels) {
+		if !cfg.IgnoreNeverTouch {
+			return fmt.Errorf("instance %s is listed in never_touch, use --ignore-never-touch to restore it anyway", instanceID)
+		}
+		slog.WarnContext(ctx, "Restoring instance listed in never_touch as requested")
+	}
+
+	if !cfg.Yes {
+		_, _ = fmt.Fprintf(out, "Revert instance %s (%s) to snapshot %s created at %s?\nAll data written since will be lost. Type 'yes' to confirm: ",
+			instance.Name, instanceID, snapshotID, snapshot.CreatedAT.Local().Format("2006-01-02 15:04:05 MST"))
+		answer, _ := bufio.NewReader(in).ReadString('\n')
+		if strings.TrimSpace(answer) != "yes" {
+			return errors.New("restore aborted")
+		}
+	}
+
+	if cfg.DryRun {
+		slog.InfoContext(ctx, "Dry run: would revert instance to snapshot", "instance_state", instance.State)
+		return nil
+	}
+
+	// The instance must be stopped to revert its volume, it is started again afterwards if it was running
+	running := instance.State == v3.InstanceStateRunning
+	if running {
+		slog.InfoContext(ctx, "Stopping instance")
+		if err := waitOperation(ctx, client, func() (*v3.Operation, error) { return client.StopInstance(ctx, instanceID) }); err != nil {
+			return fmt.Errorf("unable to stop instance: %w", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Reverting instance to snapshot")
+	err = waitOperation(ctx, client, func() (*v3.Operation, error) {
+		return client.RevertInstanceToSnapshot(ctx, instanceID, v3.RevertInstanceToSnapshotRequest{ID: snapshotID})
+	})
+	if err != nil {
+		if !running {
+			return fmt.Errorf("unable to revert instance to snapshot: %w", err)
+		}
+		// Don't leave an instance which was running stopped, even if the revert was interrupted: its volume is still
+		// the one it had before
+		slog.InfoContext(ctx, "Starting instance again after the failed revert")
+		startCtx := context.WithoutCancel(ctx)
+		if startErr := waitOperation(startCtx, client, func() (*v3.Operation, error) {
+			return client.StartInstance(startCtx, instanceID, v3.StartInstanceRequest{})
+		}); startErr != nil {
+			slog.ErrorContext(ctx, "Error starting instance again", "err", startErr)
+			return fmt.Errorf("unable to revert instance to snapshot: %w (starting the instance again failed too: %v)", err, startErr)
+		}
+		return fmt.Errorf("unable to revert instance to snapshot, the instance was started again: %w", err)
+	}
+
+	if running {
+		slog.InfoContext(ctx, "Starting instance")
+		if err := waitOperation(ctx, client, func() (*v3.Operation, error) { return client.StartInstance(ctx, instanceID, v3.StartInstanceRequest{}) }); err != nil {
+			return fmt.Errorf("unable to start instance: %w", err)
+		}
+	}
+
+	slog.InfoContext(ctx, "Restored instance")
+	return nil
+}
+
+// Find the entry of an instance among the resolved ones, or else among the ones configured by ID, which include the
+// instances dropped for being listed in never_touch. Instances without entry are looked up with the defaults.
+func configuredInstance(cfg config, configured []InstanceConfig, id v3.UUID) InstanceConfig {
+	for _, instance := range cfg.Instances {
+		if instance.ID == id {
+			return instance
+		}
+	}
+	for _, instance := range configured {
+		if instance.ID == id {
+			return instance
+		}
+	}
+	for _, account := range cfg.Accounts {
+		for _, instance := range account.Instances {
+			if instance.ID == id {
+				instance.Account = account.Name
+				return instance
+			}
+		}
+	}
+	return InstanceConfig{ID: id}
+}
+
+// Start an asynchronous operation and wait for it to succeed
+func waitOperation(ctx context.Context, client *v3.Client, start func() (*v3.Operation, error)) error {
+	op, err := start()
+	if err != nil {
+		return err
+	}
+	_, err = operations.wait(ctx, client, op)
+	return err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"maps"
+	"reflect"
+	"strings"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Schemas of the types decoded from something else than their Go shape
+var schemaOverrides = map[reflect.Type]map[string]any{
+	reflect.TypeFor[duration](): {
+		"type":        "string",
+		"pattern":     `^([0-9.]+(ns|us|µs|ms|s|m|h))+$|^[0-9.]+[dwy]$`,
+		"description": "Duration, e.g. 6h, 90d, 2w or 1y",
+	},
+	reflect.TypeFor[time.Duration](): {
+		"type":        "string",
+		"description": "Go duration, e.g. 30m or 6h",
+	},
+	reflect.TypeFor[retentionMargin](): {
+		"type":        []string{"number", "string"},
+		"pattern":     `^[0-9.]+%$`,
+		"description": "Fraction of the timeframe, e.g. 0.1 or 10%",
+	},
+	reflect.TypeFor[timeframeRetention](): {
+		"oneOf": []any{
+			map[string]any{"type": "integer", "minimum": 0},
+			map[string]any{
+				"type": "object",
+				"properties": map[string]any{
+					"keep":   map[string]any{"type": "integer", "minimum": 0},
+					"margin": map[string]any{"$ref": "#/$defs/margin"},
+				},
+				"required":             []string{"keep"},
+				"additionalProperties": false,
+			},
+		},
+		"description": "Number of snapshots to keep, or {keep, margin}",
+	},
+	reflect.TypeFor[timezone](): {
+		"type":        "string",
+		"description": "IANA time zone, e.g. Europe/Zurich",
+	},
+	reflect.TypeFor[weekStart](): {
+		"enum": []string{string(weekStartMonday), string(weekStartSunday)},
+	},
+	reflect.TypeFor[v3.UUID](): {
+		"type":   "string",
+		"format": "uuid",
+	},
+}
+
+// Build the JSON Schema of the configuration file
+func configSchema() map[string]any {
+	schema := jsonSchema(reflect.TypeFor[config]())
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = "snap-o-matic configuration"
+	schema["$defs"] = map[string]any{"margin": schemaOverrides[reflect.TypeFor[retentionMargin]()]}
+	return schema
+}
+
+// Build the JSON Schema of a type as decoded from YAML. Structs don't allow unknown keys, so that typos get caught.
+func jsonSchema(t reflect.Type) map[string]any {
+	if schema, ok := schemaOverrides[t]; ok {
+		return schema
+	}
+
+	switch t.Kind() {
+	case reflect.Pointer:
+		return jsonSchema(t.Elem())
+
+	case reflect.Struct:
+		properties := make(map[string]any)
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if !field.IsExported() {
+				continue
+			}
+			name, options, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+			if name == "-" {
+				continue
+			}
+			// The keys of inlined structs, e.g. the options shared by notification backends, belong to the parent
+			if options == "inline" || field.Anonymous && name == "" {
+				if inlined, ok := jsonSchema(field.Type)["properties"].(map[string]any); ok {
+					maps.Copy(properties, inlined)
+					continue
+				}
+			}
+			if name == "" {
+				name = strings.ToLower(field.Name)
+			}
+			properties[name] = jsonSchema(field.Type)
+		}
+		return map[string]any{"type": "object", "properties": properties, "additionalProperties": false}
+
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": jsonSchema(t.Elem())}
+
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": jsonSchema(t.Elem())}
+
+	case reflect.String:
+		return map[string]any{"type": "string"}
+
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+
+	default:
+		return map[string]any{}
+	}
+}
+
+// Write the JSON Schema of the configuration file
+func writeSchema(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(configSchema())
+}
@@ -0,0 +1,19 @@
+package main
+
+import "testing"
+
+func TestConfigSchemaInlinesEmbeddedOptions(t *testing.T) {
+	notifications := configSchema()["properties"].(map[string]any)["notifications"].(map[string]any)["properties"].(map[string]any)
+	tests := map[string]string{"slack": "failures_only", "webhooks": "failures_only", "email": "failures_only", "pagerduty": "auto_resolve"}
+	for backend, key := range tests {
+		properties := notifications[backend].(map[string]any)["items"].(map[string]any)["properties"].(map[string]any)
+		if _, ok := properties[key]; !ok {
+			t.Errorf("%s: missing %s", backend, key)
+		}
+		for name := range properties {
+			if name == "notifieroptions" || name == "incidentoptions" {
+				t.Errorf("%s: embedded options not inlined as %s", backend, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Reporting of panics and failed runs to Sentry, or an error tracker speaking its protocol
+type ErrorTrackingConfig struct {
+	SentryDSN   string `yaml:"sentry_dsn"`  // Defaults to the SENTRY_DSN environment variable
+	Environment string `yaml:"environment"` // e.g. production
+}
+
+// Client of the envelope endpoint of a Sentry project
+type sentryClient struct {
+	dsn         string
+	envelopeURL string
+	key         string
+	environment string
+}
+
+// nil unless error tracking is configured
+var errorTracker *sentryClient
+
+func newSentryClient(cfg ErrorTrackingConfig) (*sentryClient, error) {
+	dsn := cmp.Or(cfg.SentryDSN, os.Getenv("SENTRY_DSN"))
+	if dsn == "" {
+		return nil, nil
+	}
+
+	// DSNs look like https://PUBLIC_KEY@HOST/PROJECT_ID
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, errors.New("invalid Sentry DSN, expected https://PUBLIC_KEY@HOST/PROJECT_ID")
+	}
+	path, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		path, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" {
+		return nil, errors.New("invalid Sentry DSN, missing the project ID")
+	}
+
+	return &sentryClient{
+		dsn:         dsn,
+		envelopeURL: fmt.Sprintf("%s://%s%s/api/%s/envelope/", u.Scheme, u.Host, path, project),
+		key:         u.User.Username(),
+		environment: cfg.Environment,
+	}, nil
+}
+
+// Report the failures of a run, along with its context
+func (c *sentryClient) runFailed(ctx context.Context, report runReport) {
+	if c == nil || !report.hasFailures() {
+		return
+	}
+
+	instances := []map[string]any{}
+	for _, result := range report.Results {
+		if result.Err == nil && result.DeleteErrors == 0 && result.Stale == "" {
+			continue
+		}
+		instance := map[string]any{"instance": result.label(), "delete_errors": result.DeleteErrors}
+		if result.Err != nil {
+			instance["error"] = result.Err.Error()
+		}
+		if result.Stale != "" {
+			instance["stale"] = result.Stale
+		}
+		instances = append(instances, instance)
+	}
+
+	totals := report.totals()
+	c.send(ctx, map[string]any{
+		"level":       "error",
+		"message":     map[string]any{"formatted": fmt.Sprintf("snap-o-matic run failed: %d of %d instance(s) failed", totals.Failed, totals.Instances)},
+		"fingerprint": []string{"snap-o-matic", "run-failed"},
+		"tags":        map[string]any{"run_id": report.RunID, "dry_run": fmt.Sprint(report.DryRun), "interrupted": fmt.Sprint(report.Interrupted)},
+		"extra":       map[string]any{"summary": report.summary(), "instances": instances},
+	})
+}
+
+// Report an error preventing a run
+func (c *sentryClient) fatal(err error) {
+	if c == nil {
+		return
+	}
+	c.send(context.Background(), map[string]any{
+		"level":     "fatal",
+		"exception": map[string]any{"values": []any{map[string]any{"type": fmt.Sprintf("%T", err), "value": err.Error()}}},
+	})
+}
+
+// Report a panic, then let it go on crashing the program. To be deferred.
+func (c *sentryClient) recoverPanic(ctx context.Context) {
+	if c == nil {
+		return
+	}
+	r := recover()
+	if r == nil {
+		return
+	}
+	c.send(ctx, map[string]any{
+		"level": "fatal",
+		"exception": map[string]any{"values": []any{map[string]any{
+			"type":      "panic",
+			"value":     fmt.Sprint(r),
+			"mechanism": map[string]any{"type": "panic", "handled": false},
+		}}},
+		"extra": map[string]any{"stack": string(debug.Stack())},
+	})
+	panic(r)
+}
+
+// Send an event, with the run and instance of the context and the build of snap-o-matic
+func (c *sentryClient) send(ctx context.Context, event map[string]any) {
+	eventID := strings.ReplaceAll(uuid.NewString(), "-", "")
+	host, _ := os.Hostname()
+	build := currentBuild()
+
+	event["event_id"] = eventID
+	event["timestamp"] = time.Now().UTC().Format(time.RFC3339Nano)
+	event["platform"] = "go"
+	event["logger"] = "snap-o-matic"
+	event["release"] = "snap-o-matic@" + build.Version
+	event["server_name"] = host
+	if c.environment != "" {
+		event["environment"] = c.environment
+	}
+	tags, _ := event["tags"].(map[string]any)
+	if tags == nil {
+		tags = make(map[string]any)
+	}
+	tags["run_id"] = runID(ctx)
+	for _, key := range []string{"instance_id", "account"} {
+		if value := logAttr(ctx, key); value != "" {
+			tags[key] = value
+		}
+	}
+	event["tags"] = tags
+
+	header, err := json.Marshal(map[string]any{"event_id": eventID, "dsn": c.dsn, "sent_at": time.Now().UTC().Format(time.RFC3339Nano)})
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reporting to Sentry", "err", err)
+		return
+	}
+	payload, err := json.Marshal(event)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reporting to Sentry", "err", err)
+		return
+	}
+	var body bytes.Buffer
+	fmt.Fprintf(&body, "%s\n{\"type\":\"event\",\"length\":%d}\n%s\n", header, len(payload), payload)
+
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.envelopeURL, &body)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reporting to Sentry", "err", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/x-sentry-envelope")
+	req.Header.Set("X-Sentry-Auth", fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s", build.userAgent(), c.key))
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error reporting to Sentry", "err", err)
+		return
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		slog.ErrorContext(ctx, "Error reporting to Sentry", "err", fmt.Errorf("unexpected response status %q", resp.Status))
+	}
+}
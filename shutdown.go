@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Time the operations in progress are waited for once a run is stopped, unless configured otherwise
+const defaultShutdownTimeout = 5 * time.Minute
+
+// Result of the instances a stopped run didn't start processing
+var errInterrupted = errors.New("not processed, the run was interrupted")
+
+// Shutdown requested by SIGINT or SIGTERM
+var shutdown = &shutdownRequest{stopping: make(chan struct{})}
+
+type shutdownRequest struct {
+	once     sync.Once
+	stopping chan struct{} // Closed once a shutdown is requested
+}
+
+func (s *shutdownRequest) request() {
+	s.once.Do(func() { close(s.stopping) })
+}
+
+// Check whether a shutdown was requested, after which no new work is started
+func (s *shutdownRequest) requested() bool {
+	select {
+	case <-s.stopping:
+		return true
+	default:
+		return false
+	}
+}
+
+// Get why no new instance of an account may be processed anymore, the run being stopped, out of time or failing fast
+// for the account, nil if it may
+func notStartedError(ctx context.Context, account string) error {
+	switch {
+	case shutdown.requested():
+		return errInterrupted
+	case breakers.err(account) != nil:
+		return fmt.Errorf("not processed: %w", breakers.err(account))
+	case ctx.Err() != nil:
+		return fmt.Errorf("not processed: %w", context.Cause(ctx))
+	default:
+		return nil
+	}
+}
+
+// Get the context of the processing of an instance, canceled after the instance timeout
+func instanceContext(ctx context.Context, cfg config) (context.Context, context.CancelFunc) {
+	if cfg.InstanceTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeoutCause(ctx, time.Duration(cfg.InstanceTimeout), fmt.Errorf("instance timeout of %s exceeded", cfg.InstanceTimeout))
+}
+
+// Prefix an error with why its context was canceled, e.g. a timeout, telling what stalled the operation it's about
+func withCancelCause(ctx context.Context, err error) error {
+	if cause := context.Cause(ctx); err != nil && cause != nil && !errors.Is(err, cause) {
+		return fmt.Errorf("%w: %w", cause, err)
+	}
+	return err
+}
+
+// Handle SIGINT and SIGTERM: the first one requests a shutdown, the returned context is canceled, aborting the
+// operations in progress, after the timeout or on the second one. Stopping the handling cancels the context too.
+func handleSignals(timeout time.Duration) (context.Context, func()) {
+	ctx, cancelCause := context.WithCancelCause(context.Background())
+	cancel := func() { cancelCause(errors.New("aborted by the shutdown")) }
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-signals:
+			slog.Warn("Stopping, waiting for the operations in progress", "signal", sig, "timeout", timeout)
+			shutdown.request()
+		case <-ctx.Done():
+			return
+		}
+
+		select {
+		case sig := <-signals:
+			slog.Warn("Aborting the operations in progress", "signal", sig)
+		case <-time.After(timeout):
+			slog.Warn("Aborting the operations in progress, shutdown timeout exceeded", "timeout", timeout)
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		cancel()
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Settings of the simulate command
+type simulateOptions struct {
+	Policy   string // Named retention policy, the default one if empty
+	Interval string // Time between two runs
+	Horizon  string // Simulated period
+}
+
+// Outcome of a simulation
+type simulationReport struct {
+	Policy       string             `json:"policy" yaml:"policy"`
+	Interval     string             `json:"interval" yaml:"interval"`
+	Horizon      string             `json:"horizon" yaml:"horizon"`
+	Runs         int                `json:"runs" yaml:"runs"`
+	Snapshots    int                `json:"snapshots" yaml:"snapshots"`         // Snapshots left at the end of the horizon
+	MaxSnapshots int                `json:"max_snapshots" yaml:"max_snapshots"` // Most snapshots existing at once
+	MaxReachedAt string             `json:"max_reached_after" yaml:"max_reached_after"`
+	Buckets      []simulationBucket `json:"buckets" yaml:"buckets"` // Age distribution of the snapshots left
+}
+
+// Snapshots left at the end of a simulation, by retention bucket
+type simulationBucket struct {
+	Bucket   string `json:"bucket" yaml:"bucket"`
+	Count    int    `json:"count" yaml:"count"`
+	Youngest string `json:"youngest" yaml:"youngest"`
+	Oldest   string `json:"oldest" yaml:"oldest"`
+}
+
+// Simulate running a retention policy on schedule over a time horizon, creating a snapshot and pruning at each run.
+// Deletion grace periods are not simulated.
+func simulateRetention(ctx context.Context, cfg config) (simulationReport, error) {
+	opts := cfg.Simulate
+	retention, name := cfg.Defaults.Snapshots, "default"
+	if opts.Policy != "" {
+		policy, ok := cfg.Policies[opts.Policy]
+		if !ok {
+			return simulationReport{}, fmt.Errorf("unknown policy %q", opts.Policy)
+		}
+		retention, name = policy, opts.Policy
+	}
+
+	interval, err := parseDuration(opts.Interval)
+	if err != nil || interval <= 0 {
+		return simulationReport{}, fmt.Errorf("invalid interval %q", opts.Interval)
+	}
+	horizon, err := parseDuration(opts.Horizon)
+	if err != nil || horizon < interval {
+		return simulationReport{}, fmt.Errorf("invalid horizon %q, it must be at least one interval", opts.Horizon)
+	}
+	if horizon/interval > 1_000_000 {
+		return simulationReport{}, errors.New("too many simulated runs, use a longer interval or a shorter horizon")
+	}
+
+	report := simulationReport{Policy: name, Interval: formatDuration(interval), Horizon: formatDuration(horizon)}
+
+	// Retention decisions depend on the current time through min_age
+	realClock := retentionClock
+	defer func() { retentionClock = realClock }()
+
+	start := realClock.Now().Truncate(interval)
+	snapshots := []v3.Snapshot{}
+	var retained map[string]string
+	var end time.Time
+	for t := start; !t.After(start.Add(horizon)); t = t.Add(interval) {
+		retentionClock, end = fixedClock(t), t
+		report.Runs++
+
+		snapshots = append(snapshots, v3.Snapshot{ID: v3.UUID(fmt.Sprintf("simulated-%d", report.Runs)), CreatedAT: t})
+		retained = categorizeSnapshots(ctx, snapshots, retention)
+
+		kept := snapshots[:0]
+		for _, snapshot := range snapshots {
+			if _, ok := retained[snapshot.ID.String()]; ok {
+				kept = append(kept, snapshot)
+			}
+		}
+		snapshots = kept
+
+		if len(snapshots) > report.MaxSnapshots {
+			report.MaxSnapshots = len(snapshots)
+			report.MaxReachedAt = formatDuration(t.Sub(start))
+		}
+	}
+	report.Snapshots = len(snapshots)
+
+	// Distribution of the ages of the snapshots left, by bucket
+	type ages struct {
+		count            int
+		youngest, oldest time.Duration
+	}
+	byBucket := make(map[string]*ages)
+	for _, snapshot := range snapshots {
+		bucket, age := retained[snapshot.ID.String()], end.Sub(snapshot.CreatedAT)
+		a, ok := byBucket[bucket]
+		if !ok {
+			a = &ages{youngest: age, oldest: age}
+			byBucket[bucket] = a
+		}
+		a.count++
+		a.youngest, a.oldest = min(a.youngest, age), max(a.oldest, age)
+	}
+	for bucket, a := range byBucket {
+		report.Buckets = append(report.Buckets, simulationBucket{
+			Bucket:   bucket,
+			Count:    a.count,
+			Youngest: formatDuration(a.youngest),
+			Oldest:   formatDuration(a.oldest),
+		})
+	}
+	sort.Slice(report.Buckets, func(i, j int) bool {
+		return byBucket[report.Buckets[i].Bucket].youngest < byBucket[report.Buckets[j].Bucket].youngest
+	})
+
+	return report, nil
+}
+
+// Write a simulation report in the requested output format
+func writeSimulation(w io.Writer, report simulationReport, format string) error {
+	return writeFormatted(w, report, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintf(tw, "Policy %s, one run every %s over %s (%d runs)\n", report.Policy, report.Interval, report.Horizon, report.Runs)
+		_, _ = fmt.Fprintf(tw, "Snapshots at the end: %d, at most %d (reached after %s)\n\n", report.Snapshots, report.MaxSnapshots, report.MaxReachedAt)
+
+		_, _ = fmt.Fprintln(tw, "BUCKET\tSNAPSHOTS\tYOUNGEST\tOLDEST")
+		for _, b := range report.Buckets {
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%s\t%s\n", b.Bucket, b.Count, b.Youngest, b.Oldest)
+		}
+	})
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	sosMinPartSize = 64 << 20 // Size of the parts of multipart uploads, unless the object needs larger ones
+	sosMaxParts    = 10000
+)
+
+// Minimal client for the S3-compatible Exoscale Object Storage (SOS), covering what exports need
+type sosClient struct {
+	endpoint  string // e.g. https://sos-ch-gva-2.exo.io
+	region    string
+	bucket    string
+	accessKey string
+	secretKey string
+	http      *http.Client
+}
+
+// Object of a bucket listing
+type sosObject struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	Size         int64     `xml:"Size"`
+}
+
+// Get the SOS endpoint of a zone
+func sosZoneEndpoint(zone string) string {
+	return fmt.Sprintf("https://sos-%s.exo.io", zone)
+}
+
+// Upload an object of the given size (-1 if unknown) with a multipart upload, so that objects of any size are supported
+func (c *sosClient) upload(ctx context.Context, key string, r io.Reader, size int64) (err error) {
+	var initiated struct {
+		UploadID string `xml:"UploadId"`
+	}
+	if err := c.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, &initiated); err != nil {
+		return fmt.Errorf("unable to initiate upload: %w", err)
+	}
+
+	// Abort the upload on failure so that no orphaned parts are left behind
+	defer func() {
+		if err != nil {
+			_ = c.do(context.WithoutCancel(ctx), http.MethodDelete, key, url.Values{"uploadId": {initiated.UploadID}}, nil, nil)
+		}
+	}()
+
+	partSize := int64(sosMinPartSize)
+	if size > 0 {
+		partSize = max(partSize, (size+sosMaxParts-1)/sosMaxParts)
+	}
+
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+
+	buf := make([]byte, partSize)
+	for number := 1; ; number++ {
+		n, readErr := io.ReadFull(r, buf)
+		if readErr != nil && !errors.Is(readErr, io.EOF) && !errors.Is(readErr, io.ErrUnexpectedEOF) {
+			return readErr
+		}
+		if n == 0 && number > 1 {
+			break
+		}
+
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadID}}
+		resp, err := c.request(ctx, http.MethodPut, key, query, nil, buf[:n])
+		if err != nil {
+			return fmt.Errorf("unable to upload part %d: %w", number, err)
+		}
+		_ = resp.Body.Close()
+		parts = append(parts, part{PartNumber: number, ETag: resp.Header.Get("ETag")})
+
+		if readErr != nil {
+			break
+		}
+	}
+
+	complete := struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts}
+	body, err := xml.Marshal(complete)
+	if err != nil {
+		return err
+	}
+	if err := c.do(ctx, http.MethodPost, key, url.Values{"uploadId": {initiated.UploadID}}, body, nil); err != nil {
+		return fmt.Errorf("unable to complete upload: %w", err)
+	}
+
+	return nil
+}
+
+// List the objects whose key starts with prefix
+func (c *sosClient) list(ctx context.Context, prefix string) ([]sosObject, error) {
+	objects := []sosObject{}
+	token := ""
+
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+
+		var page struct {
+			Contents              []sosObject `xml:"Contents"`
+			IsTruncated           bool        `xml:"IsTruncated"`
+			NextContinuationToken string      `xml:"NextContinuationToken"`
+		}
+		if err := c.do(ctx, http.MethodGet, "", query, nil, &page); err != nil {
+			return nil, err
+		}
+
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// Download an object, unless its ETag is still the given one. Returns nil data if the object didn't change.
+func (c *sosClient) get(ctx context.Context, key, etag string) ([]byte, string, error) {
+	var header http.Header
+	if etag != "" {
+		header = http.Header{"If-None-Match": {etag}}
+	}
+	resp, err := c.request(ctx, http.MethodGet, key, nil, header, nil)
+	var statusErr *httpStatusError
+	if errors.As(err, &statusErr) && statusErr.StatusCode == http.StatusNotModified {
+		return nil, etag, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, "", err
+	}
+	return data, resp.Header.Get("ETag"), nil
+}
+
+// Delete an object
+func (c *sosClient) delete(ctx context.Context, key string) error {
+	return c.do(ctx, http.MethodDelete, key, nil, nil, nil)
+}
+
+// Perform a request and decode its XML response into out, unless nil
+func (c *sosClient) do(ctx context.Context, method, key string, query url.Values, body []byte, out any) error {
+	resp, err := c.request(ctx, method, key, query, nil, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if out == nil {
+		return nil
+	}
+	return xml.NewDecoder(resp.Body).Decode(out)
+}
+
+// Perform a signed request, with the given extra headers. Any non-2xx response is an error.
+func (c *sosClient) request(ctx context.Context, method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	u, err := url.Parse(c.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + c.bucket
+	if key != "" {
+		u.Path += "/" + key
+	}
+	u.RawPath = sosEscape(u.Path, false)
+	u.RawQuery = sosEncodeQuery(query)
+
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.ContentLength = int64(len(body))
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	c.sign(req, time.Now().UTC())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer resp.Body.Close()
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("%s %s: %w: %s", method, u.Path, &httpStatusError{StatusCode: resp.StatusCode, Status: resp.Status}, bytes.TrimSpace(msg))
+	}
+
+	return resp, nil
+}
+
+// Sign a request with AWS Signature Version 4, leaving the payload unsigned as requests go over HTTPS
+func (c *sosClient) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := []byte("AWS4" + c.secretKey)
+	for _, part := range []string{date, c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// Encode query parameters sorted by name, as expected by the signature
+func sosEncodeQuery(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			pairs = append(pairs, sosEscape(name, true)+"="+sosEscape(value, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// Percent-encode everything but unreserved characters (and slashes in paths), as expected by the signature
+func sosEscape(s string, escapeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !escapeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Locations used for the state file when none is configured, the first one with its environment variables set wins
+var defaultStatePaths = []string{
+	"$XDG_STATE_HOME/snap-o-matic/state.json",
+	"$HOME/.local/state/snap-o-matic/state.json",
+}
+
+// Snapshot created by snap-o-matic
+type snapshotRecord struct {
+	InstanceID v3.UUID   `json:"instance_id"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Snapshot protected from deletion
+type protectionRecord struct {
+	ProtectedAt time.Time `json:"protected_at"`
+	Reason      string    `json:"reason,omitempty"` // Set when snap-o-matic protected the snapshot itself
+}
+
+// Snapshot not retained anymore, deleted once it has been pending for the deletion grace period
+type pendingDeletionRecord struct {
+	MarkedAt time.Time `json:"marked_at"`
+}
+
+// Template registered by snap-o-matic from a snapshot. Templates can't be labeled, so the state file is what tags
+// them as managed.
+type templateRecord struct {
+	Kind       string      `json:"kind"` // replica or clone
+	Account    string      `json:"account,omitempty"`
+	Endpoint   v3.Endpoint `json:"endpoint"` // API endpoint of the zone of the template
+	InstanceID v3.UUID     `json:"instance_id"`
+	SnapshotID v3.UUID     `json:"snapshot_id"`
+	CreatedAt  time.Time   `json:"created_at"`
+}
+
+// Persistent state kept between runs
+type stateStore struct {
+	mu   sync.Mutex
+	path string
+
+	Snapshots map[v3.UUID]snapshotRecord   `json:"snapshots"`
+	Protected map[v3.UUID]protectionRecord `json:"protected,omitempty"`
+	Templates map[v3.UUID]templateRecord   `json:"templates,omitempty"`
+
+	PendingDeletion map[v3.UUID]pendingDeletionRecord `json:"pending_deletion,omitempty"`
+}
+
+// Get the state file path, prefer the configured one, fallback to the default locations
+func getStatePath(path string) string {
+	if path != "" {
+		return path
+	}
+
+	for _, candidate := range defaultStatePaths {
+		candidate = os.ExpandEnv(candidate)
+		if filepath.IsAbs(candidate) && !strings.HasPrefix(candidate, "/snap-o-matic/") {
+			return candidate
+		}
+	}
+
+	return "snap-o-matic-state.json"
+}
+
+// Load the state file, a missing file results in an empty state
+func loadState(path string) (*stateStore, error) {
+	state := &stateStore{
+		path:      path,
+		Snapshots: make(map[v3.UUID]snapshotRecord),
+		Protected: make(map[v3.UUID]protectionRecord),
+		Templates: make(map[v3.UUID]templateRecord),
+
+		PendingDeletion: make(map[v3.UUID]pendingDeletionRecord),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return state, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("unable to read state file: %w", err)
+	}
+
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("unable to parse state file %s: %w", path, err)
+	}
+	if state.Snapshots == nil {
+		state.Snapshots = make(map[v3.UUID]snapshotRecord)
+	}
+	if state.Protected == nil {
+		state.Protected = make(map[v3.UUID]protectionRecord)
+	}
+	if state.Templates == nil {
+		state.Templates = make(map[v3.UUID]templateRecord)
+	}
+	if state.PendingDeletion == nil {
+		state.PendingDeletion = make(map[v3.UUID]pendingDeletionRecord)
+	}
+
+	return state, nil
+}
+
+// Check whether a snapshot was created by snap-o-matic
+func (s *stateStore) isManaged(id v3.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, managed := s.Snapshots[id]
+	return managed
+}
+
+// Record a snapshot created by snap-o-matic
+func (s *stateStore) addSnapshot(id, instanceID v3.UUID, createdAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Snapshots[id] = snapshotRecord{InstanceID: instanceID, CreatedAt: createdAt}
+	return s.save()
+}
+
+// Forget a snapshot after it has been deleted
+func (s *stateStore) removeSnapshot(id v3.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Snapshots, id)
+	delete(s.PendingDeletion, id)
+	return s.save()
+}
+
+// Check whether a snapshot is protected from deletion
+func (s *stateStore) isProtected(id v3.UUID) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, protected := s.Protected[id]
+	return protected
+}
+
+// Protect a snapshot from deletion, or remove its protection
+func (s *stateStore) setProtected(id v3.UUID, protected bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if protected {
+		s.Protected[id] = protectionRecord{ProtectedAt: time.Now()}
+		delete(s.PendingDeletion, id)
+	} else {
+		delete(s.Protected, id)
+	}
+	return s.save()
+}
+
+// Protect a snapshot from deletion on behalf of its retention policy
+func (s *stateStore) protectFor(id v3.UUID, reason string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Protected[id] = protectionRecord{ProtectedAt: time.Now(), Reason: reason}
+	delete(s.PendingDeletion, id)
+	return s.save()
+}
+
+// Get why snap-o-matic protected a snapshot, empty if it isn't protected or was protected by hand
+func (s *stateStore) protectionReason(id v3.UUID) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Protected[id].Reason
+}
+
+// Get when a snapshot was marked for deletion, if it is pending deletion
+func (s *stateStore) pendingDeletionSince(id v3.UUID) (time.Time, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	record, pending := s.PendingDeletion[id]
+	return record.MarkedAt, pending
+}
+
+// Mark a snapshot for deletion, unless it already is
+func (s *stateStore) markPendingDeletion(id v3.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, pending := s.PendingDeletion[id]; pending {
+		return nil
+	}
+	s.PendingDeletion[id] = pendingDeletionRecord{MarkedAt: time.Now()}
+	return s.save()
+}
+
+// Remove the deletion mark of a snapshot which is retained again
+func (s *stateStore) unmarkPendingDeletion(id v3.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, pending := s.PendingDeletion[id]; !pending {
+		return nil
+	}
+	delete(s.PendingDeletion, id)
+	return s.save()
+}
+
+// Record a template registered by snap-o-matic
+func (s *stateStore) addTemplate(id v3.UUID, record templateRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Templates[id] = record
+	return s.save()
+}
+
+// Forget a template after it has been deleted
+func (s *stateStore) removeTemplate(id v3.UUID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.Templates, id)
+	return s.save()
+}
+
+// Get the templates of a kind registered for an instance of an account
+func (s *stateStore) instanceTemplates(kind, account string, instanceID v3.UUID) map[v3.UUID]templateRecord {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	templates := make(map[v3.UUID]templateRecord)
+	for id, record := range s.Templates {
+		if record.Kind == kind && record.Account == account && record.InstanceID == instanceID {
+			templates[id] = record
+		}
+	}
+	return templates
+}
+
+// Atomically write the state file, the caller must hold the lock
+func (s *stateStore) save() error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(s.path), 0o700); err != nil {
+		return fmt.Errorf("unable to create state directory: %w", err)
+	}
+
+	tmp := s.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return fmt.Errorf("unable to write state file: %w", err)
+	}
+
+	return os.Rename(tmp, s.path)
+}
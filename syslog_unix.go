@@ -0,0 +1,83 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+	"sync"
+)
+
+// Syslog facilities by name
+var syslogFacilities = map[string]syslog.Priority{
+	"kern": syslog.LOG_KERN, "user": syslog.LOG_USER, "mail": syslog.LOG_MAIL, "daemon": syslog.LOG_DAEMON,
+	"auth": syslog.LOG_AUTH, "syslog": syslog.LOG_SYSLOG, "lpr": syslog.LOG_LPR, "news": syslog.LOG_NEWS,
+	"uucp": syslog.LOG_UUCP, "cron": syslog.LOG_CRON, "authpriv": syslog.LOG_AUTHPRIV, "ftp": syslog.LOG_FTP,
+	"local0": syslog.LOG_LOCAL0, "local1": syslog.LOG_LOCAL1, "local2": syslog.LOG_LOCAL2, "local3": syslog.LOG_LOCAL3,
+	"local4": syslog.LOG_LOCAL4, "local5": syslog.LOG_LOCAL5, "local6": syslog.LOG_LOCAL6, "local7": syslog.LOG_LOCAL7,
+}
+
+// Connection to the local syslog daemon, writing each record with the severity of its level
+type syslogOutput struct {
+	mu    sync.Mutex
+	w     *syslog.Writer
+	level slog.Level // Of the record being written
+}
+
+func (o *syslogOutput) Write(p []byte) (int, error) {
+	msg := string(p)
+	var err error
+	switch {
+	case o.level >= slog.LevelError:
+		err = o.w.Err(msg)
+	case o.level >= slog.LevelWarn:
+		err = o.w.Warning(msg)
+	case o.level >= slog.LevelInfo:
+		err = o.w.Info(msg)
+	default:
+		err = o.w.Debug(msg)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Handler writing the records formatted by another one to syslog
+type syslogHandler struct {
+	slog.Handler
+	out *syslogOutput
+}
+
+func (h syslogHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.out.mu.Lock()
+	defer h.out.mu.Unlock()
+	h.out.level = r.Level
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h syslogHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return syslogHandler{h.Handler.WithAttrs(attrs), h.out}
+}
+
+func (h syslogHandler) WithGroup(name string) slog.Handler {
+	return syslogHandler{h.Handler.WithGroup(name), h.out}
+}
+
+// Connect to the local syslog daemon, with the given facility and tag, and route the records of the handler built
+// by newHandler to it
+func newSyslogHandler(facility, tag string, newHandler func(w io.Writer) slog.Handler) (slog.Handler, error) {
+	priority, ok := syslogFacilities[facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", facility)
+	}
+	w, err := syslog.New(priority|syslog.LOG_INFO, tag)
+	if err != nil {
+		return nil, fmt.Errorf("unable to connect to syslog: %w", err)
+	}
+	out := &syslogOutput{w: w}
+	return syslogHandler{newHandler(out), out}, nil
+}
@@ -0,0 +1,14 @@
+//go:build windows
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+)
+
+// Syslog isn't available on Windows
+func newSyslogHandler(facility, tag string, newHandler func(w io.Writer) slog.Handler) (slog.Handler, error) {
+	return nil, errors.New("syslog is not supported on Windows")
+}
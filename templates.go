@@ -0,0 +1,49 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Kinds of the templates registered by snap-o-matic
+const (
+	templateKindReplica = "replica" // Disaster recovery replica of a snapshot, pruned by retention policy
+	templateKindClone   = "clone"   // Temporary template of the clone command, deleted once the instance is created
+)
+
+// Delete a template registered by snap-o-matic and forget it
+func deleteTemplate(ctx context.Context, client *v3.Client, state *stateStore, id v3.UUID) error {
+	op, err := client.DeleteTemplate(ctx, id)
+	if err == nil {
+		_, err = operations.wait(ctx, client, op)
+	}
+	if err != nil && !errors.Is(err, v3.ErrNotFound) {
+		return err
+	}
+	return state.removeTemplate(id)
+}
+
+// Delete the clone templates of an instance which the clone command failed to delete, and return the number of
+// deleted templates
+func pruneCloneTemplates(ctx context.Context, client *v3.Client, state *stateStore, account string, instanceID v3.UUID, dryRun bool) (int, error) {
+	deleted := 0
+	for id, record := range state.instanceTemplates(templateKindClone, account, instanceID) {
+		ctx := withLogAttrs(ctx, "template_id", id)
+		if dryRun {
+			slog.InfoContext(ctx, "Dry run: leftover clone template would be deleted")
+			deleted++
+			continue
+		}
+
+		if err := deleteTemplate(ctx, client.WithEndpoint(record.Endpoint), state, id); err != nil {
+			return deleted, fmt.Errorf("unable to delete clone template %s: %w", id, err)
+		}
+		slog.InfoContext(ctx, "Deleted leftover clone template")
+		deleted++
+	}
+	return deleted, nil
+}
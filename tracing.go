@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Export of traces of the runs to an OpenTelemetry collector, over OTLP/HTTP with JSON encoding. The standard
+// OTEL_EXPORTER_OTLP_* and OTEL_SERVICE_NAME environment variables are honored as well.
+type TracingConfig struct {
+	Endpoint    string            `yaml:"endpoint"`     // Base URL of the collector, e.g. http://localhost:4318
+	Headers     map[string]string `yaml:"headers"`      // Sent along with the traces, e.g. for authentication
+	ServiceName string            `yaml:"service_name"` // Defaults to snap-o-matic
+}
+
+// Resolve the URL the traces are posted to, empty if tracing isn't configured
+func (c TracingConfig) tracesURL() string {
+	if u := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); u != "" {
+		return u
+	}
+	endpoint := cmp.Or(c.Endpoint, os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"))
+	if endpoint == "" {
+		return ""
+	}
+	return strings.TrimSuffix(endpoint, "/") + "/v1/traces"
+}
+
+// Operation of a run, such as the processing of an instance or the deletion of a snapshot
+type span struct {
+	traceID  [16]byte
+	id       [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	end      time.Time
+	attrs    []any // Key-value pairs
+	err      error
+}
+
+type spanKey struct{}
+
+// Recorder of the spans of the runs, exported at the end of each run
+type spanRecorder struct {
+	mu      sync.Mutex
+	url     string
+	headers map[string]string
+	service string
+	spans   []*span
+}
+
+// nil unless tracing is configured
+var tracer *spanRecorder
+
+func newSpanRecorder(cfg TracingConfig) *spanRecorder {
+	url := cfg.tracesURL()
+	if url == "" {
+		return nil
+	}
+
+	headers := make(map[string]string)
+	for _, header := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if key, value, ok := strings.Cut(header, "="); ok {
+			headers[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	for key, value := range cfg.Headers {
+		headers[key] = value
+	}
+
+	return &spanRecorder{
+		url:     url,
+		headers: headers,
+		service: cmp.Or(cfg.ServiceName, os.Getenv("OTEL_SERVICE_NAME"), "snap-o-matic"),
+	}
+}
+
+// Start a span as a child of the one of the context, if any. Traces of runs carry the run ID as trace ID, so that they
+// can be found from the logs. The span is nil if tracing isn't configured, which its methods accept.
+func startSpan(ctx context.Context, name string, attrs ...any) (context.Context, *span) {
+	if tracer == nil {
+		return ctx, nil
+	}
+
+	s := &span{name: name, start: time.Now(), attrs: attrs}
+	_, _ = rand.Read(s.id[:])
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parentID = parent.traceID, parent.id
+	} else if runID, err := uuid.Parse(runID(ctx)); err == nil {
+		s.traceID = runID
+	} else {
+		_, _ = rand.Read(s.traceID[:])
+	}
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// End a span, failed if err isn't nil, and record it
+func (s *span) finish(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+
+	tracer.mu.Lock()
+	defer tracer.mu.Unlock()
+	tracer.spans = append(tracer.spans, s)
+}
+
+// Send the recorded spans to the collector
+func (r *spanRecorder) export(ctx context.Context) error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	spans := r.spans
+	r.spans = nil
+	r.mu.Unlock()
+	if len(spans) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(otlpTraces(r.service, spans))
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, notificationTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, r.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range r.headers {
+		req.Header.Set(key, value)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status %q", resp.Status)
+	}
+	slog.DebugContext(ctx, "Exported traces", "spans", len(spans))
+	return nil
+}
+
+// Build the OTLP/JSON document of spans
+func otlpTraces(service string, spans []*span) map[string]any {
+	documents := make([]map[string]any, 0, len(spans))
+	for _, s := range spans {
+		doc := map[string]any{
+			"traceId":           hex.EncodeToString(s.traceID[:]),
+			"spanId":            hex.EncodeToString(s.id[:]),
+			"name":              s.name,
+			"kind":              1, // Internal
+			"startTimeUnixNano": strconv.FormatInt(s.start.UnixNano(), 10),
+			"endTimeUnixNano":   strconv.FormatInt(s.end.UnixNano(), 10),
+			"attributes":        otlpAttributes(s.attrs...),
+			"status":            map[string]any{"code": 1}, // OK
+		}
+		if s.parentID != [8]byte{} {
+			doc["parentSpanId"] = hex.EncodeToString(s.parentID[:])
+		}
+		if s.err != nil {
+			doc["status"] = map[string]any{"code": 2, "message": s.err.Error()} // Error
+		}
+		documents = append(documents, doc)
+	}
+
+	build := currentBuild()
+	return map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{"attributes": otlpAttributes("service.name", service, "service.version", build.Version)},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]any{"name": "snap-o-matic", "version": build.Version},
+				"spans": documents,
+			}},
+		}},
+	}
+}
+
+// Convert key-value pairs to OTLP attributes
+func otlpAttributes(attrs ...any) []any {
+	converted := []any{}
+	for i := 0; i+1 < len(attrs); i += 2 {
+		var value map[string]any
+		switch v := attrs[i+1].(type) {
+		case bool:
+			value = map[string]any{"boolValue": v}
+		case int:
+			value = map[string]any{"intValue": strconv.Itoa(v)}
+		case float64:
+			value = map[string]any{"doubleValue": v}
+		default:
+			value = map[string]any{"stringValue": fmt.Sprint(v)}
+		}
+		converted = append(converted, map[string]any{"key": fmt.Sprint(attrs[i]), "value": value})
+	}
+	return converted
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"regexp"
+	"strconv"
+
+	v3 "github.com/exoscale/egoscale/v3"
+	"gopkg.in/yaml.v3"
+)
+
+// Problem found in the configuration, at a line of the configuration file when known
+type configProblem struct {
+	Line    int
+	Message string
+}
+
+// Location prefix of YAML errors
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// Turn a configuration loading error into problems, with the lines YAML errors point at
+func configProblems(err error) []configProblem {
+	messages := []string{err.Error()}
+	var typeErr *yaml.TypeError
+	if errors.As(err, &typeErr) {
+		messages = typeErr.Errors
+	}
+
+	problems := []configProblem{}
+	for _, message := range messages {
+		problem := configProblem{Message: message}
+		if m := yamlLineRe.FindStringSubmatch(message); m != nil {
+			problem.Line, _ = strconv.Atoi(m[1])
+			problem.Message = m[2]
+		}
+		problems = append(problems, problem)
+	}
+	return problems
+}
+
+// Find a node of a YAML document by its path of mapping keys and sequence indexes, nil if missing
+func yamlNode(node *yaml.Node, path ...any) *yaml.Node {
+	if node != nil && node.Kind == yaml.DocumentNode && len(node.Content) > 0 {
+		node = node.Content[0]
+	}
+	for _, element := range path {
+		if node == nil {
+			return nil
+		}
+		switch key := element.(type) {
+		case string:
+			var found *yaml.Node
+			for i := 0; node.Kind == yaml.MappingNode && i+1 < len(node.Content); i += 2 {
+				if node.Content[i].Value == key {
+					found = node.Content[i+1]
+				}
+			}
+			node = found
+		case int:
+			if node.Kind != yaml.SequenceNode || key >= len(node.Content) {
+				return nil
+			}
+			node = node.Content[key]
+		}
+	}
+	return node
+}
+
+// Check whether a retention policy keeps snapshots in at least one way, unlike one only setting e.g. min_age
+func (r SnapshotRetention) keepsSnapshots() bool {
+	for _, timeframe := range r.timeframes() {
+		if timeframe.limit > 0 {
+			return true
+		}
+	}
+	return r.KeepLast > 0 || r.YearlyArchive
+}
+
+// List the settings of a retention policy which have no effect: week_start only applies to calendar timeframes,
+// timezone to them and to the yearly archive
+func (r SnapshotRetention) ineffectiveSettings() []string {
+	if r.Calendar {
+		return nil
+	}
+	var settings []string
+	if r.WeekStart != "" {
+		settings = append(settings, "week_start")
+	}
+	if r.Timezone.Location != nil && !r.YearlyArchive {
+		settings = append(settings, "timezone")
+	}
+	return settings
+}
+
+// Check a configuration file: unknown keys, invalid values, instance IDs, retention policies keeping nothing
+// and calendar settings without calendar timeframes are reported, with their line when known. Configuration fragments are checked on top of the base
+// configuration they are merged into.
+func validateConfigFile(filename, format string, base *config) (problems []configProblem) {
+	data, err := readConfigFile(filename, format, true)
+	if err != nil {
+		return configProblems(err)
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return configProblems(err)
+	}
+
+	// Lines refer to the YAML conversion of TOML files
+	defer func() {
+		if format, _ := configFormat(filename, format); format == "toml" {
+			for i := range problems {
+				problems[i].Line = 0
+			}
+		}
+	}()
+
+	cfg := config{}
+	if base != nil {
+		if err := checkFragmentKeys(&root); err != nil {
+			return configProblems(err)
+		}
+		cfg = config{Defaults: base.Defaults, Policies: maps.Clone(base.Policies)}
+	}
+	if err := decodeConfig(data, &cfg); err != nil {
+		return configProblems(err)
+	}
+
+	problems = []configProblem{}
+	check := func(node *yaml.Node, label string, instance InstanceConfig) {
+		line := 0
+		if node != nil {
+			line = node.Line
+		}
+		if err := validateInstanceSelection(instance); err != nil {
+			problems = append(problems, configProblem{line, fmt.Sprintf("%s: %s", label, err)})
+		}
+		if instance.ID != "" {
+			if _, err := v3.ParseUUID(string(instance.ID)); err != nil {
+				if id := yamlNode(node, "id"); id != nil {
+					line = id.Line
+				}
+				problems = append(problems, configProblem{line, fmt.Sprintf("%s: invalid id %q", label, instance.ID)})
+			}
+		}
+		if _, err := instance.whenStopped(cfg); err != nil {
+			problems = append(problems, configProblem{line, fmt.Sprintf("%s: %s", label, err)})
+		}
+		if !instance.Snapshots.keepsSnapshots() {
+			problems = append(problems, configProblem{line, fmt.Sprintf("%s: the retention policy keeps no snapshot, set at least one timeframe or tier", label)})
+		}
+		for _, setting := range instance.Snapshots.ineffectiveSettings() {
+			problems = append(problems, configProblem{line, fmt.Sprintf("%s: %s has no effect without calendar: true", label, setting)})
+		}
+	}
+	checkDiscovery := func(node *yaml.Node, label string, discover DiscoveryConfig) {
+		for i, id := range discover.Exclude {
+			if _, err := v3.ParseUUID(string(id)); err != nil {
+				line := 0
+				if n := yamlNode(node, "exclude", i); n != nil {
+					line = n.Line
+				}
+				problems = append(problems, configProblem{line, fmt.Sprintf("%s: invalid excluded instance id %q", label, id)})
+			}
+		}
+		if discover.Enabled && !discover.Snapshots.keepsSnapshots() {
+			problems = append(problems, configProblem{yamlNode(node).Line, fmt.Sprintf("%s: the retention policy keeps no snapshot, set at least one timeframe or tier", label)})
+		}
+		for _, setting := range discover.Snapshots.ineffectiveSettings() {
+			if discover.Enabled {
+				problems = append(problems, configProblem{yamlNode(node).Line, fmt.Sprintf("%s: %s has no effect without calendar: true", label, setting)})
+			}
+		}
+	}
+
+	for i, instance := range cfg.Instances {
+		check(yamlNode(&root, "instances", i), fmt.Sprintf("instance %d", i+1), instance)
+	}
+	for i, rule := range cfg.NeverTouch {
+		node := yamlNode(&root, "never_touch", i)
+		if err := validateNeverTouchRule(rule); err != nil {
+			problems = append(problems, configProblem{node.Line, fmt.Sprintf("never_touch %d: %s", i+1, err)})
+		} else if _, err := v3.ParseUUID(string(rule.ID)); rule.ID != "" && err != nil {
+			problems = append(problems, configProblem{yamlNode(node, "id").Line, fmt.Sprintf("never_touch %d: invalid id %q", i+1, rule.ID)})
+		}
+	}
+	if node := yamlNode(&root, "discover"); node != nil {
+		checkDiscovery(node, "discover", cfg.Discover)
+	}
+	for a, account := range cfg.Accounts {
+		label := fmt.Sprintf("account %q", account.Name)
+		for i, instance := range account.Instances {
+			check(yamlNode(&root, "accounts", a, "instances", i), fmt.Sprintf("%s: instance %d", label, i+1), instance)
+		}
+		if node := yamlNode(&root, "accounts", a, "discover"); node != nil {
+			checkDiscovery(node, label+": discover", account.Discover)
+		}
+	}
+
+	return problems
+}
+
+// Write configuration problems, with the file and line they're at
+func writeConfigProblems(w io.Writer, filename string, problems []configProblem) {
+	for _, problem := range problems {
+		if problem.Line > 0 {
+			_, _ = fmt.Fprintf(w, "%s:%d: %s\n", filename, problem.Line, problem.Message)
+		} else {
+			_, _ = fmt.Fprintf(w, "%s: %s\n", filename, problem.Message)
+		}
+	}
+}
+
+// Check that the configured instances exist, once resolved against the API
+func validateInstances(ctx context.Context, clients accountClients, cfg config) []configProblem {
+	problems := []configProblem{}
+	for _, instance := range cfg.Instances {
+		client, err := clients.get(instance.Account)
+		if err == nil {
+			_, err = client.WithEndpoint(instance.apiEndpoint(cfg.APIEndpoint)).GetInstance(ctx, instance.ID)
+		}
+		if err != nil {
+			label := "instance " + instance.ID.String()
+			if instance.Account != "" {
+				label = fmt.Sprintf("account %q: %s", instance.Account, label)
+			}
+			problems = append(problems, configProblem{Message: fmt.Sprintf("%s: %s", label, err)})
+		}
+	}
+	return problems
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Settings of the verify command
+type VerifyConfig struct {
+	MinSnapshots int      `yaml:"min_snapshots"` // Ready snapshots each instance must have, defaults to 1
+	MaxAge       duration `yaml:"max_age"`       // Age of the newest ready snapshot, defaults to max_snapshot_age, or 2 days
+}
+
+// Outcome of the verification of an instance
+type instanceVerification struct {
+	Account        string      `json:"account,omitempty" yaml:"account,omitempty"`
+	InstanceID     v3.UUID     `json:"instance_id" yaml:"instance_id"`
+	Endpoint       v3.Endpoint `json:"endpoint" yaml:"endpoint"`
+	Ready          int         `json:"ready" yaml:"ready"`     // Snapshots which can be restored
+	Errored        int         `json:"errored" yaml:"errored"` // Snapshots in error state
+	NewestSnapshot *time.Time  `json:"newest_snapshot,omitempty" yaml:"newest_snapshot,omitempty"`
+	Status         string      `json:"status" yaml:"status"` // ok, failed or disabled
+	Problems       []string    `json:"problems,omitempty" yaml:"problems,omitempty"`
+}
+
+// Check the health of the backups of the configured instances, without creating or deleting anything: each must have
+// enough ready snapshots, a recent enough one, and none in error state
+func verifyInstances(ctx context.Context, clients accountClients, cfg config, instances []InstanceConfig) ([]instanceVerification, error) {
+	minSnapshots := cmp.Or(cfg.Verify.MinSnapshots, 1)
+	now := retentionClock.Now()
+
+	verifications := []instanceVerification{}
+	indexes := newSnapshotIndexes(clients)
+	for _, instance := range instances {
+		endpoint := instance.apiEndpoint(cfg.APIEndpoint)
+		v := instanceVerification{Account: instance.Account, InstanceID: instance.ID, Endpoint: endpoint, Status: "ok"}
+		if instance.disabled() {
+			v.Status = "disabled"
+			verifications = append(verifications, v)
+			continue
+		}
+
+		index, err := indexes.get(instance.Account, endpoint)
+		if err != nil {
+			return nil, err
+		}
+		snapshots, err := index.get(ctx, instance.ID)
+		if err != nil {
+			return nil, fmt.Errorf("unable to list the snapshots of instance %s: %w", instance.ID, err)
+		}
+
+		ready := []v3.Snapshot{}
+		for _, snapshot := range snapshots {
+			switch {
+			case snapshotUsable(snapshot):
+				ready = append(ready, snapshot)
+			case snapshot.State == v3.SnapshotStateError:
+				v.Errored++
+			}
+		}
+		v.Ready = len(ready)
+
+		maxAge := cmp.Or(time.Duration(instance.MaxAge), time.Duration(cfg.Verify.MaxAge), defaultCoverageMaxAge)
+		if newest := newestSnapshot(ready); newest != nil {
+			v.NewestSnapshot = &newest.CreatedAT
+			if age := now.Sub(newest.CreatedAT); age > maxAge {
+				v.Problems = append(v.Problems, fmt.Sprintf("newest ready snapshot is %s old, more than %s", formatDuration(age.Round(time.Minute)), formatDuration(maxAge)))
+			}
+		}
+		if v.Ready < minSnapshots {
+			v.Problems = append(v.Problems, fmt.Sprintf("%d ready snapshot(s), at least %d required", v.Ready, minSnapshots))
+		}
+		if v.Errored > 0 {
+			v.Problems = append(v.Problems, fmt.Sprintf("%d snapshot(s) in error state", v.Errored))
+		}
+		if len(v.Problems) > 0 {
+			v.Status = "failed"
+		}
+		verifications = append(verifications, v)
+	}
+
+	return verifications, nil
+}
+
+// Write the verification of instances in the requested output format
+func writeVerification(w io.Writer, verifications []instanceVerification, format string) error {
+	return writeFormatted(w, verifications, format, func(tw *tabwriter.Writer) {
+		_, _ = fmt.Fprintln(tw, "INSTANCE\tREADY\tERRORED\tNEWEST SNAPSHOT\tSTATUS\tPROBLEMS")
+		for _, v := range verifications {
+			newest := "-"
+			if v.NewestSnapshot != nil {
+				newest = v.NewestSnapshot.Format(time.RFC3339)
+			}
+			_, _ = fmt.Fprintf(tw, "%s\t%d\t%d\t%s\t%s\t%s\n", v.InstanceID, v.Ready, v.Errored, newest, v.Status, cmp.Or(strings.Join(v.Problems, "; "), "-"))
+		}
+	})
+}
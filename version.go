@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Build metadata, set at build time, e.g. with -ldflags "-X main.version=1.2.3 -X main.commit=abc1234 -X main.date=..."
+var (
+	version = ""
+	commit  = ""
+	date    = ""
+)
+
+// Metadata of the running build
+type buildInfo struct {
+	Version   string
+	Commit    string
+	Date      string
+	GoVersion string
+}
+
+// Get the metadata of the running build, falling back to the one recorded by the Go toolchain (e.g. go install)
+func currentBuild() buildInfo {
+	build := buildInfo{Version: version, Commit: commit, Date: date, GoVersion: runtime.Version()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		if build.Version == "" && info.Main.Version != "(devel)" {
+			build.Version = info.Main.Version
+		}
+		for _, setting := range info.Settings {
+			switch {
+			case setting.Key == "vcs.revision" && build.Commit == "":
+				build.Commit = setting.Value[:min(len(setting.Value), 7)]
+			case setting.Key == "vcs.time" && build.Date == "":
+				build.Date = setting.Value
+			}
+		}
+	}
+	if build.Version == "" {
+		build.Version = "dev"
+	}
+	return build
+}
+
+// Get the User-Agent of the requests made by the build
+func (b buildInfo) userAgent() string {
+	return "snap-o-matic/" + b.Version
+}
+
+// Get the User-Agent identifying the API requests of a run, e.g. "snap-o-matic/1.4.0 (run 0b1c...) acme-backups"
+func requestUserAgent(ctx context.Context, suffix string) string {
+	ua := currentBuild().userAgent()
+	ua += " (run " + runID(ctx) + ")"
+	if suffix != "" {
+		ua += " " + suffix
+	}
+	return ua
+}
+
+// Get the options of the API clients, whose requests carry the User-Agent of the run before the egoscale one, are
+// rate limited per client and go through the circuit breaker of the account
+func (cfg config) clientOptions(account string) []v3.ClientOpt {
+	breaker := breakers.get(account, cfg.breakerThreshold())
+	return []v3.ClientOpt{
+		v3.ClientOptWithEndpoint(cfg.APIEndpoint),
+		v3.ClientOptWithHTTPClient(&http.Client{Transport: circuitBreakerTransport{breaker, newRateLimitedTransport(cfg.RateLimit, http.DefaultTransport)}}),
+		v3.ClientOptWithRequestInterceptors(func(ctx context.Context, req *http.Request) error {
+			req.Header.Set("User-Agent", requestUserAgent(ctx, cfg.UserAgentSuffix)+" "+req.Header.Get("User-Agent"))
+			return nil
+		}),
+	}
+}
+
+// Write the metadata of the build
+func writeVersion(w io.Writer, build buildInfo) error {
+	unknown := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return s
+	}
+	_, err := fmt.Fprintf(w, "snap-o-matic %s\ncommit: %s\nbuilt: %s\ngo: %s %s/%s\n",
+		build.Version, unknown(build.Commit), unknown(build.Date), build.GoVersion, runtime.GOOS, runtime.GOARCH)
+	return err
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"slices"
+
+	v3 "github.com/exoscale/egoscale/v3"
+)
+
+// Get the API endpoint of a zone, e.g. "de-fra-1"
+func zoneEndpoint(zone string) v3.Endpoint {
+	return v3.Endpoint(fmt.Sprintf("https://api-%s.exoscale.com/v2", zone))
+}
+
+// Get the API endpoint of the zone an instance lives in, defaulting to the configured API endpoint
+func (i InstanceConfig) apiEndpoint(fallback v3.Endpoint) v3.Endpoint {
+	switch {
+	case i.Endpoint != "":
+		return v3.Endpoint(i.Endpoint)
+	case i.Zone != "":
+		return zoneEndpoint(i.Zone)
+	default:
+		return fallback
+	}
+}
+
+// Get the API endpoints of all the zones used by the configuration, starting with the configured API endpoint
+func configuredEndpoints(cfg config) []v3.Endpoint {
+	endpoints := []v3.Endpoint{cfg.APIEndpoint}
+	add := func(endpoint v3.Endpoint) {
+		if !slices.Contains(endpoints, endpoint) {
+			endpoints = append(endpoints, endpoint)
+		}
+	}
+
+	for _, instance := range cfg.Instances {
+		add(instance.apiEndpoint(cfg.APIEndpoint))
+	}
+	for _, zone := range cfg.Discover.Zones {
+		add(zoneEndpoint(zone))
+	}
+	for _, account := range cfg.Accounts {
+		for _, zone := range account.Discover.Zones {
+			add(zoneEndpoint(zone))
+		}
+	}
+
+	return endpoints
+}